@@ -0,0 +1,413 @@
+package IM
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAuditLimit = 100
+
+	//Actions of admin api
+	AdminDisconnect = "disconnect"
+	AdminInvalidate = "invalidate"
+	AdminFilter = "filter"
+	AdminMute = "mute"
+	AdminUnmute = "unmute"
+	AdminBan = "ban"
+	AdminUnban = "unban"
+	AdminRelease = "release"
+)
+
+//Restrictions without duration last until they're lifted
+var forever = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+* Get a user to be managed, a user unknown to the store is created so that
+* restrictions on it are kept when it registers
+*/
+func (m *UserManager) managedUser(id string) *User {
+	if u, ok := m.user(id); ok {
+		return u
+	}
+
+	u := NewUser(id, "", DefaultTokenExpire, DefaultReceive)
+	u.touch()
+	m.mutex.Lock()
+	if old, ok := m.byId[id]; ok {
+		u = old
+	} else {
+		m.byId[id] = u
+	}
+	m.mutex.Unlock()
+	return u
+}
+
+/*
+* Ids of all users in the store and in cache, in order of id
+*/
+func (m *UserManager) UserIds() ([]string, error) {
+	ids, err := m.store.Ids()
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]uint8, len(ids))
+	for _, id := range ids {
+		set[id] = 0
+	}
+	for id := range m.Users() {
+		set[id] = 0
+	}
+	return sortedKeys(set), nil
+}
+
+/*
+* Mute a user until a time, a muted user can't send messages, zero time unmutes the user
+*/
+func (m *UserManager) Mute(id string, until time.Time, reason string) {
+	u := m.managedUser(id)
+
+	u.mutex.Lock()
+	u.mutedUntil = until
+	u.restrictReason = reason
+	u.mutex.Unlock()
+
+	m.save(u)
+}
+
+/*
+* Ban a user until a time, all tokens of a banned user are revoked and it can't register
+* or refresh tokens, zero time unbans the user
+*/
+func (m *UserManager) Ban(id string, until time.Time, reason string) {
+	u := m.managedUser(id)
+
+	u.mutex.Lock()
+	u.bannedUntil = until
+	u.restrictReason = reason
+	u.mutex.Unlock()
+
+	m.save(u)
+	if !until.IsZero() {
+		m.revoked.RevokeUser(id)
+		m.saveRevocations()
+		m.onRevoke(id, "")
+	}
+}
+
+/*
+* Revoke a check code and close live streams of its device, or all streams of the user
+* if the check code is not issued to a device
+*/
+func (m *UserManager) InvalidateToken(checkCode string) (*TokenClaims, error) {
+	claims, err := m.signer.Verify(checkCode)
+	if err != nil {
+		return nil, err
+	}
+
+	m.revoked.RevokeToken(claims)
+	m.saveRevocations()
+	m.onRevoke(claims.Subject, claims.Device)
+	return claims, nil
+}
+
+/*
+* Add users to and remove users from receive list("RL"), black list("BL") or mute list("ML") of a user
+*/
+func (m *UserManager) EditFilter(id string, list string, add []string, remove []string) error {
+	u, ok := m.user(id)
+	if !ok {
+		return NewSendError(http.StatusNotFound, ErrUserNotFound.Error())
+	}
+
+	u.mutex.Lock()
+	switch list {
+	case "RL":
+		u.userFilter.AddToReceiveList(add)
+		u.userFilter.RemoveFromReceiveList(remove)
+	case "BL":
+		u.userFilter.AddToBlackList(add)
+		u.userFilter.RemoveFromBlackList(remove)
+	case "ML":
+		u.userFilter.AddToMuteList(add)
+		u.userFilter.RemoveFromMuteList(remove)
+	default:
+		u.mutex.Unlock()
+		return NewSendError(http.StatusBadRequest, "Invalid list")
+	}
+	u.filterVersion++
+	u.mutex.Unlock()
+
+	m.save(u)
+	return nil
+}
+
+/*
+* Request body of admin api
+* eg: {"action":"disconnect","user":"u1"}			//close all live streams of a user
+* eg: {"action":"disconnect","user":"u1","device":"phone"}	//close live streams of a device
+* eg: {"action":"invalidate","checkCode":"xxxxx"}
+* eg: {"action":"filter","user":"u1","list":"BL","add":["u2"],"remove":["u3"]}
+* eg: {"action":"mute","user":"u1","duration":3600,"reason":"spam"}
+* eg: {"action":"ban","user":"u1","reason":"abuse"}		//ban until it's lifted
+* eg: {"action":"unban","user":"u1"}
+* eg: {"action":"release","digest":"xxxxx"}			//take content out of quarantine
+*/
+type AdminRequest struct {
+	Action string			`json:"action"`
+	User string			`json:"user,omitempty"`
+	Device string			`json:"device,omitempty"`
+	CheckCode string		`json:"checkCode,omitempty"`
+	Digest string			`json:"digest,omitempty"`			//Digest of quarantined content
+	List string			`json:"list,omitempty"`
+	Add []string			`json:"add,omitempty"`
+	Remove []string			`json:"remove,omitempty"`
+	Duration int64			`json:"duration,omitempty"`			//Seconds of a mute or ban, 0 means until it's lifted
+	Reason string			`json:"reason,omitempty"`
+}
+
+/*
+* Detail of a user returned by admin api
+*/
+type AdminUserInfo struct {
+	*UserRecord
+	Receivers map[string]int	`json:"receivers"`			//Message type -> number of live receivers
+}
+
+func (im *IM) adminUserInfo(u *User) *AdminUserInfo {
+	info := &AdminUserInfo{
+		UserRecord	: u.Record(),
+		Receivers	: make(map[string]int),
+	}
+	for mt, p := range im.consumerPools {
+		if rs, ok := p.Receivers(u.id); ok {
+			info.Receivers[mt] = rs.Len()
+		}
+	}
+	return info
+}
+
+/*
+* Content in quarantine returned by admin api, the content itself is returned only when it's released
+*/
+type QuarantineInfo struct {
+	Digest string			`json:"digest"`
+	Owner string			`json:"owner"`
+	Reason string			`json:"reason"`
+	Size int			`json:"size"`
+	Time time.Time			`json:"time"`
+	Content []byte			`json:"content,omitempty"`
+}
+
+func quarantineInfo(q *QuarantinedContent) QuarantineInfo {
+	return QuarantineInfo{
+		Digest		: q.Digest(),
+		Owner		: q.Owner(),
+		Reason		: q.Reason(),
+		Size		: len(q.Content()),
+		Time		: q.Time(),
+	}
+}
+
+/*
+* Do an admin action
+*/
+func (im *IM) adminAction(req *AdminRequest) error {
+	if req.User == "" && req.Action != AdminInvalidate {
+		return NewSendError(http.StatusBadRequest, "User missed")
+	}
+
+	until := forever
+	if req.Duration < 0 {
+		return NewSendError(http.StatusBadRequest, "Invalid duration")
+	} else if req.Duration > 0 {
+		until = time.Now().Add(time.Duration(req.Duration) * time.Second)
+	}
+
+	switch req.Action {
+	case AdminDisconnect:
+		im.closeStreams(req.User, req.Device)
+	case AdminInvalidate:
+		claims, err := im.UserManager.InvalidateToken(req.CheckCode)
+		if err != nil {
+			return NewSendError(http.StatusBadRequest, err.Error())
+		}
+		req.User = claims.Subject
+	case AdminFilter:
+		return im.UserManager.EditFilter(req.User, req.List, req.Add, req.Remove)
+	case AdminMute:
+		im.UserManager.Mute(req.User, until, req.Reason)
+	case AdminUnmute:
+		im.UserManager.Mute(req.User, time.Time{}, "")
+	case AdminBan:
+		im.UserManager.Ban(req.User, until, req.Reason)
+	case AdminUnban:
+		im.UserManager.Ban(req.User, time.Time{}, "")
+	default:
+		return NewSendError(http.StatusBadRequest, "Invalid action")
+	}
+	return nil
+}
+
+/*
+* Serve admin api for operators, every request is audited
+* Get request returns {"users":[...]} with ids of all users, or AdminUserInfo of the user
+* set by query param "user", or audit entries if query param "audit" is "true", which
+* can be filtered by "user" and limited by "limit", or {"quarantine":[...]} with
+* QuarantineInfo of contents in quarantine if query param "quarantine" is "true"
+* Post request does an action with AdminRequest in json, return AdminUserInfo of the user,
+* a release returns QuarantineInfo with the content released
+* --------------headers:---------------
+* "Secret-Key":"xxxxx"
+* --------------body(post only)--------
+* AdminRequest in json
+*/
+func (im *IM) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	entry := AuditEntry{ Actor : r.RemoteAddr }
+	fail := func(err error) {
+		entry.Result = err.Error()
+		im.audit.Record(entry)
+		writeAPIError(w, "", err)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		entry.Target = q.Get("user")
+		if q.Get("audit") == "true" {
+			entry.Action = "audit"
+		} else if q.Get("quarantine") == "true" {
+			entry.Action = "quarantine"
+		} else if entry.Target != "" {
+			entry.Action = "view"
+		} else {
+			entry.Action = "list"
+		}
+	case http.MethodPost:
+		entry.Action = "unknown"
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+		return
+	}
+
+	if !im.UserManager.CheckSecretKey(r.Header.Get("Secret-Key")) {
+		fail(NewSendError(http.StatusUnauthorized, "Invalid secret key"))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		switch entry.Action {
+		case "audit":
+			limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+			if err != nil || limit <= 0 {
+				limit = DefaultAuditLimit
+			}
+			es := im.audit.Entries(entry.Target, limit)
+			im.audit.Record(entry)
+			writeJSON(w, http.StatusOK, map[string][]AuditEntry{ "entries" : es })
+		case "quarantine":
+			qs := make([]QuarantineInfo, 0)
+			for _, q := range im.communication.QuarantinedContents() {
+				qs = append(qs, quarantineInfo(q))
+			}
+			im.audit.Record(entry)
+			writeJSON(w, http.StatusOK, map[string][]QuarantineInfo{ "quarantine" : qs })
+		case "view":
+			u, ok := im.UserManager.UserById(entry.Target)
+			if !ok {
+				fail(NewSendError(http.StatusNotFound, ErrUserNotFound.Error()))
+				return
+			}
+			im.audit.Record(entry)
+			writeJSON(w, http.StatusOK, im.adminUserInfo(u))
+		default:
+			ids, err := im.UserManager.UserIds()
+			if err != nil {
+				fail(NewSendError(http.StatusInternalServerError, err.Error()))
+				return
+			}
+			im.audit.Record(entry)
+			writeJSON(w, http.StatusOK, map[string][]string{ "users" : ids })
+		}
+		return
+	}
+
+	body, err := readLimitedBody(r, 64 * 1024)
+	if err != nil {
+		fail(err)
+		return
+	}
+	req := &AdminRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		fail(NewSendError(http.StatusBadRequest, "Invalid request json"))
+		return
+	}
+
+	entry.Action = req.Action
+	entry.Target = req.User
+	entry.Detail = adminDetail(req)
+	if req.Action == AdminRelease {
+		q, ok := im.communication.ReleaseQuarantined(req.Digest)
+		if !ok {
+			fail(NewSendError(http.StatusNotFound, "No such quarantined content"))
+			return
+		}
+		entry.Target = q.Owner()
+		im.audit.Record(entry)
+
+		info := quarantineInfo(q)
+		info.Content = q.Content()
+		writeJSON(w, http.StatusOK, &info)
+		return
+	}
+	err = im.adminAction(req)
+	entry.Target = req.User
+	if err != nil {
+		fail(err)
+		return
+	}
+	im.audit.Record(entry)
+
+	u, ok := im.UserManager.UserById(req.User)
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]string{ "status" : "ok" })
+		return
+	}
+	writeJSON(w, http.StatusOK, im.adminUserInfo(u))
+}
+
+/*
+* Params of an admin request kept in audit log, check codes are not kept
+*/
+func adminDetail(req *AdminRequest) string {
+	ps := make([]string, 0)
+	if req.Device != "" {
+		ps = append(ps, "device=" + req.Device)
+	}
+	if req.Digest != "" {
+		ps = append(ps, "digest=" + req.Digest)
+	}
+	if req.List != "" {
+		ps = append(ps, "list=" + req.List)
+	}
+	if len(req.Add) > 0 {
+		ps = append(ps, "add=" + strings.Join(req.Add, ";"))
+	}
+	if len(req.Remove) > 0 {
+		ps = append(ps, "remove=" + strings.Join(req.Remove, ";"))
+	}
+	if req.Duration > 0 {
+		ps = append(ps, fmt.Sprintf("duration=%ds", req.Duration))
+	}
+	if req.Reason != "" {
+		ps = append(ps, "reason=" + req.Reason)
+	}
+	return strings.Join(ps, " ")
+}
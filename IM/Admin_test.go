@@ -0,0 +1,90 @@
+package IM
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeAdminActions(t *testing.T) {
+	im := NewIM("localhost")
+	im.UserManager = NewUserManager("secret")
+	audit, err := NewAuditLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.audit = audit
+	im.SetCommunicationPath("/communication")
+	digest := im.communication.fileProxy.Quarantine([]byte("infected"), "u4", "virus")
+
+	cases := []struct {
+		name string
+		key string
+		body string
+		code int
+		action string
+		result string
+	}{
+		{ "wrong key", "wrong", `{"action":"mute","user":"u1"}`, http.StatusUnauthorized, "unknown", "Invalid secret key" },
+		{ "invalid json", "secret", "{", http.StatusBadRequest, "unknown", "Invalid request json" },
+		{ "user missed", "secret", `{"action":"mute"}`, http.StatusBadRequest, "mute", "User missed" },
+		{ "invalid duration", "secret", `{"action":"mute","user":"u1","duration":-1}`, http.StatusBadRequest, "mute", "Invalid duration" },
+		{ "invalid action", "secret", `{"action":"delete","user":"u1"}`, http.StatusBadRequest, "delete", "Invalid action" },
+		{ "mute", "secret", `{"action":"mute","user":"u1","duration":3600,"reason":"spam"}`, http.StatusOK, "mute", "ok" },
+		{ "ban", "secret", `{"action":"ban","user":"u2"}`, http.StatusOK, "ban", "ok" },
+		{ "invalid list", "secret", `{"action":"filter","user":"u1","list":"XL","add":["u3"]}`, http.StatusBadRequest, "filter", "Invalid list" },
+		{ "filter", "secret", `{"action":"filter","user":"u1","list":"BL","add":["u3"]}`, http.StatusOK, "filter", "ok" },
+		{ "invalid check code", "secret", `{"action":"invalidate","checkCode":"xxx"}`, http.StatusBadRequest, "invalidate", "" },
+		{ "release", "secret", `{"action":"release","digest":"` + digest + `"}`, http.StatusOK, "release", "ok" },
+		{ "release twice", "secret", `{"action":"release","digest":"` + digest + `"}`, http.StatusNotFound, "release", "No such quarantined content" },
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/admin", strings.NewReader(c.body))
+		r.Header.Set("Secret-Key", c.key)
+		w := httptest.NewRecorder()
+		im.ServeAdmin(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, w.Code, c.code)
+		}
+		es := im.audit.Entries("", 1)
+		if len(es) != 1 || es[0].Action != c.action || c.result != "" && es[0].Result != c.result {
+			t.Errorf("%s: got audit entries %+v", c.name, es)
+		}
+		im.audit.Record(AuditEntry{ Action : "separator" })
+	}
+
+	u1, _ := im.UserManager.UserById("u1")
+	u2, _ := im.UserManager.UserById("u2")
+	users := []struct {
+		name string
+		ok bool
+	}{
+		{ "u1 muted", u1 != nil && u1.Record().MutedUntil.After(u1.Record().Created) },
+		{ "u1 blocks u3", u1 != nil && u1.userFilter.IsBlocked("u3") },
+		{ "u2 banned until lifted", u2 != nil && u2.Record().BannedUntil.Equal(forever) },
+	}
+	for _, c := range users {
+		if !c.ok {
+			t.Errorf("%s: not done", c.name)
+		}
+	}
+}
+
+func TestAdminDetail(t *testing.T) {
+	cases := []struct {
+		req *AdminRequest
+		detail string
+	}{
+		{ &AdminRequest{ Action : AdminInvalidate, CheckCode : "secret code" }, "" },
+		{ &AdminRequest{ Action : AdminDisconnect, User : "u1", Device : "phone" }, "device=phone" },
+	}
+
+	for _, c := range cases {
+		if detail := adminDetail(c.req); strings.Contains(detail, "secret code") || !strings.HasPrefix(detail, c.detail) {
+			t.Errorf("%s: got detail %q", c.req.Action, detail)
+		}
+	}
+}
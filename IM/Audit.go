@@ -0,0 +1,106 @@
+package IM
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	MaxAuditEntries = 1000			//Entries kept in memory, all entries are appended to the audit file
+)
+
+/*
+* An operation done by an operator or the server, which is audited
+*/
+type AuditEntry struct {
+	Time time.Time			`json:"time"`
+	Actor string			`json:"actor"`				//Remote address of an operator, or "system"
+	Action string			`json:"action"`
+	Target string			`json:"target,omitempty"`		//User the action is done to
+	Detail string			`json:"detail,omitempty"`		//Params of the action
+	Result string			`json:"result"`				//"ok" or the error
+}
+
+/*
+* Audit log keeps the latest entries in memory, and appends every entry to a file
+* in json lines if a file is set
+*/
+type AuditLog struct {
+	mutex sync.Mutex
+
+	entries []AuditEntry
+	next int
+	file *os.File
+	path string
+}
+
+/*
+* Create an audit log, path is the file to append entries to, no file is used if it's empty
+*/
+func NewAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{
+		entries		: make([]AuditEntry, 0, MaxAuditEntries),
+	}
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+		l.path = path
+	}
+	return l, nil
+}
+
+func (l *AuditLog) Record(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Result == "" {
+		e.Result = "ok"
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.entries) < MaxAuditEntries {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+	l.next = (l.next + 1) % MaxAuditEntries
+
+	log.Printf("Audit: %s %s %s %s %s\n", e.Actor, e.Action, e.Target, e.Detail, e.Result)
+	if l.file != nil {
+		bs, err := json.Marshal(&e)
+		if err != nil {
+			return
+		}
+		if _, err := l.file.Write(append(bs, '\n')); err != nil {
+			log.Print("Fail to write audit log:", err)
+		}
+	}
+}
+
+/*
+* The latest entries in memory, newest first, filtered by target if it's set
+*/
+func (l *AuditLog) Entries(target string, limit int) []AuditEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	es := make([]AuditEntry, 0)
+	n := len(l.entries)
+	for i := 0; i < n && len(es) < limit; i++ {
+		e := l.entries[(l.next - 1 - i + n) % n]
+		if target != "" && e.Target != target {
+			continue
+		}
+		es = append(es, e)
+	}
+	return es
+}
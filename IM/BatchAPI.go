@@ -0,0 +1,174 @@
+package IM
+
+import (
+	"net/http"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+	"log"
+)
+
+const (
+	DefaultBatchConcurrency = 16
+	DefaultMaxBatchSize = 10000
+	DefaultBatchSender = "system"
+)
+
+/*
+* Request body of the batch api
+* "messages" is a list of messages to send, each of them in the format of MessageRequest
+* "message" is one message sent to each of its targets separately
+* "from" is the sender id of all messages, "system" if not set
+*
+* eg: {"from":"notice","messages":[{"type":"TextMessage","to":["u1"],"text":"a"},{"type":"TextMessage","to":["u2"],"text":"b"}]}
+* eg: {"message":{"type":"TextMessage","to":["u1","u2","u3"],"text":"maintenance at 9pm"}}
+*/
+type BatchRequest struct {
+	From string			`json:"from,omitempty"`
+	Messages []MessageRequest	`json:"messages,omitempty"`
+	Message *MessageRequest		`json:"message,omitempty"`
+}
+
+/*
+* Response body of the batch api, results are in the same order as messages of the request
+* A message sent to many targets has one result for each target in the order of its targets
+*/
+type BatchResponse struct {
+	Results []MessageResponse	`json:"results"`
+}
+
+/*
+* Expand a batch request into messages sent one by one
+*/
+func (req *BatchRequest) items() []MessageRequest {
+	items := make([]MessageRequest, 0, len(req.Messages))
+	items = append(items, req.Messages...)
+
+	if req.Message != nil {
+		for _, to := range req.Message.To {
+			item := *req.Message
+			item.To = []string{ to }
+			item.Group = ""
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+/*
+* Send a batch of messages with at most concurrency messages sending at the same time
+*/
+func (im *IM) SendBatch(senderId string, items []MessageRequest, concurrency int) []MessageResponse {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]MessageResponse, len(items))
+	tokens := make(chan int, concurrency)
+	var wg sync.WaitGroup
+
+	for i := range items {
+		tokens <- 1
+		wg.Add(1)
+
+		go func(i int) {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Print(err)
+					results[i].Status = StatusFailed
+					results[i].Error = &APIError{ Code : ErrorInternal, Message : "Fail to send message" }
+				}
+				<-tokens
+				wg.Done()
+			}()
+
+			item := &items[i]
+			results[i].ClientMsgId = item.ClientMsgId
+
+			m, err := item.toMessage(im.uploadPolicy, im.registry, senderId)
+			var id uint64
+			var dup bool
+			var at time.Time
+			if err == nil {
+				at, err = item.sendAt()
+			}
+			if err == nil {
+				id, dup, err = im.SendOrSchedule(m, item.ClientMsgId, at)
+			}
+
+			if err != nil {
+				_, results[i].Error = NewAPIError(err)
+				results[i].Status = StatusFailed
+			} else if dup {
+				results[i].Id = strconv.FormatUint(id, 10)
+				results[i].Status = StatusDuplicate
+			} else if !at.IsZero() {
+				results[i].Id = strconv.FormatUint(id, 10)
+				results[i].Status = StatusScheduled
+			} else {
+				results[i].Id = strconv.FormatUint(id, 10)
+				results[i].Status = StatusQueued
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	return results
+}
+
+/*
+* Serve the batch api, which is used by servers holding the secret key
+* --------------headers:---------------
+* "Secret-Key":"xxxxx"
+* "Content-Type":"application/json"
+* --------------body-------------------
+* BatchRequest in json
+*
+* Return BatchResponse in json, each result is "queued" or "failed" with an error
+*/
+func (im *IM) ServeBatchAPI(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only post is allowed"))
+		return
+	}
+
+	if !im.UserManager.CheckSecretKey(r.Header.Get("Secret-Key")) {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Secret key not match"))
+		return
+	}
+
+	body, err := readLimitedBody(r, im.uploadPolicy.MaxRequestSize() * 2)
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	req := &BatchRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid batch json"))
+		return
+	}
+
+	items := req.items()
+	if len(items) == 0 {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "No message to send"))
+		return
+	}
+	if len(items) > im.maxBatchSize {
+		writeAPIError(w, "", NewSendError(http.StatusRequestEntityTooLarge, "Too many messages in a batch"))
+		return
+	}
+
+	senderId := req.From
+	if senderId == "" {
+		senderId = DefaultBatchSender
+	}
+
+	writeJSON(w, http.StatusOK, &BatchResponse{
+		Results		: im.SendBatch(senderId, items, im.batchConcurrency),
+	})
+}
@@ -0,0 +1,73 @@
+package IM
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBatchRequestItems(t *testing.T) {
+	req := &BatchRequest{
+		Messages	: []MessageRequest{
+			{ Type : TextMessageType, To : []string{ "u1" }, Text : "a" },
+		},
+		Message		: &MessageRequest{ Type : TextMessageType, To : []string{ "u2", "u3" }, Group : "g", Text : "b" },
+	}
+
+	cases := []struct {
+		to []string
+		group string
+		text string
+	}{
+		{ []string{ "u1" }, "", "a" },
+		{ []string{ "u2" }, "", "b" },
+		{ []string{ "u3" }, "", "b" },
+	}
+
+	items := req.items()
+	if len(items) != len(cases) {
+		t.Fatalf("got %d items, want %d", len(items), len(cases))
+	}
+	for i, c := range cases {
+		if !reflect.DeepEqual(items[i].To, c.to) || items[i].Group != c.group || items[i].Text != c.text {
+			t.Errorf("item %d: got %+v", i, items[i])
+		}
+	}
+	if len(req.Message.To) != 2 || req.Message.Group != "g" {
+		t.Errorf("message of the request is changed: %+v", req.Message)
+	}
+}
+
+func TestServeBatchAPIRejected(t *testing.T) {
+	im := NewIM("localhost")
+	im.UserManager = NewUserManager("secret")
+	im.SetBatchPath("/batch", 1, 2)
+
+	text := `{"type":"TextMessage","to":["u1"],"text":"a"}`
+	cases := []struct {
+		name string
+		method string
+		key string
+		body string
+		code int
+	}{
+		{ "get", http.MethodGet, "secret", "", http.StatusMethodNotAllowed },
+		{ "wrong key", http.MethodPost, "wrong", `{"messages":[` + text + `]}`, http.StatusUnauthorized },
+		{ "invalid json", http.MethodPost, "secret", "{", http.StatusBadRequest },
+		{ "no message", http.MethodPost, "secret", `{"messages":[]}`, http.StatusBadRequest },
+		{ "too many messages", http.MethodPost, "secret", `{"messages":[` + text + `],"message":{"type":"TextMessage","to":["u2","u3"],"text":"b"}}`, http.StatusRequestEntityTooLarge },
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/batch", strings.NewReader(c.body))
+		r.Header.Set("Secret-Key", c.key)
+		w := httptest.NewRecorder()
+		im.ServeBatchAPI(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, w.Code, c.code)
+		}
+	}
+}
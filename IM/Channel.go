@@ -1,6 +1,7 @@
 package IM
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 	"errors"
@@ -38,6 +39,10 @@ type ChannelGroup struct {
 	sendingMessage chan Message		//Sending message chan
 	channels [] Channel			//A group of channels handle the same type of message
 	gm GroupManager				//A group manager of this channel group
+
+	mutex sync.Mutex
+	partitions []chan Message		//Incoming message chan of each channel in ordering mode
+	bound map[*BaseChannel]chan Message	//Partition bound to each channel
 }
 
 /*
@@ -76,6 +81,51 @@ func NewChannelGroup(n ChannelNewer, mt string, channelNum uint32, channelBuffer
 	return &g
 }
 
+/*
+* In ordering mode, every channel has its own incoming message chan, and messages of the same
+* conversation always go to the same channel. Must be called before channels start
+*/
+func (g *ChannelGroup) SetOrdered() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.partitions = make([]chan Message, len(g.channels))
+	for i := range g.partitions {
+		g.partitions[i] = make(chan Message, cap(g.incomingMessage))
+	}
+	g.bound = make(map[*BaseChannel]chan Message)
+}
+
+/*
+* Incoming chan of a message
+*/
+func (g *ChannelGroup) incoming(m Message) chan Message {
+	if len(g.partitions) == 0 {
+		return g.incomingMessage
+	}
+	return g.partitions[partitionIndex(ConversationKey(m), len(g.partitions))]
+}
+
+/*
+* Incoming chan of a channel, a channel keeps its partition when it restarts
+*/
+func (g *ChannelGroup) channelIncoming(c *BaseChannel) chan Message {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if len(g.partitions) == 0 {
+		return g.incomingMessage
+	}
+
+	if p, ok := g.bound[c]; ok {
+		return p
+	}
+
+	p := g.partitions[len(g.bound) % len(g.partitions)]
+	g.bound[c] = p
+	return p
+}
+
 /*
 * Register message classifiers
 */
@@ -113,15 +163,21 @@ func (g *ChannelGroup) StopChannels() {
 		c.Stop()
 	}
 
+	incomings := append([]chan Message{ g.incomingMessage }, g.partitions...)
+	for _, incoming := range incomings {
+		drain(incoming)
+	}
+}
+
+func drain(incoming chan Message) {
 	for {
 		select {
-		case m := <-g.incomingMessage:
+		case m := <-incoming:
 			m.Finish(errors.New("Channel stoped"))
 		default:
-			goto exit
+			return
 		}
 	}
-	exit:
 }
 
 func (g *ChannelGroup) Metrics() []interface{} {
@@ -154,6 +210,7 @@ func (c *BaseChannel) StartChannelLoop(g *ChannelGroup)  {
 	}
 
 	atomic.StoreUint32(&c.stateFlag, 1)
+	incoming := g.channelIncoming(c)
 
 	go func() {
 		//Restart Channel when it's down
@@ -170,7 +227,7 @@ func (c *BaseChannel) StartChannelLoop(g *ChannelGroup)  {
 				break
 			}
 
-			message := <-g.incomingMessage
+			message := <-incoming
 
 			message.OnReceived()
 
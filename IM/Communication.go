@@ -3,6 +3,10 @@ package IM
 import (
 	"net/http"
 	"errors"
+	"strconv"
+	"strings"
+	"sort"
+	"time"
 	"log"
 )
 
@@ -44,6 +48,19 @@ func NewCommunication(im *IM) *Communication {
 	}
 }
 
+/*
+* Register parsers of all types in the registry to the broker, parsers are read by every
+* connection, so they are registered once before serving
+*/
+func (c *Communication) registerParsers() {
+	for _, name := range c.im.registry.Types() {
+		if t, ok := c.im.registry.Lookup(name); ok {
+			parse := t.Parse
+			c.broker.AddParseFunc(name, func(ms []Message) []*Frame { return parse(c, ms) })
+		}
+	}
+}
+
 func (c *Communication) FetchFile(name string) ([]byte, error) {
 	if f, err := c.imageProxy.FetchFile(name); err == nil {
 		return f, nil
@@ -54,6 +71,42 @@ func (c *Communication) FetchFile(name string) ([]byte, error) {
 	}
 }
 
+/*
+* Storage used by files uploaded by a user
+*/
+func (c *Communication) StorageUsage(id string) int64 {
+	return c.imageProxy.OwnerUsage(id) + c.fileProxy.OwnerUsage(id)
+}
+
+/*
+* Meta shared by frames of all message types, parsers of registered types should add it to their frames
+*/
+func (c *Communication) AddCommonMeta(f *Frame, m Message) {
+	f.AddMeta(MessageId, strconv.FormatUint(m.Id(), 10))
+	f.AddMeta(Sender, m.SenderId())
+	c.im.addProfileMeta(f, m)
+	if m.IsGroupMessage() {
+		f.AddMeta(Group, m.GroupName())
+	}
+	if m.Sequence() > 0 {
+		f.AddMeta(Sequence, strconv.FormatUint(m.Sequence(), 10))
+		f.AddMeta(SequenceScope, strconv.FormatUint(m.SequenceScope(), 10))
+	}
+	if at := m.ExpireAt(); !at.IsZero() {
+		f.AddMeta(Expire, strconv.FormatInt(at.UnixNano() / int64(time.Millisecond), 10))
+	} else if ttl, afterRead := m.Expiry(); ttl > 0 && afterRead {
+		f.AddMeta(TTL, strconv.FormatInt(int64(ttl / time.Second), 10))
+	}
+	if m.ParentId() > 0 {
+		f.AddMeta(Parent, strconv.FormatUint(m.ParentId(), 10))
+		if c.im.history != nil {
+			if p, ok := c.im.history.Get(m.ParentId()); ok {
+				f.AddMeta(Quote, p.Snippet(DefaultQuoteLength))
+			}
+		}
+	}
+}
+
 /*
 * Parser func used to parse relative message
 */
@@ -64,9 +117,9 @@ func (c *Communication) parseText(ms []Message) []*Frame {
 			fs[i] = NewFrame(TextMessageType, s)
 		} else { fs[i] = NewFrame(TextMessageType, ""); }
 
-		fs[i].AddMeta(Sender, m.SenderId())
-		if m.IsGroupMessage() {
-			fs[i].AddMeta(Group, m.GroupName())
+		c.AddCommonMeta(fs[i], m)
+		if tm, ok := m.(*TextMessage); ok && len(tm.Mentions()) > 0 {
+			fs[i].AddMeta(Mentions, strings.Join(tm.Mentions(), ";"))
 		}
 	}
 
@@ -78,15 +131,12 @@ func (c *Communication) parseImage(ms []Message) []*Frame {
 	for i, m := range ms {
 		if pm, ok := m.(*PictureMessage); ok {
 			if bs, ok := pm.Content().([]byte); ok {
-				url := c.imageProxy.AddDisposalFileWithRestfulAPI(bs, pm.Suffix())
+				url := c.imageProxy.AddDisposalFileWithRestfulAPI(bs, pm.Suffix(), pm.SenderId())
 				fs[i] = NewFrame(PictureMessageType, url)
 			} else { fs[i] = NewFrame(PictureMessageType, "") }
 		} else { fs[i] = NewFrame(PictureMessageType, "") }
 
-		fs[i].AddMeta(Sender, m.SenderId())
-		if m.IsGroupMessage() {
-			fs[i].AddMeta(Group, m.GroupName())
-		}
+		c.AddCommonMeta(fs[i], m)
 	}
 
 	return fs
@@ -97,11 +147,66 @@ func (c *Communication) parseFile(ms []Message) []*Frame {
 	for i, m := range ms {
 		if pm, ok := m.(*FileMessage); ok {
 			if bs, ok := pm.Content().([]byte); ok {
-				url := c.fileProxy.AddDisposalNamedFileWithRestfulAPI(bs, pm.FileName())
+				url := c.fileProxy.AddDisposalNamedFileWithRestfulAPI(bs, pm.FileName(), pm.SenderId())
 				fs[i] = NewFrame(FileMessageType, url)
 			} else { fs[i] = NewFrame(PictureMessageType, "") }
 		} else { fs[i] = NewFrame(PictureMessageType, "") }
 
+		c.AddCommonMeta(fs[i], m)
+	}
+
+	return fs
+}
+func (c *Communication) parseVoice(ms []Message) []*Frame {
+	fs := make([]*Frame, len(ms))
+
+	for i, m := range ms {
+		if vm, ok := m.(*VoiceMessage); ok {
+			if bs, ok := vm.Content().([]byte); ok {
+				url := c.fileProxy.AddDisposalFileWithRestfulAPI(bs, vm.Format(), vm.SenderId())
+				fs[i] = NewFrame(VoiceMessageType, url)
+			} else { fs[i] = NewFrame(VoiceMessageType, "") }
+			fs[i].AddMeta(Duration, strconv.FormatInt(vm.Duration(), 10))
+			fs[i].AddMeta(Waveform, EncodeWaveform(vm.Waveform()))
+		} else { fs[i] = NewFrame(VoiceMessageType, "") }
+
+		c.AddCommonMeta(fs[i], m)
+	}
+
+	return fs
+}
+
+/*
+* Parse messages whose content is sent to clients in json, such as location, contact card and sticker
+*/
+func (c *Communication) parseJSON(ms []Message) []*Frame {
+	fs := make([]*Frame, len(ms))
+
+	for i, m := range ms {
+		if bs, err := m.OnBinary(); err == nil {
+			fs[i] = NewFrame(m.Type(), string(bs))
+		} else { fs[i] = NewFrame(m.Type(), "") }
+
+		c.AddCommonMeta(fs[i], m)
+	}
+
+	return fs
+}
+func (c *Communication) parseNotice(ms []Message) []*Frame {
+	fs := make([]*Frame, len(ms))
+
+	for i, m := range ms {
+		if nm, ok := m.(*NoticeMessage); ok {
+			content, _ := nm.Content().(string)
+			fs[i] = NewFrame(nm.Kind(), content)
+			for k, v := range nm.Meta() {
+				fs[i].AddMeta(k, v)
+			}
+		} else { fs[i] = NewFrame(NoticeMessageType, "") }
+
+		if _, ok := fs[i].Meta[MessageId]; !ok {
+			fs[i].AddMeta(MessageId, strconv.FormatUint(m.Id(), 10))
+		}
 		fs[i].AddMeta(Sender, m.SenderId())
 		if m.IsGroupMessage() {
 			fs[i].AddMeta(Group, m.GroupName())
@@ -110,6 +215,42 @@ func (c *Communication) parseFile(ms []Message) []*Frame {
 
 	return fs
 }
+
+/*
+* Keep content of a rejected message in quarantine, return the digest of the content
+*/
+func (c *Communication) Quarantine(m Message, reason string) (string, error) {
+	content, err := m.OnBinary()
+	if err != nil {
+		return "", err
+	}
+
+	if m.Type() == PictureMessageType {
+		return c.imageProxy.Quarantine(content, m.SenderId(), reason), nil
+	} else {
+		return c.fileProxy.Quarantine(content, m.SenderId(), reason), nil
+	}
+}
+
+/*
+* Contents in quarantine of all proxies in order of time
+*/
+func (c *Communication) QuarantinedContents() []*QuarantinedContent {
+	qs := append(c.imageProxy.QuarantinedContents(), c.fileProxy.QuarantinedContents()...)
+	sort.Slice(qs, func(i, j int) bool { return qs[i].Time().Before(qs[j].Time()) })
+	return qs
+}
+
+/*
+* Take content out of quarantine of the proxy keeping it
+*/
+func (c *Communication) ReleaseQuarantined(digest string) (*QuarantinedContent, bool) {
+	if q, ok := c.imageProxy.ReleaseQuarantined(digest); ok {
+		return q, true
+	}
+	return c.fileProxy.ReleaseQuarantined(digest)
+}
+
 func (c *Communication) AddMessageFilter(filter MessageFilter) {
 	c.broker.AddFilter(filter)
 }
@@ -123,16 +264,26 @@ func (c *Communication) ClearMessageFilter() {
 * communicationURL/(checkCode)
 */
 func (c *Communication) Start(w http.ResponseWriter, r *http.Request, checkCode string) {
-	if u, err := c.im.Validate(checkCode); err != nil {
+	if u, claims, err := c.im.UserManager.ValidateClaims(checkCode); err != nil {
 		log.Print(err)
 		return
+	} else if err := c.im.checkRate(RateConnectUser, u.id); err != nil {
+		WriteSendError(w, err)
+		return
 	} else {
-		c.broker.AddParseFunc(TextMessageType, c.parseText)
-		c.broker.AddParseFunc(PictureMessageType, c.parseImage)
-		c.broker.AddParseFunc(FileMessageType, c.parseFile)
 		communications[u.id] = c
-		c.broker.ClearFilter()
-		c.broker.AddFilter(&u.userFilter)
-		c.broker.StartProxy(u.id, w)
+
+		//the filter of the user applies to its own connection only
+		if claims.Device == "" {
+			c.broker.StartDeviceProxy(u.id, nil, &u.userFilter, w, nil)
+			return
+		}
+
+		//a device connecting for the first time catches up nothing
+		d, _ := u.Device(claims.Device, claims.Platform)
+		if d.Cursor() == 0 {
+			d.Advance(c.im.nextMessageId())
+		}
+		c.broker.StartDeviceProxy(u.id, d, &u.userFilter, w, func() []Message { return c.im.catchUp(u.id, d) })
 	}
 }
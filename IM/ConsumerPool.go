@@ -28,6 +28,7 @@ type ConsumerPool interface {
 	Get() *Consumer							//Get a consumer
 	Recycle(c *Consumer)						//Recycle consumer
 	ReceiveMessages(string, bool) (*MessageReceiver, error)		//Get a receiver which is a broker between consumer and user
+	ReceiveDeviceMessages(string, string, bool) (*MessageReceiver, error)	//Get a receiver of a device of the user
 	CloseReceiver(*MessageReceiver)
 	Receivers(id string) (*ReceiverList, bool)
 }
@@ -49,6 +50,27 @@ func NewConsumerPool(onNewReceiver func(string),
 	return pool
 }
 
+/*
+* Consumer pool used in ordering mode, messages of the same conversation are always dispatched
+* by the same consumer one by one, so they keep their order
+*/
+func NewOrderedConsumerPool(onNewReceiver func(string),
+	onMessageTargetMiss func(Message, string) error, partitionNum int) ConsumerPool {
+
+	if partitionNum < 1 {
+		partitionNum = 1
+	}
+
+	pool := NewConsumerPool(onNewReceiver, onMessageTargetMiss).(*DefaultConsumerPool)
+	pool.partitions = make([]*Consumer, partitionNum)
+	for i := range pool.partitions {
+		pool.partitions[i] = NewConsumer(pool)
+		pool.partitions[i].dedicated = true
+	}
+
+	return pool
+}
+
 /*
 * A list of receivers with same id. This allows many receivers listen
 * to the same consumer with a unique id
@@ -62,7 +84,7 @@ type ReceiverList struct {
 */
 func (l *ReceiverList) ClearReceivers() {
 	l.mutex.Lock()
-	l.mutex.Unlock()
+	defer l.mutex.Unlock()
 
 	for r := range l.receivers {
 		r.Stop()
@@ -70,6 +92,38 @@ func (l *ReceiverList) ClearReceivers() {
 
 	l.receivers = make(map[*MessageReceiver]uint8)
 }
+/*
+* Clear receivers of a device
+*/
+func (l *ReceiverList) ClearDevice(device string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for r := range l.receivers {
+		if r.device == device {
+			r.Stop()
+			delete(l.receivers, r)
+		}
+	}
+}
+func (l *ReceiverList) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.receivers)
+}
+func (l *ReceiverList) DeviceCount(device string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	n := 0
+	for r := range l.receivers {
+		if r.device == device {
+			n++
+		}
+	}
+	return n
+}
 func (l *ReceiverList) AddReceivers(recs... *MessageReceiver) {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
@@ -99,6 +153,7 @@ type DefaultConsumerPool struct {
 
 	//consumers map[string]*Consumer					//consumers
 	restConsumers *list.List
+	partitions []*Consumer							//Dedicated consumers in ordering mode
 	receivers map[string]*ReceiverList
 	onNewReceiver func(string)						//Called when a new receiver with a new id is registered
 	onMessageTargetMissCallback func(Message, string) error			//Called when message target is not cached
@@ -108,6 +163,11 @@ func (p *DefaultConsumerPool) OnNewReceiver(id string) {
 }
 func (p *DefaultConsumerPool) OnMessageTargetMiss(m Message, id string) error { return p.onMessageTargetMissCallback(m, id); }
 func (p *DefaultConsumerPool) Consume(m Message) {
+	if len(p.partitions) > 0 {
+		p.partitions[partitionIndex(ConversationKey(m), len(p.partitions))].Consume(m)
+		return
+	}
+
 	cos := p.Get()
 	cos.Consume(m)
 }
@@ -188,20 +248,27 @@ func (p *DefaultConsumerPool) Stop() {
 * with the target id
 */
 func (p *DefaultConsumerPool) ReceiveMessages(id string, race bool) (*MessageReceiver, error) {
+	return p.ReceiveDeviceMessages(id, "", race)
+}
+/*
+* Obtain a message receiver of a device, in race mode only receivers of the same device
+* are kicked, and a receiver without device kicks all receivers
+*/
+func (p *DefaultConsumerPool) ReceiveDeviceMessages(id string, device string, race bool) (*MessageReceiver, error) {
 	if rs, ok := p.receivers[id]; ok {
-		if race {
-			rec := NewMessageReceiver(p, id)
-
-			rs.ClearReceivers()
-			rs.AddReceivers(rec)
-
-			return rec, nil
-		} else {
-			rec := NewMessageReceiver(p, id)
-			p.receivers[id].AddReceivers(rec)
+		rec := NewMessageReceiver(p, id)
+		rec.device = device
 
-			return rec, nil
+		if race {
+			if device == "" {
+				rs.ClearReceivers()
+			} else {
+				rs.ClearDevice(device)
+			}
 		}
+		rs.AddReceivers(rec)
+
+		return rec, nil
 	} else {
 		go func() {
 			defer func() {
@@ -214,6 +281,7 @@ func (p *DefaultConsumerPool) ReceiveMessages(id string, race bool) (*MessageRec
 		}()
 
 		rec := NewMessageReceiver(p, id)
+		rec.device = device
 		p.mutex.Lock()
 		p.receivers[id] = NewReceiverList(rec)
 		p.mutex.Unlock()
@@ -232,6 +300,7 @@ type MessageReceiver struct {
 	ReceiveChan chan Message		//This chan notify user that message is coming
 	state uint32				//Is this receiver is in use
 	id string
+	device string				//Device of the user, empty if the client doesn't tell
 
 	consumePool ConsumerPool
 }
@@ -268,6 +337,7 @@ type Consumer struct {
 
 	messageChan chan Message
 	running uint32
+	dedicated bool				//A dedicated consumer is never recycled
 }
 
 func NewConsumer(pool ConsumerPool) *Consumer {
@@ -294,7 +364,9 @@ func (c *Consumer) Consume(m Message) {
 					log.Print(err)
 
 					atomic.StoreUint32(&c.running, 0)
-					c.consumerPool.Recycle(c)
+					if !c.dedicated {
+						c.consumerPool.Recycle(c)
+					}
 				}
 			}()
 
@@ -306,7 +378,9 @@ func (c *Consumer) Consume(m Message) {
 				}
 
 				c.dispatch(message)
-				c.consumerPool.Recycle(c)
+				if !c.dedicated {
+					c.consumerPool.Recycle(c)
+				}
 			}
 		}()
 	}
@@ -321,6 +395,12 @@ func (c *Consumer) dispatch(m Message) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
+	//message expired while it's held in channel buffers
+	if IsExpired(m) {
+		m.Finish(ErrMessageExpired)
+		return
+	}
+
 	var tids []string
 
 	if m.IsGroupMessage() {
@@ -336,6 +416,7 @@ func (c *Consumer) dispatch(m Message) {
 			for r := range rs.receivers {
 				select {
 				case r.ReceiveChan <- m:
+					m.Finish(nil)
 				default:
 					log.Print("Message dropped because receiver chan is busy")
 					m.Finish(errors.New("Message dropped because receiver chan is busy"))
@@ -349,7 +430,7 @@ func (c *Consumer) dispatch(m Message) {
 					}
 				}()
 
-				c.consumerPool.OnMessageTargetMiss(m, tid)
+				m.Finish(c.consumerPool.OnMessageTargetMiss(m, tid))
 				log.Print("Message Target Miss")
 			}()
 		}
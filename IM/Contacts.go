@@ -0,0 +1,382 @@
+package IM
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	MaxPendingFriendRequests = 100			//Max pending friend requests sent by a user
+	MaxFriendRequestMessage = 256			//Max length of the message of a friend request
+
+	//Frame kinds of notices about friend requests and contacts
+	FriendRequested = "FriendRequested"
+	FriendAccepted = "FriendAccepted"
+	FriendDeclined = "FriendDeclined"
+	FriendCancelled = "FriendCancelled"
+	ContactRemoved = "ContactRemoved"
+
+	//Actions of contact api
+	ContactActionRequest = "request"
+	ContactActionAccept = "accept"
+	ContactActionDecline = "decline"
+	ContactActionCancel = "cancel"
+	ContactActionRemove = "remove"
+)
+
+/*
+* A pending friend request, kept by both the sender and the receiver
+*/
+type FriendRequest struct {
+	From string			`json:"from"`
+	To string			`json:"to"`
+	Message string			`json:"message,omitempty"`
+	Created time.Time		`json:"created"`
+}
+
+/*
+* Pending friend requests of a user, sent by or sent to the user
+*/
+func (u *User) FriendRequests() (incoming []FriendRequest, outgoing []FriendRequest) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	incoming = make([]FriendRequest, 0)
+	outgoing = make([]FriendRequest, 0)
+	for _, fr := range u.requests {
+		if fr.To == u.id {
+			incoming = append(incoming, *fr)
+		} else {
+			outgoing = append(outgoing, *fr)
+		}
+	}
+	sort.Slice(incoming, func(i, j int) bool { return incoming[i].Created.Before(incoming[j].Created) })
+	sort.Slice(outgoing, func(i, j int) bool { return outgoing[i].Created.Before(outgoing[j].Created) })
+
+	return incoming, outgoing
+}
+
+/*
+* Get a pending request between the user and another user
+*/
+func (u *User) friendRequest(other string) (*FriendRequest, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	fr, ok := u.requests[other]
+	return fr, ok
+}
+
+func (u *User) setFriendRequest(other string, fr *FriendRequest) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if fr == nil {
+		delete(u.requests, other)
+	} else {
+		u.requests[other] = fr
+	}
+}
+
+func (u *User) outgoingRequests() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	n := 0
+	for _, fr := range u.requests {
+		if fr.From == u.id {
+			n++
+		}
+	}
+	return n
+}
+
+/*
+* Contacts of the user in order of id
+*/
+func (u *User) Contacts() []string {
+	return u.userFilter.sorted(u.userFilter.contacts)
+}
+
+func (u *User) IsContact(id string) bool {
+	return u.userFilter.IsContact(id)
+}
+
+/*
+* Two users to change their relation, the contact mutex must be held
+*/
+func (m *UserManager) pair(id string, other string) (*User, *User, error) {
+	if id == other || other == "" {
+		return nil, nil, NewSendError(http.StatusBadRequest, "Invalid user")
+	}
+
+	u, ok := m.user(id)
+	if !ok {
+		return nil, nil, NewSendError(http.StatusNotFound, ErrUserNotFound.Error())
+	}
+	o, ok := m.user(other)
+	if !ok {
+		return nil, nil, NewSendError(http.StatusNotFound, ErrUserNotFound.Error())
+	}
+	return u, o, nil
+}
+
+/*
+* Make two users contacts of each other and remove the requests between them
+*/
+func (m *UserManager) addContact(u *User, o *User) {
+	u.mutex.Lock()
+	u.userFilter.AddContacts([]string{ o.id })
+	u.filterVersion++
+	u.mutex.Unlock()
+	u.setFriendRequest(o.id, nil)
+
+	o.mutex.Lock()
+	o.userFilter.AddContacts([]string{ u.id })
+	o.filterVersion++
+	o.mutex.Unlock()
+	o.setFriendRequest(u.id, nil)
+
+	m.save(u)
+	m.save(o)
+	m.onContact(FriendAccepted, u.id, o.id, "")
+}
+
+/*
+* Send a friend request, if the other user has sent a request to the user,
+* both requests are accepted at once
+* A request to a user who blocked the sender looks the same to the sender, but it's
+* kept only by the sender and never reaches the other user, so that a block is never leaked
+*/
+func (m *UserManager) RequestFriend(id string, to string, message string) error {
+	if len(message) > MaxFriendRequestMessage {
+		return NewSendError(http.StatusBadRequest, "Message too long")
+	}
+
+	m.contactMutex.Lock()
+	defer m.contactMutex.Unlock()
+
+	u, o, err := m.pair(id, to)
+	if err != nil {
+		return err
+	}
+	if u.IsContact(to) {
+		return NewSendError(http.StatusConflict, "Already a contact")
+	}
+	if fr, ok := u.friendRequest(to); ok {
+		if fr.From == to {
+			m.addContact(u, o)
+			return nil
+		}
+		return NewSendError(http.StatusConflict, "Friend request is pending")
+	}
+	if u.outgoingRequests() >= MaxPendingFriendRequests {
+		return NewSendError(http.StatusTooManyRequests, "Too many pending friend requests")
+	}
+
+	fr := &FriendRequest{
+		From		: id,
+		To		: to,
+		Message		: message,
+		Created		: time.Now(),
+	}
+	u.setFriendRequest(to, fr)
+	m.save(u)
+	if !o.userFilter.IsBlocked(id) {
+		o.setFriendRequest(id, fr)
+		m.save(o)
+	}
+
+	//the notice to a user who blocked the sender is dropped by its filter
+	m.onContact(FriendRequested, id, to, message)
+	return nil
+}
+
+/*
+* Accept or decline a friend request sent by from
+*/
+func (m *UserManager) AnswerFriend(id string, from string, accept bool) error {
+	m.contactMutex.Lock()
+	defer m.contactMutex.Unlock()
+
+	u, o, err := m.pair(id, from)
+	if err != nil {
+		return err
+	}
+	if fr, ok := u.friendRequest(from); !ok || fr.From != from {
+		return NewSendError(http.StatusNotFound, "No such friend request")
+	}
+
+	if accept {
+		m.addContact(u, o)
+		return nil
+	}
+
+	u.setFriendRequest(from, nil)
+	o.setFriendRequest(id, nil)
+	m.save(u)
+	m.save(o)
+	m.onContact(FriendDeclined, id, from, "")
+	return nil
+}
+
+/*
+* Cancel a friend request sent to another user
+*/
+func (m *UserManager) CancelFriend(id string, to string) error {
+	m.contactMutex.Lock()
+	defer m.contactMutex.Unlock()
+
+	u, o, err := m.pair(id, to)
+	if err != nil {
+		return err
+	}
+	if fr, ok := u.friendRequest(to); !ok || fr.From != id {
+		return NewSendError(http.StatusNotFound, "No such friend request")
+	}
+
+	u.setFriendRequest(to, nil)
+	o.setFriendRequest(id, nil)
+	m.save(u)
+	m.save(o)
+	m.onContact(FriendCancelled, id, to, "")
+	return nil
+}
+
+/*
+* Remove a contact, the user is removed from contacts of the other user too
+*/
+func (m *UserManager) RemoveContact(id string, other string) error {
+	m.contactMutex.Lock()
+	defer m.contactMutex.Unlock()
+
+	u, o, err := m.pair(id, other)
+	if err != nil {
+		return err
+	}
+	if !u.IsContact(other) {
+		return NewSendError(http.StatusNotFound, "No such contact")
+	}
+
+	u.mutex.Lock()
+	u.userFilter.RemoveContacts([]string{ other })
+	u.filterVersion++
+	u.mutex.Unlock()
+
+	o.mutex.Lock()
+	o.userFilter.RemoveContacts([]string{ id })
+	o.filterVersion++
+	o.mutex.Unlock()
+
+	m.save(u)
+	m.save(o)
+	m.onContact(ContactRemoved, id, other, "")
+	return nil
+}
+
+/*
+* Tell both users that their relation changed, from is the user who changes it,
+* so that other devices of the user are synced
+*/
+func (im *IM) notifyContact(kind string, from string, to string, content string) {
+	for _, pair := range [][2]string{ { to, from }, { from, to } } {
+		n := NewNoticeMessage(kind, content)
+		n.SetSenderId(from)
+		n.SetTargetId(pair[0])
+		n.AddMeta(Contact, pair[1])
+		im.SendMessage(n)
+	}
+}
+
+/*
+* Request body of contact api
+* eg: {"action":"request","user":"u2","message":"Hi, I'm u1"}
+* eg: {"action":"accept","user":"u1"}
+* eg: {"action":"remove","user":"u2"}
+*/
+type ContactRequest struct {
+	Action string			`json:"action"`		//request, accept, decline, cancel or remove
+	User string			`json:"user"`
+	Message string			`json:"message,omitempty"`	//Message of a friend request
+}
+
+/*
+* Contacts and pending friend requests of a user
+*/
+type ContactList struct {
+	Contacts []string		`json:"contacts"`
+	Incoming []FriendRequest	`json:"incoming"`
+	Outgoing []FriendRequest	`json:"outgoing"`
+}
+
+/*
+* Serve contact api
+* Get request returns ContactList of the user in json
+* Post request sends, accepts, declines, cancels a friend request or removes a contact,
+* return ContactList of the user in json
+* Users get FriendRequested, FriendAccepted, FriendDeclined, FriendCancelled and
+* ContactRemoved frames when their contacts change
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body(post only)--------
+* ContactRequest in json
+*/
+func (im *IM) ServeContacts(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := readLimitedBody(r, 1024)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		req := &ContactRequest{}
+		if err := json.Unmarshal(body, req); err != nil {
+			writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+			return
+		}
+
+		switch req.Action {
+		case ContactActionRequest:
+			err = im.UserManager.RequestFriend(u.id, req.User, req.Message)
+		case ContactActionAccept:
+			err = im.UserManager.AnswerFriend(u.id, req.User, true)
+		case ContactActionDecline:
+			err = im.UserManager.AnswerFriend(u.id, req.User, false)
+		case ContactActionCancel:
+			err = im.UserManager.CancelFriend(u.id, req.User)
+		case ContactActionRemove:
+			err = im.UserManager.RemoveContact(u.id, req.User)
+		default:
+			err = NewSendError(http.StatusBadRequest, "Invalid action")
+		}
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+		return
+	}
+
+	//the user may be reloaded from the store
+	if cu, ok := im.UserManager.UserById(u.id); ok {
+		u = cu
+	}
+	incoming, outgoing := u.FriendRequests()
+	writeJSON(w, http.StatusOK, &ContactList{
+		Contacts	: u.Contacts(),
+		Incoming	: incoming,
+		Outgoing	: outgoing,
+	})
+}
@@ -0,0 +1,83 @@
+package IM
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFriendRequests(t *testing.T) {
+	m := NewUserManager("secret")
+	for _, id := range []string{ "a", "b", "c", "blocker" } {
+		m.byId[id] = NewUser(id, "", DefaultTokenExpire, DefaultReceive)
+	}
+	m.byId["blocker"].userFilter.AddToBlackList([]string{ "a" })
+
+	notices := make([]string, 0)
+	m.SetContactCallback(func(kind string, from string, to string, message string) {
+		notices = append(notices, kind + ":" + from + ">" + to)
+	})
+
+	cases := []struct {
+		name string
+		op func() error
+		code int
+		notice string
+	}{
+		{ "request", func() error { return m.RequestFriend("a", "b", "hi") }, 0, "FriendRequested:a>b" },
+		{ "request again", func() error { return m.RequestFriend("a", "b", "hi") }, http.StatusConflict, "" },
+		{ "request self", func() error { return m.RequestFriend("a", "a", "") }, http.StatusBadRequest, "" },
+		{ "request unknown user", func() error { return m.RequestFriend("a", "stranger", "") }, http.StatusNotFound, "" },
+		{ "answer own request", func() error { return m.AnswerFriend("a", "b", true) }, http.StatusNotFound, "" },
+		{ "accept", func() error { return m.AnswerFriend("b", "a", true) }, 0, "FriendAccepted:b>a" },
+		{ "request a contact", func() error { return m.RequestFriend("b", "a", "") }, http.StatusConflict, "" },
+		{ "request c", func() error { return m.RequestFriend("a", "c", "") }, 0, "FriendRequested:a>c" },
+		{ "cancel", func() error { return m.CancelFriend("a", "c") }, 0, "FriendCancelled:a>c" },
+		{ "cancel again", func() error { return m.CancelFriend("a", "c") }, http.StatusNotFound, "" },
+		{ "request c again", func() error { return m.RequestFriend("a", "c", "") }, 0, "FriendRequested:a>c" },
+		{ "decline", func() error { return m.AnswerFriend("c", "a", false) }, 0, "FriendDeclined:c>a" },
+		{ "crossed requests", func() error { m.RequestFriend("c", "b", ""); return m.RequestFriend("b", "c", "") }, 0, "FriendAccepted:b>c" },
+		{ "request a blocker", func() error { return m.RequestFriend("a", "blocker", "") }, 0, "FriendRequested:a>blocker" },
+		{ "remove contact", func() error { return m.RemoveContact("a", "b") }, 0, "ContactRemoved:a>b" },
+		{ "remove again", func() error { return m.RemoveContact("a", "b") }, http.StatusNotFound, "" },
+	}
+
+	for _, c := range cases {
+		notices = notices[:0]
+		err := c.op()
+		if code := sendErrorCode(err); code != c.code || err != nil && code == 0 {
+			t.Errorf("%s: got error %v, want code %d", c.name, err, c.code)
+		}
+		if c.notice != "" && (len(notices) == 0 || notices[len(notices) - 1] != c.notice) {
+			t.Errorf("%s: got notices %v, want %s", c.name, notices, c.notice)
+		}
+		if c.notice == "" && len(notices) != 0 {
+			t.Errorf("%s: got notices %v", c.name, notices)
+		}
+	}
+
+	contacts := []struct {
+		id string
+		contacts []string
+	}{
+		{ "a", []string{} },
+		{ "b", []string{ "c" } },
+		{ "c", []string{ "b" } },
+	}
+	for _, c := range contacts {
+		if got := m.byId[c.id].Contacts(); !reflect.DeepEqual(got, c.contacts) && len(got) + len(c.contacts) > 0 {
+			t.Errorf("%s: got contacts %v, want %v", c.id, got, c.contacts)
+		}
+	}
+
+	//a request to a user who blocked the sender is kept by the sender only
+	if _, outgoing := m.byId["a"].FriendRequests(); len(outgoing) != 1 || outgoing[0].To != "blocker" {
+		t.Errorf("got outgoing requests %v", outgoing)
+	}
+	if incoming, _ := m.byId["blocker"].FriendRequests(); len(incoming) != 0 {
+		t.Errorf("blocker got requests %v", incoming)
+	}
+	if incoming, outgoing := m.byId["c"].FriendRequests(); len(incoming) + len(outgoing) != 0 {
+		t.Errorf("got requests %v %v after they are answered", incoming, outgoing)
+	}
+}
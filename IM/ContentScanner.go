@@ -0,0 +1,208 @@
+package IM
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"log"
+)
+
+/*
+* Frame kinds of notices sent by the content scan process
+*/
+const (
+	ScanPending = "ScanPending"
+	ScanRejected = "ScanRejected"
+)
+
+/*
+* Result of a content scan, Reason tells why the content is rejected
+*/
+type ScanResult struct {
+	Clean bool
+	Reason string
+}
+
+/*
+* A content scanner checks files and pictures before they are delivered
+*/
+type ContentScanner interface {
+	Scan(name string, content []byte) (ScanResult, error)
+}
+
+/*
+* Messages need to be scanned and the name of their content
+*/
+func scannedContent(m Message) (string, []byte, bool) {
+	switch sm := m.(type) {
+	case *PictureMessage:
+		bs, ok := sm.Content().([]byte)
+		return "." + sm.Suffix(), bs, ok
+	case *FileMessage:
+		bs, ok := sm.Content().([]byte)
+		return sm.FileName(), bs, ok
+	case *VoiceMessage:
+		bs, ok := sm.Content().([]byte)
+		return "." + sm.Format(), bs, ok
+	default:
+		return "", nil, false
+	}
+}
+
+/*
+* Scan a message, a scanner error is treated as rejection
+*/
+func scanMessage(s ContentScanner, m Message) ScanResult {
+	name, content, ok := scannedContent(m)
+	if !ok {
+		return ScanResult{ Clean : true }
+	}
+
+	res, err := s.Scan(name, content)
+	if err != nil {
+		log.Print(err)
+		return ScanResult{ Clean : false, Reason : "Scan failed" }
+	}
+
+	return res
+}
+
+/*
+* Create a notice about a message, the notice is delivered to the targets of the message
+*/
+func newScanNotice(kind string, m Message, content string) *NoticeMessage {
+	n := NewNoticeMessage(kind, content)
+	n.SetTargetId(m.TargetId())
+	n.SetSenderId(m.SenderId())
+	if m.IsGroupMessage() {
+		n.SetGroup(m.GroupName())
+	}
+	n.AddMeta(MessageId, strconv.FormatUint(m.Id(), 10))
+
+	return n
+}
+
+/*
+* Scan a message and send it when it's clean
+*
+* In sync mode, the sender gets an error if the content is rejected
+* In async mode, receivers get a ScanPending frame with the id of the message at once,
+* then the message itself with the same id when the content is clean,
+* or a ScanRejected frame with the same id when the content is rejected
+*
+* Rejected contents are kept in the quarantine of the file proxy
+* A reply is checked against its parent and mentions of a group message are parsed before it's scanned,
+* and a message not accepted by its receivers is rejected, see checkPolicy
+* Storage quota of the sender is reserved until the message is finished, see reserveQuota
+*/
+func (im *IM) SendScannedMessage(m Message) error {
+	if err := im.checkParent(m); err != nil {
+		return err
+	}
+	if err := im.checkPolicy(m); err != nil {
+		return err
+	}
+	if err := im.reserveQuota(m); err != nil {
+		return err
+	}
+	im.parseMentions(m)
+
+	if im.scanner == nil {
+		im.SendMessage(m)
+		return nil
+	}
+
+	if _, _, ok := scannedContent(m); !ok {
+		im.SendMessage(m)
+		return nil
+	}
+
+	if !im.asyncScan {
+		res := scanMessage(im.scanner, m)
+		if !res.Clean {
+			im.quarantine(m, res.Reason)
+			return NewSendError(http.StatusUnprocessableEntity, "Content rejected: " + res.Reason)
+		}
+
+		im.SendMessage(m)
+		return nil
+	}
+
+	if m.Id() == 0 {
+		m.SetId(im.nextMessageId())
+	}
+	im.SendMessage(newScanNotice(ScanPending, m, ""))
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				log.Print(err)
+			}
+		}()
+
+		res := scanMessage(im.scanner, m)
+		if res.Clean {
+			im.classify(m)
+		} else {
+			im.quarantine(m, res.Reason)
+
+			//tell both receivers and the sender
+			im.SendMessage(newScanNotice(ScanRejected, m, res.Reason))
+			back := newScanNotice(ScanRejected, m, res.Reason)
+			back.SetTargetId(m.SenderId())
+			im.SendMessage(back)
+		}
+	}()
+
+	return nil
+}
+
+func (im *IM) quarantine(m Message, reason string) {
+	if _, err := im.communication.Quarantine(m, reason); err != nil {
+		log.Print(err)
+	}
+	m.Finish(NewSendError(http.StatusUnprocessableEntity, "Content rejected: " + reason))
+}
+
+
+/*
+* A scanner rejects contents containing any of its signatures
+*/
+type SignatureScanner struct {
+	signatures map[string][]byte
+}
+
+func NewSignatureScanner() *SignatureScanner {
+	return &SignatureScanner{
+		signatures	: make(map[string][]byte),
+	}
+}
+
+func (s *SignatureScanner) AddSignature(name string, signature []byte) {
+	s.signatures[name] = signature
+}
+
+func (s *SignatureScanner) Scan(name string, content []byte) (ScanResult, error) {
+	if content == nil {
+		return ScanResult{}, errors.New("No content to scan")
+	}
+
+	for n, sig := range s.signatures {
+		if bytes.Contains(content, sig) {
+			return ScanResult{ Clean : false, Reason : n }, nil
+		}
+	}
+
+	return ScanResult{ Clean : true }, nil
+}
+
+/*
+* A test scanner which flags the EICAR anti-virus test file and contents like it
+*/
+func NewEICARScanner() *SignatureScanner {
+	s := NewSignatureScanner()
+	s.AddSignature("EICAR-Test-Signature", []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE"))
+
+	return s
+}
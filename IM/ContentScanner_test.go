@@ -0,0 +1,70 @@
+package IM
+
+import (
+	"errors"
+	"testing"
+)
+
+type failingScanner struct{}
+
+func (failingScanner) Scan(name string, content []byte) (ScanResult, error) {
+	return ScanResult{}, errors.New("scanner down")
+}
+
+func TestScanMessage(t *testing.T) {
+	eicar := []byte("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*")
+
+	cases := []struct {
+		name string
+		scanner ContentScanner
+		m Message
+		clean bool
+		reason string
+	}{
+		{ "clean picture", NewEICARScanner(), NewPictureMessage([]byte("png"), "png"), true, "" },
+		{ "infected file", NewEICARScanner(), NewFileMessage(eicar, "a.com"), false, "EICAR-Test-Signature" },
+		{ "infected voice", NewEICARScanner(), NewVoiceMessage(eicar, "ogg", VoiceMeta{}), false, "EICAR-Test-Signature" },
+		{ "text is not scanned", NewEICARScanner(), NewTextMessage(string(eicar)), true, "" },
+		{ "scanner error", failingScanner{}, NewPictureMessage([]byte("png"), "png"), false, "Scan failed" },
+	}
+
+	for _, c := range cases {
+		res := scanMessage(c.scanner, c.m)
+		if res.Clean != c.clean || res.Reason != c.reason {
+			t.Errorf("%s: got %+v", c.name, res)
+		}
+	}
+}
+
+func TestFileProxyQuarantine(t *testing.T) {
+	p := NewFileProxy("files", "localhost")
+	data := []byte("infected")
+
+	digest := p.Quarantine(data, "a", "virus")
+	if n, _ := p.Usage(); n != 0 {
+		t.Errorf("quarantined content is kept as proxy content")
+	}
+	if qs := p.QuarantinedContents(); len(qs) != 1 || qs[0].Owner() != "a" || qs[0].Reason() != "virus" {
+		t.Errorf("got quarantined contents %v", qs)
+	}
+
+	cases := []struct {
+		name string
+		ok bool
+	}{
+		{ "released", true },
+		{ "released twice", false },
+	}
+	for _, c := range cases {
+		q, ok := p.ReleaseQuarantined(digest)
+		if ok != c.ok || ok && string(q.Content()) != string(data) {
+			t.Errorf("%s: got %v, %v", c.name, q, ok)
+		}
+	}
+
+	p.Quarantine(data, "a", "virus")
+	p.DeleteQuarantined(digest)
+	if qs := p.QuarantinedContents(); len(qs) != 0 {
+		t.Errorf("got %d quarantined contents after delete", len(qs))
+	}
+}
@@ -0,0 +1,238 @@
+package IM
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCatchUpLimit = 200			//Max messages pushed to a device when it reconnects
+)
+
+/*
+* A device of a user, eg: a phone or a laptop, which is signed in with its own tokens
+* and catches up messages from its own cursor
+*/
+type Device struct {
+	mutex sync.Mutex
+
+	id string
+	platform string
+	created time.Time
+	lastSeen time.Time
+	cursor uint64				//Id of the latest message delivered to the device, 0 if it has never connected
+}
+
+func NewDevice(id string, platform string) *Device {
+	now := time.Now()
+	return &Device{
+		id		: id,
+		platform	: platform,
+		created		: now,
+		lastSeen	: now,
+	}
+}
+
+func (d *Device) Id() string { return d.id }
+
+func (d *Device) Touch(platform string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lastSeen = time.Now()
+	if platform != "" {
+		d.platform = platform
+	}
+}
+
+func (d *Device) Cursor() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.cursor
+}
+
+/*
+* Move the cursor forward to a delivered message
+*/
+func (d *Device) Advance(id uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if id > d.cursor {
+		d.cursor = id
+	}
+	d.lastSeen = time.Now()
+}
+
+/*
+* Device info returned by sessions api and kept in user store
+*/
+type DeviceInfo struct {
+	Id string			`json:"id"`
+	Platform string			`json:"platform,omitempty"`
+	Created time.Time		`json:"created"`
+	LastSeen time.Time		`json:"lastSeen"`
+	Cursor uint64			`json:"cursor,string"`
+	Online int			`json:"online"`			//Number of live streams of the device
+	Current bool			`json:"current,omitempty"`		//The device calling the api
+}
+
+func (d *Device) Info() DeviceInfo {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return DeviceInfo{
+		Id		: d.id,
+		Platform	: d.platform,
+		Created		: d.created,
+		LastSeen	: d.lastSeen,
+		Cursor		: d.cursor,
+	}
+}
+
+/*
+* Get a device of the user, create it if it's unknown, return true if it's created
+*/
+func (u *User) Device(id string, platform string) (*Device, bool) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	d, ok := u.devices[id]
+	if !ok {
+		d = NewDevice(id, platform)
+		u.devices[id] = d
+		return d, true
+	}
+
+	d.Touch(platform)
+	return d, false
+}
+
+/*
+* Devices of the user, in order of when they are created
+*/
+func (u *User) Devices() []*Device {
+	u.mutex.Lock()
+	ds := make([]*Device, 0, len(u.devices))
+	for _, d := range u.devices {
+		ds = append(ds, d)
+	}
+	u.mutex.Unlock()
+
+	sort.Slice(ds, func(i, j int) bool { return ds[i].created.Before(ds[j].created) })
+	return ds
+}
+
+func (u *User) RemoveDevice(id string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, ok := u.devices[id]; !ok {
+		return false
+	}
+	delete(u.devices, id)
+	return true
+}
+
+/*
+* Messages sent to a user after the cursor of a device, which are pushed to the device
+* before live messages when it reconnects
+*/
+func (im *IM) catchUp(id string, d *Device) []Message {
+	cursor := d.Cursor()
+	if im.history == nil || cursor == 0 {
+		return nil
+	}
+
+	ms := make([]Message, 0)
+	for _, r := range im.history.Since(id, cursor, DefaultCatchUpLimit) {
+		if r.Recalled {
+			continue
+		}
+
+		m, err := im.registry.Restore(r)
+		if err != nil || IsExpired(m) {
+			continue
+		}
+		ms = append(ms, m)
+	}
+
+	return ms
+}
+
+/*
+* Number of live streams of a device
+*/
+func (im *IM) deviceStreams(id string, device string) int {
+	n := 0
+	for _, p := range im.consumerPools {
+		if rs, ok := p.Receivers(id); ok {
+			n += rs.DeviceCount(device)
+		}
+	}
+	return n
+}
+
+/*
+* Request body of sessions api to sign out a device
+* eg: {"device":"phone-1"}
+*/
+type SessionRequest struct {
+	Device string			`json:"device"`
+}
+
+/*
+* Serve sessions api which lists devices of a user and signs out a device remotely
+* Get request returns devices of the user in json
+* Post request signs out a device, tokens of the device are revoked and its live streams
+* are closed, return devices left in json
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body(post only)--------
+* SessionRequest in json
+*/
+func (im *IM) ServeSessions(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	u, claims, err := im.UserManager.ValidateClaims(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := readLimitedBody(r, 1024)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		req := &SessionRequest{}
+		if err := json.Unmarshal(body, req); err != nil || req.Device == "" {
+			writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+			return
+		}
+		if err := im.UserManager.SignOut(u.id, req.Device); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+		return
+	}
+
+	ds := u.Devices()
+	infos := make([]DeviceInfo, 0, len(ds))
+	for _, d := range ds {
+		info := d.Info()
+		info.Online = im.deviceStreams(u.id, d.id)
+		info.Current = d.id == claims.Device
+		infos = append(infos, info)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
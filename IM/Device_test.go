@@ -0,0 +1,111 @@
+package IM
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceAdvance(t *testing.T) {
+	d := NewDevice("phone", "ios")
+
+	cases := []struct {
+		id uint64
+		cursor uint64
+	}{
+		{ 5, 5 },
+		{ 3, 5 },
+		{ 5, 5 },
+		{ 8, 8 },
+	}
+
+	for _, c := range cases {
+		d.Advance(c.id)
+		if cursor := d.Cursor(); cursor != c.cursor {
+			t.Errorf("advanced to %d: got cursor %d, want %d", c.id, cursor, c.cursor)
+		}
+	}
+}
+
+func TestUserDevices(t *testing.T) {
+	u := NewUser("a", "", DefaultTokenExpire, DefaultReceive)
+
+	cases := []struct {
+		id string
+		platform string
+		created bool
+		info string
+	}{
+		{ "phone", "ios", true, "ios" },
+		{ "laptop", "", true, "" },
+		{ "phone", "", false, "ios" },
+		{ "laptop", "linux", false, "linux" },
+	}
+
+	for _, c := range cases {
+		d, created := u.Device(c.id, c.platform)
+		if created != c.created || d.Id() != c.id || d.Info().Platform != c.info {
+			t.Errorf("%s: got device %+v, created %v", c.id, d.Info(), created)
+		}
+	}
+
+	u.devices["phone"].created = time.Now().Add(-time.Hour)
+	ds := u.Devices()
+	if len(ds) != 2 || ds[0].Id() != "phone" || ds[1].Id() != "laptop" {
+		t.Errorf("got %d devices not in order of creation", len(ds))
+	}
+
+	if !u.RemoveDevice("phone") || u.RemoveDevice("phone") {
+		t.Errorf("removed a device not once")
+	}
+	if ds := u.Devices(); len(ds) != 1 {
+		t.Errorf("got %d devices after removal", len(ds))
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	im := NewIM("localhost")
+	history := NewMemoryHistory(DefaultHistoryLength)
+	im.SetHistory(history, "/history")
+
+	records := []*HistoryRecord{
+		{ Id : 1, Type : TextMessageType, Sender : "b", Target : "a", Content : []byte("1") },
+		{ Id : 2, Type : TextMessageType, Sender : "b", Target : "a", Content : []byte("2") },
+		{ Id : 3, Type : TextMessageType, Sender : "b", Target : "a", Content : []byte("3"), Recalled : true },
+		{ Id : 4, Type : TextMessageType, Sender : "b", Target : "c", Content : []byte("4") },
+		{ Id : 5, Type : TextMessageType, Sender : "a", Target : "b", Content : []byte("5") },
+		{ Id : 6, Type : TextMessageType, Sender : "b", Target : "a", Content : []byte("6"), ExpireAt : time.Now().Add(-time.Minute) },
+	}
+	for _, r := range records {
+		history.Add(r)
+	}
+
+	cases := []struct {
+		name string
+		cursor uint64
+		ids []uint64
+	}{
+		{ "never connected", 0, nil },
+		{ "behind", 1, []uint64{ 2, 5 } },
+		{ "up to date", 6, nil },
+	}
+
+	for _, c := range cases {
+		d := NewDevice("phone", "")
+		d.Advance(c.cursor)
+
+		ids := make([]uint64, 0)
+		for _, m := range im.catchUp("a", d) {
+			ids = append(ids, m.Id())
+		}
+		if len(ids) != len(c.ids) {
+			t.Errorf("%s: got messages %v, want %v", c.name, ids, c.ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Errorf("%s: got messages %v, want %v", c.name, ids, c.ids)
+				break
+			}
+		}
+	}
+}
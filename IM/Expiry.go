@@ -0,0 +1,567 @@
+package IM
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxMessageTTL = time.Hour * 24 * 7
+	DefaultExpiryRootPath = "IM_EXPIRY"
+
+	//Frame kind of the notice telling clients to delete local copies of an expired message
+	MessageExpired = "MessageExpired"
+)
+
+/*
+* Expiry policy of a conversation, messages without their own TTL follow it
+*/
+type ExpiryPolicy struct {
+	TTL int64			`json:"ttl"`				//Seconds, 0 means messages never expire
+	AfterRead bool			`json:"afterRead,omitempty"`		//TTL counts from when a message is read
+}
+
+func (p *ExpiryPolicy) Validate() error {
+	if p.TTL < 0 || p.TTL > int64(MaxMessageTTL / time.Second) {
+		return NewSendError(http.StatusBadRequest, "Invalid TTL")
+	}
+	return nil
+}
+
+/*
+* Parse the TTL of a message, ttl is seconds and afterRead is "true" if it counts from when it's read
+*/
+func ParseExpiry(ttl string, afterRead string) (*ExpiryPolicy, error) {
+	if ttl == "" {
+		return nil, nil
+	}
+
+	seconds, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil {
+		return nil, NewSendError(http.StatusBadRequest, "Invalid TTL")
+	}
+
+	p := &ExpiryPolicy{ TTL : seconds, AfterRead : afterRead == "true" }
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/*
+* A message counting down to expire, content of the record is not kept
+*/
+type expiringMessage struct {
+	record *HistoryRecord
+	digest string				//Digest of the content kept in file proxy, empty for text
+	at time.Time
+
+	index int
+}
+
+/*
+* A message counting down kept in expiry store
+*/
+type ExpiringRecord struct {
+	Record *HistoryRecord		`json:"record"`
+	Digest string			`json:"digest,omitempty"`
+	At time.Time			`json:"at"`
+}
+
+/*
+* Expiry store persists expiry policies and messages counting down, so that conversations
+* keep disappearing and messages counting down are still purged after restart
+*/
+type ExpiryStore interface {
+	SavePolicies(map[string]ExpiryPolicy) error			//Save all policies when one of them changes
+	SaveExpiring(*ExpiringRecord) error				//Save a message when it starts counting down
+	DeleteExpiring(uint64) error					//Delete a message when it expires or stops counting down
+	Load() (map[string]ExpiryPolicy, []*ExpiringRecord, error)	//Load policies and messages counting down
+}
+
+/*
+* Expiry store keeping policies in file "policies.json" and a json file for each message
+* counting down in a directory
+*/
+type FileExpiryStore struct {
+	root string
+}
+
+func NewFileExpiryStore(root string) (*FileExpiryStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileExpiryStore{ root : root }, nil
+}
+
+func (s *FileExpiryStore) path(id uint64) string {
+	return filepath.Join(s.root, strconv.FormatUint(id, 10) + ".json")
+}
+func (s *FileExpiryStore) policiesPath() string {
+	return filepath.Join(s.root, "policies.json")
+}
+
+func (s *FileExpiryStore) SavePolicies(ps map[string]ExpiryPolicy) error {
+	bs, err := json.Marshal(ps)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.policiesPath(), bs)
+}
+
+func (s *FileExpiryStore) SaveExpiring(er *ExpiringRecord) error {
+	bs, err := json.Marshal(er)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(er.Record.Id), bs)
+}
+
+func (s *FileExpiryStore) DeleteExpiring(id uint64) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileExpiryStore) Load() (map[string]ExpiryPolicy, []*ExpiringRecord, error) {
+	ps := make(map[string]ExpiryPolicy)
+	bs, err := ioutil.ReadFile(s.policiesPath())
+	if err == nil {
+		err = json.Unmarshal(bs, &ps)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ers := make([]*ExpiringRecord, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") || f.Name() == "policies.json" {
+			continue
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(s.root, f.Name()))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		er := &ExpiringRecord{}
+		if err := json.Unmarshal(bs, er); err != nil || er.Record == nil {
+			log.Printf("Broken expiring message: %s\n", f.Name())
+			continue
+		}
+		ers = append(ers, er)
+	}
+
+	return ps, ers, nil
+}
+
+type expiryQueue []*expiringMessage
+
+func (q expiryQueue) Len() int { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(*expiringMessage)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old) - 1]
+	old[len(old) - 1] = nil
+	e.index = -1
+	*q = old[:len(old) - 1]
+	return e
+}
+
+/*
+* Expirer keeps expiry policies of conversations and messages counting down to expire,
+* and purges a message when it expires
+* Policies and messages counting down are kept in memory only if store is nil
+*/
+type Expirer struct {
+	mutex sync.Mutex
+	readMutex sync.Mutex
+
+	policies map[string]ExpiryPolicy
+	queue expiryQueue
+	pending map[uint64]*expiringMessage
+	store ExpiryStore
+
+	expire func(*HistoryRecord, string)
+	wake chan int
+}
+
+func NewExpirer(store ExpiryStore, expire func(*HistoryRecord, string)) *Expirer {
+	return &Expirer{
+		policies	: make(map[string]ExpiryPolicy),
+		queue		: make(expiryQueue, 0),
+		pending		: make(map[uint64]*expiringMessage),
+		store		: store,
+		expire		: expire,
+		wake		: make(chan int, 1),
+	}
+}
+
+/*
+* Load policies and messages counting down from store, messages due while the server
+* was down expire at once
+*/
+func (e *Expirer) Load() error {
+	if e.store == nil {
+		return nil
+	}
+	ps, ers, err := e.store.Load()
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for key, p := range ps {
+		e.policies[key] = p
+	}
+	for _, er := range ers {
+		if _, ok := e.pending[er.Record.Id]; ok {
+			continue
+		}
+		em := &expiringMessage{ record : er.Record, digest : er.Digest, at : er.At }
+		e.pending[er.Record.Id] = em
+		heap.Push(&e.queue, em)
+	}
+	return nil
+}
+
+/*
+* Set expiry policy of a conversation, a policy with 0 TTL removes it
+* Policies are saved under the lock, so the latest policies are saved last
+*/
+func (e *Expirer) SetPolicy(key string, p ExpiryPolicy) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if p.TTL == 0 {
+		delete(e.policies, key)
+	} else {
+		e.policies[key] = p
+	}
+
+	if e.store != nil {
+		return e.store.SavePolicies(e.policies)
+	}
+	return nil
+}
+func (e *Expirer) Policy(key string) (ExpiryPolicy, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	p, ok := e.policies[key]
+	return p, ok
+}
+
+/*
+* Start counting down a message, return false if it's counting down already
+*/
+func (e *Expirer) Add(r *HistoryRecord, digest string, at time.Time) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.pending[r.Id]; ok {
+		return false
+	}
+
+	em := &expiringMessage{
+		record		: r,
+		digest		: digest,
+		at		: at,
+	}
+	if e.store != nil {
+		if err := e.store.SaveExpiring(&ExpiringRecord{ Record : r, Digest : digest, At : at }); err != nil {
+			log.Print("Fail to save expiring message:", err)
+		}
+	}
+	e.pending[r.Id] = em
+	heap.Push(&e.queue, em)
+
+	select {
+	case e.wake <- 1:
+	default:
+	}
+	return true
+}
+
+/*
+* Stop counting down a message, eg: when it's recalled
+*/
+func (e *Expirer) Remove(id uint64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if em, ok := e.pending[id]; ok {
+		heap.Remove(&e.queue, em.index)
+		delete(e.pending, id)
+		if e.store != nil {
+			if err := e.store.DeleteExpiring(id); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func (e *Expirer) Start() {
+	go e.run()
+}
+
+func (e *Expirer) run() {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		now := time.Now()
+		due := make([]*expiringMessage, 0)
+		wait := time.Hour
+
+		e.mutex.Lock()
+		for len(e.queue) > 0 && !e.queue[0].at.After(now) {
+			em := heap.Pop(&e.queue).(*expiringMessage)
+			delete(e.pending, em.record.Id)
+			due = append(due, em)
+		}
+		if len(e.queue) > 0 {
+			wait = e.queue[0].at.Sub(now)
+		}
+		e.mutex.Unlock()
+
+		//a message is deleted from store after it expires, so it's purged again after a crash
+		for _, em := range due {
+			e.expireMessage(em)
+			if e.store != nil {
+				if err := e.store.DeleteExpiring(em.record.Id); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-e.wake:
+		}
+	}
+}
+
+func (e *Expirer) expireMessage(em *expiringMessage) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Print("Expirer error:", err)
+		}
+	}()
+
+	e.expire(em.record, em.digest)
+}
+
+/*
+* Apply TTL to a message before it's sent, a message without its own TTL follows
+* the policy of its conversation, and a message whose TTL counts from when it's sent
+* starts counting down at once
+*/
+func (im *IM) applyExpiry(m Message) {
+	if im.expirer == nil || m.Type() == NoticeMessageType || !m.ExpireAt().IsZero() {
+		return
+	}
+
+	ttl, afterRead := m.Expiry()
+	if ttl == 0 {
+		p, ok := im.expirer.Policy(ConversationKey(m))
+		if !ok {
+			return
+		}
+		ttl, afterRead = time.Duration(p.TTL) * time.Second, p.AfterRead
+		m.SetExpiry(ttl, afterRead)
+	}
+
+	if !afterRead {
+		m.SetExpireAt(time.Now().Add(ttl))
+		im.countDown(m)
+	}
+}
+
+/*
+* Called when a message is pushed to a client, a message whose TTL counts from
+* when it's read starts counting down
+*/
+func (im *IM) onMessageRead(m Message) {
+	if im.expirer == nil {
+		return
+	}
+
+	ttl, afterRead := m.Expiry()
+	if ttl == 0 || !afterRead {
+		return
+	}
+
+	//a group message is read by several receivers at the same time
+	im.expirer.readMutex.Lock()
+	if !m.ExpireAt().IsZero() {
+		im.expirer.readMutex.Unlock()
+		return
+	}
+	at := time.Now().Add(ttl)
+	m.SetExpireAt(at)
+	im.expirer.readMutex.Unlock()
+
+	if im.countDown(m) && im.history != nil {
+		im.history.Update(m.Id(), func(r *HistoryRecord) { r.ExpireAt = at })
+	}
+}
+
+func (im *IM) countDown(m Message) bool {
+	r, err := NewHistoryRecord(m)
+	if err != nil {
+		return false
+	}
+
+	digest := ""
+	if _, content, ok := scannedContent(m); ok {
+		digest = ContentDigest(content)
+	}
+	r.Content = nil
+
+	return im.expirer.Add(r, digest, m.ExpireAt())
+}
+
+/*
+* Purge an expired message from history and file proxy, and tell participants
+* to delete local copies of it
+*/
+func (im *IM) expireRecord(r *HistoryRecord, digest string) {
+	if im.history != nil {
+		im.history.Delete(r.Id)
+	}
+	if im.reactions != nil {
+		im.reactions.Delete(r.Id)
+	}
+	if digest != "" {
+		im.purgeContent(digest, r.Sender)
+	}
+
+	im.notifyParticipants(MessageExpired, r, r.Sender, "")
+}
+
+/*
+* Purge files of a content sent by a user which are not fetched yet from file proxies
+*/
+func (im *IM) purgeContent(digest string, sender string) {
+	if im.communication != nil {
+		im.communication.imageProxy.PurgeContent(digest, sender)
+		im.communication.fileProxy.PurgeContent(digest, sender)
+	}
+}
+
+/*
+* Request body of expiry api, the conversation is set by "with" or "group"
+* eg: {"with":"u2","ttl":3600}
+* eg: {"group":"g1","ttl":30,"afterRead":true}
+* eg: {"with":"u2","ttl":0}			//messages never expire
+*/
+type ExpiryRequest struct {
+	With string			`json:"with,omitempty"`
+	Group string			`json:"group,omitempty"`
+	ExpiryPolicy
+}
+
+/*
+* Serve expiry api which sets expiry policy of a conversation
+* Get request returns the policy of a conversation set by query param "with" or "group"
+* Post request sets the policy, return the policy in json
+* Only members of a group can get or set its policy, see GroupMembers
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body(post only)--------
+* ExpiryRequest in json
+*/
+func (im *IM) ServeExpiry(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	req := &ExpiryRequest{}
+	switch r.Method {
+	case http.MethodGet:
+		req.With = r.URL.Query().Get("with")
+		req.Group = r.URL.Query().Get("group")
+	case http.MethodPost:
+		body, err := readLimitedBody(r, 1024)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if err := json.Unmarshal(body, req); err != nil {
+			writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+			return
+		}
+		if err := req.Validate(); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+		return
+	}
+
+	var key string
+	if req.Group != "" {
+		if !im.IsGroupMember(req.Group, u.id) {
+			writeAPIError(w, "", NewSendError(http.StatusForbidden, "Not a member of the group"))
+			return
+		}
+		key = conversationKey("", "", req.Group)
+	} else if req.With != "" {
+		key = conversationKey(u.id, req.With, "")
+	} else {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Conversation missed"))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := im.expirer.SetPolicy(key, req.ExpiryPolicy); err != nil {
+			log.Print(err)
+			writeAPIError(w, "", NewSendError(http.StatusInternalServerError, "Fail to save expiry policy"))
+			return
+		}
+	}
+
+	p, _ := im.expirer.Policy(key)
+	writeJSON(w, http.StatusOK, &p)
+}
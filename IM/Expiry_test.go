@@ -0,0 +1,142 @@
+package IM
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+)
+
+func TestExpiryQueueOrder(t *testing.T) {
+	now := time.Now()
+	offsets := []int{ 5, 1, 4, 2, 3 }
+
+	q := make(expiryQueue, 0)
+	for _, o := range offsets {
+		heap.Push(&q, &expiringMessage{ at : now.Add(time.Duration(o) * time.Second) })
+	}
+
+	for want := 1; want <= len(offsets); want++ {
+		em := heap.Pop(&q).(*expiringMessage)
+		if got := int(em.at.Sub(now) / time.Second); got != want {
+			t.Errorf("got message expiring in %ds, want %ds", got, want)
+		}
+		if em.index != -1 {
+			t.Errorf("index of a popped message is %d", em.index)
+		}
+	}
+}
+
+func TestExpirerAddRemove(t *testing.T) {
+	e := NewExpirer(nil, nil)
+	now := time.Now()
+
+	cases := []struct {
+		name string
+		id uint64
+		remove bool
+		added bool
+	}{
+		{ "new", 1, false, true },
+		{ "another", 2, false, true },
+		{ "counting down", 1, false, false },
+		{ "removed", 2, true, true },
+		{ "removed twice", 2, true, true },
+	}
+
+	for _, c := range cases {
+		if c.remove {
+			e.Remove(c.id)
+		}
+		if added := e.Add(&HistoryRecord{ Id : c.id }, "", now.Add(time.Hour)); added != c.added {
+			t.Errorf("%s: added %v, want %v", c.name, added, c.added)
+		}
+	}
+
+	e.Remove(1)
+	if len(e.queue) != 1 || e.queue[0].record.Id != 2 || len(e.pending) != 1 {
+		t.Errorf("got %d messages in queue and %d pending", len(e.queue), len(e.pending))
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	cases := []struct {
+		ttl string
+		afterRead string
+		policy *ExpiryPolicy
+		valid bool
+	}{
+		{ "", "true", nil, true },
+		{ "60", "", &ExpiryPolicy{ TTL : 60 }, true },
+		{ "60", "true", &ExpiryPolicy{ TTL : 60, AfterRead : true }, true },
+		{ "0", "", &ExpiryPolicy{}, true },
+		{ "-1", "", nil, false },
+		{ "604801", "", nil, false },
+		{ "1m", "", nil, false },
+	}
+
+	for _, c := range cases {
+		p, err := ParseExpiry(c.ttl, c.afterRead)
+		if (err == nil) != c.valid {
+			t.Errorf("%q: got error %v", c.ttl, err)
+			continue
+		}
+		if (p == nil) != (c.policy == nil) || p != nil && *p != *c.policy {
+			t.Errorf("%q: got policy %+v, want %+v", c.ttl, p, c.policy)
+		}
+	}
+}
+
+func TestFileExpiryStore(t *testing.T) {
+	store, err := NewFileExpiryStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	e := NewExpirer(store, nil)
+	e.SetPolicy("a", ExpiryPolicy{ TTL : 60 })
+	e.SetPolicy("b", ExpiryPolicy{ TTL : 30, AfterRead : true })
+	e.SetPolicy("a", ExpiryPolicy{})
+	e.Add(&HistoryRecord{ Id : 1 }, "digest", now.Add(time.Hour))
+	e.Add(&HistoryRecord{ Id : 2 }, "", now.Add(time.Minute))
+	e.Add(&HistoryRecord{ Id : 3 }, "", now.Add(time.Second))
+	e.Remove(3)
+
+	loaded := NewExpirer(store, nil)
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	policies := []struct {
+		key string
+		policy ExpiryPolicy
+		ok bool
+	}{
+		{ "a", ExpiryPolicy{}, false },
+		{ "b", ExpiryPolicy{ TTL : 30, AfterRead : true }, true },
+	}
+	for _, c := range policies {
+		if p, ok := loaded.policies[c.key]; ok != c.ok || p != c.policy {
+			t.Errorf("%s: got policy %+v, want %+v", c.key, p, c.policy)
+		}
+	}
+
+	pending := []struct {
+		id uint64
+		digest string
+		ok bool
+	}{
+		{ 1, "digest", true },
+		{ 2, "", true },
+		{ 3, "", false },
+	}
+	for _, c := range pending {
+		em, ok := loaded.pending[c.id]
+		if ok != c.ok || ok && (em.digest != c.digest || em.at.IsZero()) {
+			t.Errorf("message %d: got %+v, want counting down %v", c.id, em, c.ok)
+		}
+	}
+	if loaded.queue[0].record.Id != 2 {
+		t.Errorf("got message %d first in queue, want 2", loaded.queue[0].record.Id)
+	}
+}
@@ -2,92 +2,429 @@ package IM
 
 import (
 	"crypto/md5"
-	"time"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"sync"
 	"errors"
 	"strings"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultFileTTL = time.Hour * 24 * 7			//Disposable files not fetched in a week are swept
+	DefaultFileSweepInterval = time.Hour
 )
 
 /*
 * A file proxy can automatically cache file and generate file from byte stream
 * then return an url for html to fetch the file
+*
+* Stored content is addressed by the sha256 digest of its bytes, so the same file
+* delivered to many receivers is kept only once. Every url handed out holds a
+* reference to the content, and the content is collected when the last reference expires
 */
 type FileProxy struct {
 	mutex sync.Mutex
 	files map[string]ProxyFile
+	contents map[string]*ProxyContent
+	quarantine map[string]*QuarantinedContent		//Rejected contents which can't be fetched
+	seq uint64
+	ttl time.Duration					//Disposable files not fetched in ttl are swept
 
 	host string
 	proxyRoot string
 }
 
+/*
+* A piece of stored content shared by all files with the same digest
+*/
+type ProxyContent struct {
+	digest string
+	data []byte
+	refs int
+	owners map[string]int			//References held by each uploader
+}
+
+/*
+* Digest of a byte stream, used as the key of stored content
+*/
+func ContentDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+* Store content and add a reference to it for the owner, return the digest of the content
+* Note: caller must hold the mutex
+*/
+func (p *FileProxy) retainContent(data []byte, owner string) string {
+	digest := ContentDigest(data)
+
+	c, ok := p.contents[digest]
+	if !ok {
+		c = &ProxyContent{
+			digest		: digest,
+			data		: data,
+			owners		: make(map[string]int),
+		}
+		p.contents[digest] = c
+	}
+	c.refs++
+	c.owners[owner]++
+
+	return digest
+}
+
+/*
+* Remove a reference of content, the content is deleted when no reference is left
+* Note: caller must hold the mutex
+*/
+func (p *FileProxy) releaseContent(digest string, owner string) {
+	if c, ok := p.contents[digest]; ok {
+		c.refs--
+		c.owners[owner]--
+		if c.owners[owner] <= 0 {
+			delete(c.owners, owner)
+		}
+		if c.refs <= 0 {
+			delete(p.contents, digest)
+		}
+	}
+}
+
+/*
+* Get stored content by digest
+*/
+func (p *FileProxy) Content(digest string) ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c, ok := p.contents[digest]; ok {
+		return c.data, true
+	} else {
+		return nil, false
+	}
+}
+
+/*
+* Number of unique contents and their total size kept by the proxy
+*/
+func (p *FileProxy) Usage() (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	size := 0
+	for _, c := range p.contents {
+		size += len(c.data)
+	}
+
+	return len(p.contents), size
+}
+
+/*
+* Total size of the contents referenced by files of an owner
+*/
+func (p *FileProxy) OwnerUsage(owner string) int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var size int64
+	for _, c := range p.contents {
+		if _, ok := c.owners[owner]; ok {
+			size += int64(len(c.data))
+		}
+	}
+
+	return size
+}
+
+/*
+* Generate a new hash to identify a reference of content
+* Note: caller must hold the mutex
+*/
+func (p *FileProxy) newFileHash(digest string) string {
+	p.seq++
+
+	h := md5.New()
+	h.Write([]byte(digest + strconv.FormatUint(p.seq, 10)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 /*
 * Delete a file from file proxy
 */
-func (p *FileProxy) DeleteFile(url string) {
+func (p *FileProxy) DeleteFile(hash string) {
 	p.mutex.Lock()
-	delete(p.files, url)
-	p.mutex.Unlock()
+	defer p.mutex.Unlock()
+
+	if f, ok := p.files[hash]; ok {
+		delete(p.files, hash)
+		if _, stored := f.(*StoredFile); !stored {
+			p.releaseContent(f.Digest(), f.Owner())
+		}
+	}
 }
 
 /*
 * Fetch content from file proxy, if file not found, return error
+* A disposable file is taken out under the mutex, so it's fetched only once even if
+* it's fetched by several requests at the same time
 */
 func (p *FileProxy) FetchFile(hash string) ([]byte, error) {
-	if f, ok := p.files[hash]; ok {
-		return f.Content(), nil
-	} else {
+	p.mutex.Lock()
+	f, ok := p.files[hash]
+	if !ok {
+		p.mutex.Unlock()
 		return nil, errors.New("No such file: " + hash)
 	}
+
+	var content []byte
+	switch f.(type) {
+	case *DurableFile, *StoredFile:
+		p.mutex.Unlock()
+		content = f.Content()
+	default:
+		delete(p.files, hash)
+		if c, ok := p.contents[f.Digest()]; ok {
+			content = c.data
+		}
+		p.releaseContent(f.Digest(), f.Owner())
+		p.mutex.Unlock()
+	}
+
+	if content == nil {
+		return nil, errors.New("Content of file is gone: " + hash)
+	}
+	return content, nil
+}
+
+/*
+* Set how long a disposable file is kept if it's never fetched
+*/
+func (p *FileProxy) SetTTL(ttl time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.ttl = ttl
+}
+
+/*
+* Delete disposable files added before ttl which are never fetched, eg: files sent to
+* a receiver who never connects, durable and stored files are kept
+*/
+func (p *FileProxy) Sweep() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	for hash, f := range p.files {
+		switch cf := f.(type) {
+		case *DurableFile, *StoredFile:
+		case interface{ Created() time.Time }:
+			if now.Sub(cf.Created()) > p.ttl {
+				delete(p.files, hash)
+				p.releaseContent(f.Digest(), f.Owner())
+			}
+		}
+	}
+}
+
+func (p *FileProxy) run() {
+	ticker := time.NewTicker(DefaultFileSweepInterval)
+	for range ticker.C {
+		p.Sweep()
+	}
 }
 
 /*
 * Add a disposable file which can be fetch only once
 * Return value is the url for the file so that html can fetch the file by it
+* The owner is the id of the user who uploads the file, whose storage usage is charged
 */
-func (p *FileProxy) AddDisposableFile(file []byte, suffix string) string {
-	src := []byte(time.Now().String() + suffix)
+func (p *FileProxy) AddDisposableFile(file []byte, suffix string, owner string) string {
+	p.mutex.Lock()
+	digest := p.retainContent(file, owner)
+	hash := p.newFileHash(digest)
+	p.files[hash] = NewCacheFile(digest, hash, owner, p)
+	p.mutex.Unlock()
+
+	if suffix != "" {
+		return fmt.Sprintf("%s/%s.%s", hash, hash, suffix)
+	} else {
+		return fmt.Sprintf("%s/%s", hash, hash)
+	}
+}
+
+func (p *FileProxy) AddDisposalFileWithRestfulAPI(file []byte, suffix string, owner string) string {
+	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddDisposableFile(file, suffix, owner))
+}
+
+func (p *FileProxy) AddDisposalNamedFile(file []byte, filename string, owner string) string {
+	p.mutex.Lock()
+	digest := p.retainContent(file, owner)
+	hash := p.newFileHash(digest)
+	p.files[hash] = NewCacheNamedFile(digest, hash, filename, owner, p)
+	p.mutex.Unlock()
+
+	return fmt.Sprintf("%s/%s", hash, filename)
+}
+
+func (p *FileProxy) AddDisposalNamedFileWithRestfulAPI(file []byte, filename string, owner string) string {
+	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddDisposalNamedFile(file, filename, owner))
+}
 
+/*
+* Hash of a durable file, decided by its owner and content
+*/
+func durableFileHash(digest string, owner string) string {
 	h := md5.New()
-	h.Write(src)
-	hash := hex.EncodeToString(h.Sum(nil))
-	var url string
+	h.Write([]byte("durable\n" + owner + "\n" + digest))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+* Add a durable file which can be fetched many times until it's deleted, eg: an avatar
+* Its url is decided by the owner and the content, so it's kept when the same file is added
+* again, eg: after restart
+*/
+func (p *FileProxy) AddDurableFile(file []byte, suffix string, owner string) string {
+	digest := ContentDigest(file)
+	hash := durableFileHash(digest, owner)
+
+	p.mutex.Lock()
+	if _, ok := p.files[hash]; !ok {
+		p.retainContent(file, owner)
+		p.files[hash] = NewDurableFile(digest, hash, owner, p)
+	}
+	p.mutex.Unlock()
+
 	if suffix != "" {
-		url = fmt.Sprintf("%s/%s.%s", hash, hash, suffix)
+		return fmt.Sprintf("%s/%s.%s", hash, hash, suffix)
 	} else {
-		url = fmt.Sprintf("%s/%s", hash, hash)
+		return fmt.Sprintf("%s/%s", hash, hash)
 	}
+}
+
+func (p *FileProxy) AddDurableFileWithRestfulAPI(file []byte, suffix string, owner string) string {
+	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddDurableFile(file, suffix, owner))
+}
+
+/*
+* Add a durable file whose content is kept outside of the proxy, eg: an avatar kept in
+* profile store, load is called every time the file is fetched
+* Its url is decided by the owner and the digest of the content like a durable file
+*/
+func (p *FileProxy) AddStoredFile(digest string, suffix string, owner string, load func() []byte) string {
+	hash := durableFileHash(digest, owner)
 
-	fmt.Println("hash:", hash)
 	p.mutex.Lock()
-	p.files[hash] = NewCacheFile(file, hash, p)
+	p.files[hash] = NewStoredFile(digest, hash, owner, p, load)
 	p.mutex.Unlock()
 
-	return url
+	if suffix != "" {
+		return fmt.Sprintf("%s/%s.%s", hash, hash, suffix)
+	} else {
+		return fmt.Sprintf("%s/%s", hash, hash)
+	}
 }
 
-func (p *FileProxy) AddDisposalFileWithRestfulAPI(file []byte, suffix string) string {
-	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddDisposableFile(file, suffix))
+func (p *FileProxy) AddStoredFileWithRestfulAPI(digest string, suffix string, owner string, load func() []byte) string {
+	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddStoredFile(digest, suffix, owner, load))
 }
 
-func (p *FileProxy) AddDisposalNamedFile(file []byte, filename string) string {
-	src := []byte(time.Now().String() + filename)
+/*
+* Delete a durable or stored file by the digest of its content and its owner
+*/
+func (p *FileProxy) DeleteDurableFile(digest string, owner string) {
+	p.DeleteFile(durableFileHash(digest, owner))
+}
 
-	h := md5.New()
-	h.Write(src)
-	hash := hex.EncodeToString(h.Sum(nil))
-	url := fmt.Sprintf("%s/%s", hash, filename)
+/*
+* Delete all files of a content uploaded by an owner which are not fetched yet,
+* used when the message carrying the content expires
+*/
+func (p *FileProxy) PurgeContent(digest string, owner string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for hash, f := range p.files {
+		switch f.(type) {
+		case *DurableFile, *StoredFile:
+			continue
+		}
+		if f.Digest() == digest && f.Owner() == owner {
+			delete(p.files, hash)
+			p.releaseContent(digest, owner)
+		}
+	}
+}
+
+/*
+* Content rejected by a content scanner is kept in quarantine for review,
+* it's never served through the proxy
+*/
+type QuarantinedContent struct {
+	digest string
+	data []byte
+	owner string
+	reason string
+	time time.Time
+}
+func (q *QuarantinedContent) Digest() string { return q.digest }
+func (q *QuarantinedContent) Content() []byte { return q.data }
+func (q *QuarantinedContent) Owner() string { return q.owner }
+func (q *QuarantinedContent) Reason() string { return q.reason }
+func (q *QuarantinedContent) Time() time.Time { return q.time }
+
+/*
+* Put content into quarantine, return the digest of the content
+*/
+func (p *FileProxy) Quarantine(data []byte, owner string, reason string) string {
+	digest := ContentDigest(data)
 
 	p.mutex.Lock()
-	p.files[hash] = NewCacheNamedFile(file, hash, filename, p)
+	p.quarantine[digest] = &QuarantinedContent{
+		digest		: digest,
+		data		: data,
+		owner		: owner,
+		reason		: reason,
+		time		: time.Now(),
+	}
 	p.mutex.Unlock()
 
-	return url
+	return digest
+}
+func (p *FileProxy) QuarantinedContents() []*QuarantinedContent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	qs := make([]*QuarantinedContent, 0, len(p.quarantine))
+	for _, q := range p.quarantine {
+		qs = append(qs, q)
+	}
+
+	return qs
+}
+func (p *FileProxy) DeleteQuarantined(digest string) {
+	p.mutex.Lock()
+	delete(p.quarantine, digest)
+	p.mutex.Unlock()
 }
 
-func (p FileProxy) AddDisposalNamedFileWithRestfulAPI(file []byte, filename string) string {
-	return fmt.Sprintf("%s/%s/%s", p.host, p.proxyRoot, p.AddDisposableFile(file, filename))
+/*
+* Take content out of quarantine, eg: when it's reviewed, return the content released
+*/
+func (p *FileProxy) ReleaseQuarantined(digest string) (*QuarantinedContent, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	q, ok := p.quarantine[digest]
+	if ok {
+		delete(p.quarantine, digest)
+	}
+	return q, ok
 }
 
 /*
@@ -109,6 +446,9 @@ func NewFileProxy(rootPath string, host string) *FileProxy {
 
 	return &FileProxy{
 		files			: make(map[string]ProxyFile),
+		contents		: make(map[string]*ProxyContent),
+		quarantine		: make(map[string]*QuarantinedContent),
+		ttl			: DefaultFileTTL,
 		host			: host,
 		proxyRoot		: rootPath,
 	}
@@ -119,29 +459,86 @@ func NewFileProxy(rootPath string, host string) *FileProxy {
 */
 type ProxyFile interface {
 	Content() []byte
+	Digest() string
+	Owner() string
 	Expire()
 }
 
 /*
 * Cached File will just stay in memory with out any persistent operation
+* It only keeps the digest of its content, the content itself is held by the proxy
 */
 type CachedFile struct {
 	proxy *FileProxy
-	content []byte
+	digest string
 	hash string
+	owner string
+	created time.Time
 }
 func (f *CachedFile) Content() []byte {
+	content, _ := f.proxy.Content(f.digest)
 	f.Expire()
-	return f.content
+	return content
 }
+func (f *CachedFile) Digest() string { return f.digest }
+func (f *CachedFile) Owner() string { return f.owner }
+func (f *CachedFile) Created() time.Time { return f.created }
 func (f *CachedFile) Expire() {
 	f.proxy.DeleteFile(f.hash)
 }
-func NewCacheFile(content []byte, hash string, proxy *FileProxy) *CachedFile {
+func NewCacheFile(digest string, hash string, owner string, proxy *FileProxy) *CachedFile {
 	return &CachedFile{
-		content		: content,
+		digest		: digest,
 		proxy		: proxy,
 		hash		: hash,
+		owner		: owner,
+		created		: time.Now(),
+	}
+}
+
+/*
+* A durable file is not expired when it's fetched
+*/
+type DurableFile struct {
+	CachedFile
+}
+func (f *DurableFile) Content() []byte {
+	content, _ := f.proxy.Content(f.digest)
+	return content
+}
+func (f *DurableFile) Expire() {}
+func NewDurableFile(digest string, hash string, owner string, proxy *FileProxy) *DurableFile {
+	return &DurableFile{
+		CachedFile : CachedFile{
+			digest		: digest,
+			proxy		: proxy,
+			hash		: hash,
+			owner		: owner,
+			created		: time.Now(),
+		},
+	}
+}
+
+/*
+* A stored file is durable, and its content is loaded by the owner of it, it's not kept by the proxy
+*/
+type StoredFile struct {
+	CachedFile
+	load func() []byte
+}
+func (f *StoredFile) Content() []byte { return f.load() }
+func (f *StoredFile) Expire() {}
+func NewStoredFile(digest string, hash string, owner string, proxy *FileProxy, load func() []byte) *StoredFile {
+	return &StoredFile{
+		CachedFile : CachedFile{
+			digest		: digest,
+			proxy		: proxy,
+			hash		: hash,
+			owner		: owner,
+			created		: time.Now(),
+		},
+
+		load		: load,
 	}
 }
 
@@ -153,12 +550,14 @@ type CacheNamedFile struct {
 	name string
 }
 
-func NewCacheNamedFile(content []byte, hash string, name string, proxy *FileProxy) *CacheNamedFile {
+func NewCacheNamedFile(digest string, hash string, name string, owner string, proxy *FileProxy) *CacheNamedFile {
 	return &CacheNamedFile{
 		CachedFile : CachedFile{
-			content		: content,
+			digest		: digest,
 			proxy		: proxy,
 			hash		: hash,
+			owner		: owner,
+			created		: time.Now(),
 		},
 
 		name		: name,
@@ -0,0 +1,158 @@
+package IM
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func fileHash(url string) string {
+	return strings.SplitN(url, "/", 2)[0]
+}
+
+func TestFileProxyRetainRelease(t *testing.T) {
+	p := NewFileProxy("files", "localhost")
+	png := []byte("png")
+	digest := ContentDigest(png)
+
+	a := fileHash(p.AddDisposableFile(png, "png", "a"))
+	b := fileHash(p.AddDisposableFile(png, "png", "a"))
+	c := fileHash(p.AddDisposableFile(png, "png", "b"))
+
+	if n, size := p.Usage(); n != 1 || size != len(png) {
+		t.Errorf("got %d contents of %d bytes, want one deduplicated content", n, size)
+	}
+
+	cases := []struct {
+		name string
+		release func()
+		refs int
+		owners map[string]int
+		kept bool
+	}{
+		{ "fetched", func() { p.FetchFile(a) }, 2, map[string]int{ "a" : 1, "b" : 1 }, true },
+		{ "fetched again", func() { p.FetchFile(a) }, 2, map[string]int{ "a" : 1, "b" : 1 }, true },
+		{ "deleted", func() { p.DeleteFile(c) }, 1, map[string]int{ "a" : 1 }, true },
+		{ "deleted again", func() { p.DeleteFile(c) }, 1, map[string]int{ "a" : 1 }, true },
+		{ "last fetched", func() { p.FetchFile(b) }, 0, nil, false },
+	}
+
+	for _, c := range cases {
+		c.release()
+		pc, ok := p.contents[digest]
+		if ok != c.kept {
+			t.Errorf("%s: content kept %v, want %v", c.name, ok, c.kept)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if pc.refs != c.refs || len(pc.owners) != len(c.owners) {
+			t.Errorf("%s: got %d references of %v, want %d of %v", c.name, pc.refs, pc.owners, c.refs, c.owners)
+			continue
+		}
+		for owner, n := range c.owners {
+			if pc.owners[owner] != n {
+				t.Errorf("%s: got %d references of %s, want %d", c.name, pc.owners[owner], owner, n)
+			}
+		}
+	}
+}
+
+func TestFileProxyOwnerUsage(t *testing.T) {
+	p := NewFileProxy("files", "localhost")
+	p.AddDisposableFile([]byte("12345"), "", "a")
+	p.AddDisposableFile([]byte("12345"), "", "a")
+	p.AddDisposableFile([]byte("123"), "", "a")
+	p.AddDisposableFile([]byte("123"), "", "b")
+	p.AddDurableFile([]byte("1234567"), "", "c")
+
+	cases := []struct {
+		owner string
+		size int64
+	}{
+		{ "a", 8 },
+		{ "b", 3 },
+		{ "c", 7 },
+		{ "d", 0 },
+	}
+
+	for _, c := range cases {
+		if size := p.OwnerUsage(c.owner); size != c.size {
+			t.Errorf("%s: got usage %d, want %d", c.owner, size, c.size)
+		}
+	}
+}
+
+func TestFileProxyFetch(t *testing.T) {
+	p := NewFileProxy("files", "localhost")
+	data := []byte("data")
+
+	disposable := fileHash(p.AddDisposableFile(data, "", "a"))
+	durable := fileHash(p.AddDurableFile(data, "", "a"))
+	stored := fileHash(p.AddStoredFile("digest", "", "a", func() []byte { return data }))
+
+	if again := fileHash(p.AddDurableFile(data, "", "a")); again != durable {
+		t.Errorf("got durable file %s for the same content, want %s", again, durable)
+	}
+
+	cases := []struct {
+		name string
+		hash string
+		ok bool
+	}{
+		{ "disposable", disposable, true },
+		{ "disposable fetched twice", disposable, false },
+		{ "durable", durable, true },
+		{ "durable fetched twice", durable, true },
+		{ "stored", stored, true },
+		{ "stored fetched twice", stored, true },
+		{ "unknown", "unknown", false },
+	}
+
+	for _, c := range cases {
+		content, err := p.FetchFile(c.hash)
+		if (err == nil) != c.ok || c.ok && string(content) != string(data) {
+			t.Errorf("%s: got %q, %v", c.name, content, err)
+		}
+	}
+
+	p.DeleteDurableFile(ContentDigest(data), "a")
+	if _, err := p.FetchFile(durable); err == nil {
+		t.Errorf("fetched a deleted durable file")
+	}
+	if n, _ := p.Usage(); n != 0 {
+		t.Errorf("got %d contents after all files are gone", n)
+	}
+}
+
+func TestFileProxySweep(t *testing.T) {
+	p := NewFileProxy("files", "localhost")
+	p.SetTTL(time.Minute)
+
+	old := fileHash(p.AddDisposableFile([]byte("old"), "", "a"))
+	fresh := fileHash(p.AddDisposableFile([]byte("fresh"), "", "a"))
+	durable := fileHash(p.AddDurableFile([]byte("durable"), "", "a"))
+	p.files[old].(*CachedFile).created = time.Now().Add(-time.Hour)
+	p.files[durable].(*DurableFile).created = time.Now().Add(-time.Hour)
+
+	p.Sweep()
+
+	cases := []struct {
+		name string
+		hash string
+		kept bool
+	}{
+		{ "expired", old, false },
+		{ "fresh", fresh, true },
+		{ "durable", durable, true },
+	}
+	for _, c := range cases {
+		if _, ok := p.files[c.hash]; ok != c.kept {
+			t.Errorf("%s: file kept %v, want %v", c.name, ok, c.kept)
+		}
+	}
+	if _, ok := p.Content(ContentDigest([]byte("old"))); ok {
+		t.Errorf("content of a swept file is kept")
+	}
+}
@@ -0,0 +1,531 @@
+package IM
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHistoryLength = 1000			//Max records kept for a conversation
+	DefaultHistoryLimit = 50			//Default number of records returned by a fetch
+	MaxHistoryLimit = 200				//Max number of records returned by a fetch
+)
+
+var ErrRecordNotFound = errors.New("No such message in history")
+
+/*
+* A message kept in history
+*/
+type HistoryRecord struct {
+	Id uint64			`json:"id,string"`
+	Type string			`json:"type"`
+	Sender string			`json:"sender"`
+	Target string			`json:"target"`
+	Group string			`json:"group,omitempty"`
+	Content []byte			`json:"-"`
+	Name string			`json:"name,omitempty"`		//Suffix of a picture or name of a file
+	Time time.Time			`json:"time"`
+	ParentId uint64			`json:"parentId,string,omitempty"`
+	ReplyCount int			`json:"replyCount,omitempty"`
+	Meta map[string]string		`json:"meta,omitempty"`		//Extra meta of the message, eg: duration of a voice
+	TTL int64			`json:"ttl,omitempty"`			//Seconds before the message expires
+	ExpireAfterRead bool		`json:"expireAfterRead,omitempty"`	//TTL counts from when the message is read
+	ExpireAt time.Time		`json:"expireAt,omitempty"`
+
+	Edited bool			`json:"edited,omitempty"`
+	EditTime time.Time		`json:"editTime,omitempty"`
+	Recalled bool			`json:"recalled,omitempty"`
+	Removed bool			`json:"removed,omitempty"`		//Removed by a moderator, a removed record is recalled as well
+}
+
+/*
+* Create a history record of a message with its content got by OnBinary,
+* fields of a type are filled by MessageRegistry.Record
+*/
+func NewHistoryRecord(m Message) (*HistoryRecord, error) {
+	content, err := m.OnBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &HistoryRecord{
+		Id		: m.Id(),
+		Type		: m.Type(),
+		Sender		: m.SenderId(),
+		Target		: m.TargetId(),
+		Content		: content,
+		Time		: time.Now(),
+		ParentId	: m.ParentId(),
+		ExpireAt	: m.ExpireAt(),
+	}
+	ttl, afterRead := m.Expiry()
+	r.TTL = int64(ttl / time.Second)
+	r.ExpireAfterRead = afterRead
+	if m.IsGroupMessage() {
+		r.Group = m.GroupName()
+	}
+
+	return r, nil
+}
+
+/*
+* Key of the conversation the record belongs to, same as ConversationKey of the message
+*/
+func (r *HistoryRecord) ConversationKey() string {
+	return conversationKey(r.Sender, r.Target, r.Group)
+}
+
+/*
+* A short snippet of the record used to quote it, in no more than length characters
+*/
+func (r *HistoryRecord) Snippet(length int) string {
+	if r.Removed {
+		return "[Removed]"
+	}
+	if r.Recalled {
+		return "[Recalled]"
+	}
+
+	switch r.Type {
+	case TextMessageType:
+		rs := []rune(strings.Replace(string(r.Content), "\n", " ", -1))
+		if len(rs) > length {
+			return string(rs[:length]) + "..."
+		}
+		return string(rs)
+	case PictureMessageType:
+		return "[Picture]"
+	case FileMessageType:
+		return "[File]" + r.Name
+	default:
+		return "[" + r.Type + "]"
+	}
+}
+
+/*
+* Receivers of the record
+*/
+func (r *HistoryRecord) Targets() []string {
+	if r.Group != "" {
+		return strings.Split(r.Target, ";")
+	}
+	return []string{ r.Target }
+}
+
+/*
+* Sender and receivers of the record
+*/
+func (r *HistoryRecord) Participants() []string {
+	ps := r.Targets()
+	for _, p := range ps {
+		if p == r.Sender {
+			return ps
+		}
+	}
+	return append(ps, r.Sender)
+}
+
+/*
+* If a user is the sender or a receiver of the record
+*/
+func (r *HistoryRecord) IsParticipant(id string) bool {
+	if r.Sender == id {
+		return true
+	}
+	for _, t := range r.Targets() {
+		if t == id {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Message history keeps messages sent so that clients can fetch them later
+* and changes to messages survive reconnects
+*/
+type MessageHistory interface {
+	Add(*HistoryRecord)						//Add a record
+	Get(uint64) (*HistoryRecord, bool)				//Get a record by message id
+	Update(uint64, func(*HistoryRecord)) error			//Change a record
+	Delete(uint64)							//Delete a record
+	Conversation(string, uint64, int) []*HistoryRecord		//Records of a conversation before an id(0 for latest), at most limit records, in order of id
+	Thread(uint64) []*HistoryRecord					//Replies of a record in order of id
+	Since(string, uint64, int) []*HistoryRecord			//Records sent by or to a user after an id, at most limit records, in order of id
+}
+
+/*
+* A history which drops old records by itself tells it by the function set by OnEvict,
+* so that state kept apart from records, like reactions, is dropped with them
+*/
+type EvictingHistory interface {
+	OnEvict(func(uint64))						//Set the function called with ids of records evicted
+}
+
+/*
+* Message history kept in memory, only the latest records of each conversation are kept
+*/
+type MemoryHistory struct {
+	mutex sync.RWMutex
+
+	length int
+	records map[uint64]*HistoryRecord
+	conversations map[string][]uint64
+	threads map[uint64][]uint64
+
+	onEvict func(uint64)
+}
+
+func NewMemoryHistory(length int) *MemoryHistory {
+	if length < 1 {
+		length = DefaultHistoryLength
+	}
+
+	return &MemoryHistory{
+		length		: length,
+		records		: make(map[uint64]*HistoryRecord),
+		conversations	: make(map[string][]uint64),
+		threads		: make(map[uint64][]uint64),
+	}
+}
+
+func (h *MemoryHistory) OnEvict(f func(uint64)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.onEvict = f
+}
+
+/*
+* Add a record, the oldest records of the conversation beyond length are evicted
+*/
+func (h *MemoryHistory) Add(r *HistoryRecord) {
+	evicted, onEvict := h.add(r)
+	if onEvict != nil {
+		for _, id := range evicted {
+			onEvict(id)
+		}
+	}
+}
+
+func (h *MemoryHistory) add(r *HistoryRecord) ([]uint64, func(uint64)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := r.ConversationKey()
+	ids := h.conversations[key]
+
+	//keep ids in order, records are almost always added in order
+	i := len(ids)
+	for i > 0 && ids[i - 1] > r.Id {
+		i--
+	}
+	ids = append(ids, 0)
+	copy(ids[i + 1:], ids[i:])
+	ids[i] = r.Id
+
+	h.records[r.Id] = r
+	if r.ParentId != 0 {
+		h.threads[r.ParentId] = append(h.threads[r.ParentId], r.Id)
+		if p, ok := h.records[r.ParentId]; ok {
+			p.ReplyCount++
+		}
+	}
+
+	//the record is indexed before eviction, so it's evicted as well if it's older than all kept
+	evicted := make([]uint64, 0)
+	for len(ids) > h.length {
+		h.deleteRecord(ids[0])
+		evicted = append(evicted, ids[0])
+		ids = ids[1:]
+	}
+
+	h.conversations[key] = ids
+	return evicted, h.onEvict
+}
+
+/*
+* Delete a record and its thread index, but not its id in conversation
+* Note: caller must hold the mutex
+*/
+func (h *MemoryHistory) deleteRecord(id uint64) {
+	r, ok := h.records[id]
+	if !ok {
+		return
+	}
+
+	delete(h.records, id)
+	delete(h.threads, id)
+
+	if r.ParentId != 0 {
+		replies := h.threads[r.ParentId]
+		for i, rid := range replies {
+			if rid == id {
+				h.threads[r.ParentId] = append(replies[:i:i], replies[i + 1:]...)
+				break
+			}
+		}
+		if p, ok := h.records[r.ParentId]; ok {
+			p.ReplyCount--
+		}
+	}
+}
+
+func (h *MemoryHistory) Get(id uint64) (*HistoryRecord, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	r, ok := h.records[id]
+	if !ok {
+		return nil, false
+	}
+
+	c := *r
+	return &c, true
+}
+
+func (h *MemoryHistory) Update(id uint64, f func(*HistoryRecord)) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if r, ok := h.records[id]; ok {
+		f(r)
+		return nil
+	} else {
+		return ErrRecordNotFound
+	}
+}
+
+func (h *MemoryHistory) Delete(id uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	r, ok := h.records[id]
+	if !ok {
+		return
+	}
+
+	h.deleteRecord(id)
+
+	key := r.ConversationKey()
+	ids := h.conversations[key]
+	for i, rid := range ids {
+		if rid == id {
+			h.conversations[key] = append(ids[:i:i], ids[i + 1:]...)
+			break
+		}
+	}
+	if len(h.conversations[key]) == 0 {
+		delete(h.conversations, key)
+	}
+}
+
+func (h *MemoryHistory) Conversation(key string, before uint64, limit int) []*HistoryRecord {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	ids := h.conversations[key]
+	end := len(ids)
+	if before != 0 {
+		end = sort.Search(len(ids), func(i int) bool { return ids[i] >= before })
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+
+	rs := make([]*HistoryRecord, 0, end - start)
+	for _, id := range ids[start:end] {
+		c := *h.records[id]
+		rs = append(rs, &c)
+	}
+
+	return rs
+}
+
+func (h *MemoryHistory) Since(user string, after uint64, limit int) []*HistoryRecord {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	ids := make([]uint64, 0)
+	for id, r := range h.records {
+		if id > after && r.IsParticipant(user) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	rs := make([]*HistoryRecord, 0, len(ids))
+	for _, id := range ids {
+		c := *h.records[id]
+		rs = append(rs, &c)
+	}
+
+	return rs
+}
+
+func (h *MemoryHistory) Thread(id uint64) []*HistoryRecord {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	replies := h.threads[id]
+	rs := make([]*HistoryRecord, 0, len(replies))
+	for _, rid := range replies {
+		if r, ok := h.records[rid]; ok {
+			c := *r
+			rs = append(rs, &c)
+		}
+	}
+
+	return rs
+}
+
+/*
+* Record a message in history, notices are not recorded
+*/
+func (im *IM) record(m Message) {
+	if im.history == nil || m.Type() == NoticeMessageType {
+		return
+	}
+
+	if r, err := im.registry.Record(m); err == nil {
+		im.history.Add(r)
+	}
+}
+
+/*
+* Members of a group known to the server, who are participants of its latest messages
+* in history, the server knows no member if history is disabled
+*/
+func (im *IM) GroupMembers(group string) map[string]uint8 {
+	members := make(map[string]uint8)
+	if im.history == nil {
+		return members
+	}
+
+	for _, r := range im.history.Conversation(conversationKey("", "", group), 0, DefaultHistoryLimit) {
+		for _, p := range r.Participants() {
+			members[p] = 0
+		}
+	}
+	return members
+}
+
+func (im *IM) IsGroupMember(group string, id string) bool {
+	_, ok := im.GroupMembers(group)[id]
+	return ok
+}
+
+/*
+* A record in json returned by history api, content is the content of the frame the message
+* is delivered in, eg: text of a text message, or an url of history api to fetch a picture or a file
+*/
+type HistoryItem struct {
+	*HistoryRecord
+	Content string			`json:"content"`
+	Reactions []ReactionSummary	`json:"reactions,omitempty"`
+}
+
+func (im *IM) historyItem(r *HistoryRecord) *HistoryItem {
+	item := &HistoryItem{ HistoryRecord : r }
+	if r.Recalled {
+		return item
+	}
+
+	if im.reactions != nil {
+		item.Reactions = im.reactions.Reactions(r.Id)
+	}
+
+	//a blob is fetched from history api instead of file proxies, so fetching history never
+	//adds files to proxies nor charges the sender
+	item.Content = string(r.Content)
+	if t, ok := im.registry.Lookup(r.Type); ok && t.Binary {
+		item.Content = im.host + im.historyPath + "?content=" + strconv.FormatUint(r.Id, 10)
+	}
+
+	return item
+}
+
+/*
+* Write the content of a record to a participant, eg: a picture or a file
+*/
+func (im *IM) serveHistoryContent(w http.ResponseWriter, u *User, id string) {
+	rid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid message id"))
+		return
+	}
+
+	rec, ok := im.history.Get(rid)
+	if !ok || rec.Recalled || !rec.IsParticipant(u.id) {
+		writeAPIError(w, "", NewSendError(http.StatusNotFound, ErrRecordNotFound.Error()))
+		return
+	}
+
+	w.Write(rec.Content)
+}
+
+/*
+* Serve history api
+* Get request should obey the following format:
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------query:-----------------
+* with=xxx			//id of the other user of a conversation
+* group=xxx			//or name of a group
+* before=xxx			//optional, only records with id before it are returned
+* limit=xxx			//optional, max number of records, default 50, at most 200
+* content=xxx			//or id of a record to fetch its content, eg: a picture or a file
+*
+* Return {"messages":[...]} in json, in order of message id, or the content of a record
+* Only group records the user takes part in are returned
+*/
+func (im *IM) ServeHistory(w http.ResponseWriter, r *http.Request) {
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	q := r.URL.Query()
+	if id := q.Get("content"); id != "" {
+		im.serveHistoryContent(w, u, id)
+		return
+	}
+
+	var key string
+	if g := q.Get("group"); g != "" {
+		key = conversationKey("", "", g)
+	} else if with := q.Get("with"); with != "" {
+		key = conversationKey(u.id, with, "")
+	} else {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Conversation missed"))
+		return
+	}
+
+	before, _ := strconv.ParseUint(q.Get("before"), 10, 64)
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = DefaultHistoryLimit
+	}
+	if limit > MaxHistoryLimit {
+		limit = MaxHistoryLimit
+	}
+
+	items := make([]*HistoryItem, 0, limit)
+	for _, rec := range im.history.Conversation(key, before, limit) {
+		if rec.IsParticipant(u.id) {
+			items = append(items, im.historyItem(rec))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{ "messages" : items })
+}
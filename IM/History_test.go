@@ -0,0 +1,50 @@
+package IM
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryHistoryEviction(t *testing.T) {
+	cases := []struct {
+		name string
+		length int
+		ids []uint64
+		kept []uint64
+		evicted []uint64
+	}{
+		{ "under length", 3, []uint64{ 1, 2 }, []uint64{ 1, 2 }, []uint64{} },
+		{ "oldest evicted", 3, []uint64{ 1, 2, 3, 4, 5 }, []uint64{ 3, 4, 5 }, []uint64{ 1, 2 } },
+		{ "added out of order", 2, []uint64{ 3, 1, 2 }, []uint64{ 2, 3 }, []uint64{ 1 } },
+		{ "older than all kept", 2, []uint64{ 2, 3, 1 }, []uint64{ 2, 3 }, []uint64{ 1 } },
+	}
+
+	for _, c := range cases {
+		h := NewMemoryHistory(c.length)
+		evicted := make([]uint64, 0)
+		h.OnEvict(func(id uint64) { evicted = append(evicted, id) })
+
+		for _, id := range c.ids {
+			h.Add(&HistoryRecord{ Id : id, Type : "text", Sender : "a", Target : "b" })
+		}
+		//records of other conversations are not counted
+		h.Add(&HistoryRecord{ Id : 100, Type : "text", Sender : "a", Target : "c" })
+
+		kept := make([]uint64, 0)
+		for _, r := range h.Conversation(conversationKey("b", "a", ""), 0, 10) {
+			kept = append(kept, r.Id)
+		}
+
+		if !reflect.DeepEqual(kept, c.kept) {
+			t.Errorf("%s: kept %v, want %v", c.name, kept, c.kept)
+		}
+		if !reflect.DeepEqual(evicted, c.evicted) {
+			t.Errorf("%s: evicted %v, want %v", c.name, evicted, c.evicted)
+		}
+		for _, id := range c.evicted {
+			if _, ok := h.Get(id); ok {
+				t.Errorf("%s: evicted record %d is still kept", c.name, id)
+			}
+		}
+	}
+}
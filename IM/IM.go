@@ -4,7 +4,9 @@ import (
 	"errors"
 	"time"
 	"strings"
+	"sync/atomic"
 	"log"
+	"path/filepath"
 )
 
 /*
@@ -15,7 +17,34 @@ import (
 * ---call SetChannels to init your channels which handles different messages
 */
 type IM struct {
-	messageCount uint64
+	classifyCount uint64
+	idGenerator *IdGenerator
+	dedup *SendDeduplicator
+	registry *MessageRegistry
+
+	ordered bool
+	sequencer *Sequencer
+
+	history MessageHistory
+	historyPath string
+	threadPath string
+	editPath string
+	recallPath string
+	editWindow time.Duration
+
+	reactions ReactionStore
+	reactionPath string
+
+	scheduler *Scheduler
+	schedulePath string
+
+	expirer *Expirer
+	expiryPath string
+
+	profiles *Profiles
+	profilePath string
+	embedProfile bool
+
 	classifierNum uint32
 	channelGroupNum uint32
 	channelNum uint32
@@ -32,15 +61,38 @@ type IM struct {
 
 	onNewReceiver func(string)
 	onMessageTargetMissCallback func(Message, string) error
+	groupNotifyLimit int
+	mentionAllLimit int
 
 	communication *Communication
 	communicationPath string
 
 	senderPath string
+	messageAPIPath string
+	batchPath string
+	batchConcurrency int
+	maxBatchSize int
+	uploadPolicy *UploadPolicy
+	scanner ContentScanner
+	asyncScan bool
 
 	UserManager *UserManager
 	registerURL string
 	updateSecretURL string
+	refreshURL string
+	revokeURL string
+	sessionPath string
+	contactPath string
+
+	adminPath string
+	audit *AuditLog
+
+	reports *ReportQueue
+	reportPath string
+	moderationPath string
+
+	limiter *RateLimiter
+	metricsPath string
 }
 
 /*
@@ -53,26 +105,84 @@ func NewIM(host string) *IM {
 
 	return &IM{
 		channelGroups		: make(map[string] *ChannelGroup),
+		idGenerator		: NewIdGenerator(0),
+		dedup			: NewSendDeduplicator(DefaultDedupWindow),
+		registry		: NewMessageRegistry(),
+		editWindow		: DefaultEditWindow,
+		mentionAllLimit		: DefaultMentionAllLimit,
 		expireTime		: time.Second * 10,
 
 		consumerInit 		: false,
 
 		host			: host,
+
+		messageAPIPath		: DefaultMessageAPIPath,
+		batchConcurrency	: DefaultBatchConcurrency,
+		maxBatchSize		: DefaultMaxBatchSize,
+		uploadPolicy		: NewUploadPolicy(),
+		limiter			: NewRateLimiter(DefaultLimiterShards),
 	}
 }
 
 /*
-* Send a message to classifier
+* Send a message to classifier, a message without id is assigned a new id
 */
 func (im *IM) SendMessage(m Message) {
-	im.messageCount++
+	if m.Id() == 0 {
+		m.SetId(im.nextMessageId())
+	}
+	im.classify(m)
+}
+func (im *IM) nextMessageId() uint64 {
+	return im.idGenerator.Next()
+}
+func (im *IM) classify(m Message) {
+	im.applyExpiry(m)
+	if IsExpired(m) {
+		m.Finish(ErrMessageExpired)
+		return
+	}
+	if err := im.recheckPolicy(m); err != nil {
+		m.Finish(err)
+		return
+	}
+	im.record(m)
 
-	m.SetId(im.messageCount)
+	if im.ordered {
+		im.classifyOrdered(m)
+		return
+	}
 
-	index :=im.messageCount % uint64(im.classifierNum)
+	index := atomic.AddUint64(&im.classifyCount, 1) % uint64(im.classifierNum)
 	im.classifiers[index].Classify(m)
 }
 
+/*
+* In ordering mode, messages of a conversation are delivered in the order they are sent,
+* and frames carry their sequence number in the conversation
+*/
+func (im *IM) SetOrderingMode(ordered bool) {
+	im.ordered = ordered
+	if ordered {
+		im.sequencer = NewSequencer(DefaultOrderingShards)
+	}
+}
+
+/*
+* Set node id of this server, servers sharing users should have different node ids
+* so that message ids never conflict
+*/
+func (im *IM) SetNodeId(node uint16) {
+	im.idGenerator = NewIdGenerator(node)
+}
+
+/*
+* Set the window in which a message retried with the same client message id is sent only once
+*/
+func (im *IM) SetDedupWindow(window time.Duration) {
+	im.dedup = NewSendDeduplicator(window)
+}
+
 /*
 * withdraw message that haven't been read
 */
@@ -83,6 +193,13 @@ func (im *IM) ReceiveMessages(id string, t string, race bool) (*MessageReceiver,
 		return nil, errors.New("No such message type registered")
 	}
 }
+func (im *IM) ReceiveDeviceMessages(id string, device string, t string, race bool) (*MessageReceiver, error) {
+	if p, ok := im.consumerPools[t]; ok {
+		return p.ReceiveDeviceMessages(id, device, race)
+	} else {
+		return nil, errors.New("No such message type registered")
+	}
+}
 
 /*
 * set a group of channels to handle a kind of messages
@@ -121,6 +238,146 @@ func (im *IM) FetchFile(name string) ([]byte, error) {
 func (im *IM) SetSenderPath(path string) {
 	im.senderPath = path
 }
+func (im *IM) SetMessageAPIPath(path string) {
+	im.messageAPIPath = path
+}
+
+/*
+* Batch api is authenticated with the secret key of user manager
+* concurrency is the max number of messages sending at the same time
+*/
+func (im *IM) SetBatchPath(path string, concurrency int, maxBatchSize int) {
+	if concurrency < 1 {
+		log.Printf("Batch concurrency is set to default: %d\n", DefaultBatchConcurrency)
+		concurrency = DefaultBatchConcurrency
+	}
+	if maxBatchSize < 1 {
+		log.Printf("Max batch size is set to default: %d\n", DefaultMaxBatchSize)
+		maxBatchSize = DefaultMaxBatchSize
+	}
+
+	im.batchPath = path
+	im.batchConcurrency = concurrency
+	im.maxBatchSize = maxBatchSize
+}
+
+/*
+* Settings about upload limits
+* ---SetMaxMessageSize sets max body size of a message type, use "" as message type to set the default
+* ---SetUserStorageQuota sets the max bytes of files a user can keep in file proxies, including files
+* still being sent, 0 means no quota and anonymous senders can upload only when there is no quota
+* ---SetFileTypes sets allowed and denied file types, either extensions(".png") or mime types("image/png")
+*/
+func (im *IM) SetMaxMessageSize(mt string, size int64) {
+	im.uploadPolicy.SetMaxSize(mt, size)
+}
+func (im *IM) SetUserStorageQuota(quota int64) {
+	im.uploadPolicy.SetUserQuota(quota)
+}
+func (im *IM) SetFileTypes(allowed []string, denied []string) {
+	im.uploadPolicy.SetFileTypes(allowed, denied)
+}
+
+/*
+* Set a content scanner to scan pictures and files before they are delivered
+* set async to true to deliver a placeholder first and the message after scan
+*/
+func (im *IM) SetContentScanner(scanner ContentScanner, async bool) {
+	im.scanner = scanner
+	im.asyncScan = async
+}
+
+/*
+* Settings about message history, history is disabled by default, since contents of all
+* messages are kept, eg: NewMemoryHistory(DefaultHistoryLength) keeps them in memory
+* Edit, recall, threads, reactions and catch up of devices depend on history
+* set history to nil to disable it
+*/
+func (im *IM) SetHistory(history MessageHistory, path string) {
+	im.history = history
+	im.historyPath = path
+}
+
+func (im *IM) SetThreadPath(path string) {
+	im.threadPath = path
+}
+
+/*
+* Settings about edit and recall, a message can be changed by its sender in window after it's sent
+*/
+func (im *IM) SetEditPaths(editPath string, recallPath string, window time.Duration) {
+	im.editPath = editPath
+	im.recallPath = recallPath
+	if window > 0 {
+		im.editWindow = window
+	}
+}
+
+/*
+* Settings about reactions, reactions are disabled by default and are kept in memory
+* if store is nil, they are enabled only with history
+*/
+func (im *IM) SetReactions(store ReactionStore, path string) {
+	if store == nil {
+		store = NewMemoryReactionStore()
+	}
+	im.reactions = store
+	im.reactionPath = path
+}
+
+/*
+* Settings about scheduled messages, scheduled messages are kept in files
+* under DefaultScheduleRootPath if store is nil
+*/
+func (im *IM) SetScheduler(store ScheduleStore, path string) {
+	if store == nil {
+		fs, err := NewFileScheduleStore(DefaultScheduleRootPath)
+		if err != nil {
+			panic(err)
+		}
+		store = fs
+	}
+
+	im.scheduler = NewScheduler(store, im.fireScheduled)
+	im.schedulePath = path
+}
+
+/*
+* Settings about disappearing messages, a message with TTL or in a conversation with
+* expiry policy is purged from history and file proxy when it expires
+* Expiry policies and messages counting down are kept in files under DefaultExpiryRootPath
+* if store is nil
+*/
+func (im *IM) SetExpirer(store ExpiryStore, path string) {
+	if store == nil {
+		fs, err := NewFileExpiryStore(DefaultExpiryRootPath)
+		if err != nil {
+			panic(err)
+		}
+		store = fs
+	}
+
+	im.expirer = NewExpirer(store, im.expireRecord)
+	im.expiryPath = path
+}
+
+/*
+* Settings about profiles of users, a FileProfileStore under DefaultProfileRootPath is used
+* if store is nil, and display name and avatar of the sender are added to frame meta if embed is true
+*/
+func (im *IM) SetProfiles(store ProfileStore, path string, embed bool) {
+	if store == nil {
+		fs, err := NewFileProfileStore(DefaultProfileRootPath)
+		if err != nil {
+			panic(err)
+		}
+		store = fs
+	}
+
+	im.profiles = NewProfiles(store)
+	im.profilePath = path
+	im.embedProfile = embed
+}
 
 /*
 * Settings about user manager
@@ -129,6 +386,117 @@ func (im *IM) SetUserManager(secretKey string, registerURL string, updateSecretU
 	im.UserManager = NewUserManager(secretKey)
 	im.registerURL = registerURL
 	im.updateSecretURL = updateSecretURL
+	im.UserManager.SetRevokeCallback(im.closeStreams)
+	im.UserManager.SetContactCallback(im.notifyContact)
+}
+
+/*
+* Keep users in a store so that they survive restart, a FileUserStore under
+* DefaultUserRootPath is used if store is nil
+* Note: call it after SetUserManager
+*/
+func (im *IM) SetUserStore(store UserStore) {
+	if store == nil {
+		fs, err := NewFileUserStore(DefaultUserRootPath)
+		if err != nil {
+			panic(err)
+		}
+		store = fs
+	}
+
+	if err := im.UserManager.SetStore(store); err != nil {
+		panic(err)
+	}
+}
+
+/*
+* Refresh url exchanges a refresh token for a new check code, and revoke url
+* revokes tokens of a user and closes live streams of the user
+*/
+func (im *IM) SetTokenPaths(refreshURL string, revokeURL string) {
+	im.refreshURL = refreshURL
+	im.revokeURL = revokeURL
+}
+
+/*
+* Set a token bucket rate limit of a scope, eg: RateSendUser, RateConnectIP, requests over
+* the limit get 429 with Retry-After, perSecond 0 removes the limit
+* Messages sent by batch api are authenticated by the secret key and are not limited
+*/
+func (im *IM) SetRateLimit(scope string, perSecond float64, burst int) {
+	im.limiter.SetRate(scope, Rate{ PerSecond : perSecond, Burst : burst })
+}
+
+/*
+* Set a rate limit of sends of a message type, scope is RateSendUser or RateSendIP
+*/
+func (im *IM) SetMessageRateLimit(messageType string, scope string, perSecond float64, burst int) {
+	im.SetRateLimit(MessageRateScope(scope, messageType), perSecond, burst)
+}
+
+/*
+* Metrics path serves metrics of rate limits, authenticated by the secret key
+*/
+func (im *IM) SetMetricsPath(path string) {
+	im.metricsPath = path
+}
+
+/*
+* Admin path serves admin api authenticated by the secret key, every request is audited
+* and appended to auditFile if it's not empty
+*/
+func (im *IM) SetAdminPath(path string, auditFile string) {
+	im.setAuditFile(auditFile)
+	im.adminPath = path
+}
+
+/*
+* Report path lets users report messages, and moderation path serves the review queue
+* and moderation actions for moderators, authenticated by the secret key
+* Moderation actions are audited in the audit log shared with admin api, and the audit
+* file set first is used
+* Reports are saved in DefaultReportFile next to the audit file, or kept in memory only
+* if there's no audit file
+*/
+func (im *IM) SetModerationPaths(reportPath string, moderationPath string, auditFile string) {
+	im.setAuditFile(auditFile)
+	if im.audit.path == "" {
+		im.reports = NewReportQueue()
+	} else {
+		reports, err := NewFileReportQueue(filepath.Join(filepath.Dir(im.audit.path), DefaultReportFile))
+		if err != nil {
+			panic(err)
+		}
+		im.reports = reports
+	}
+	im.reportPath = reportPath
+	im.moderationPath = moderationPath
+}
+
+func (im *IM) setAuditFile(auditFile string) {
+	if im.audit != nil {
+		return
+	}
+
+	audit, err := NewAuditLog(auditFile)
+	if err != nil {
+		panic(err)
+	}
+	im.audit = audit
+}
+
+/*
+* Session path lists devices of a user and signs out a device remotely
+*/
+func (im *IM) SetSessionPath(path string) {
+	im.sessionPath = path
+}
+
+/*
+* Contact path sends and answers friend requests and lists contacts of a user
+*/
+func (im *IM) SetContactPath(path string) {
+	im.contactPath = path
 }
 func (im *IM) Validate(validation string) (*User, error) {
 	return im.UserManager.Validate(validation)
@@ -156,6 +524,22 @@ func (im *IM) SetConsumerCallbacks(onNewReceiverCallback func(string),
 	im.consumerInit = true
 }
 
+/*
+* Group messages with more receivers than limit don't call onMessageTargetMissCallback
+* for offline receivers unless they are mentioned, 0 means no limit
+*/
+func (im *IM) SetGroupNotifyLimit(limit int) {
+	im.groupNotifyLimit = limit
+}
+
+/*
+* "@all" mentions every member only in group messages with at most limit receivers,
+* 0 means no one can mention all
+*/
+func (im *IM) SetMentionAllLimit(limit int) {
+	im.mentionAllLimit = limit
+}
+
 /*
 * init IM struct
 */
@@ -167,8 +551,16 @@ func (im *IM) init() {
 
 	im.consumerPools = make(map[string]ConsumerPool)
 	for _, g := range im.channelGroups {
+		if _, ok := im.registry.Lookup(g.mt); !ok {
+			log.Printf("Message type(%s) is not registered, its messages can't be delivered\n", g.mt)
+		}
 		g.SetMessageClassifiers(im.classifiers)
-		im.consumerPools[g.mt] = NewConsumerPool(im.onNewReceiver, im.onMessageTargetMissCallback)
+		if im.ordered {
+			g.SetOrdered()
+			im.consumerPools[g.mt] = NewOrderedConsumerPool(im.onNewReceiver, im.onTargetMiss, len(g.channels))
+		} else {
+			im.consumerPools[g.mt] = NewConsumerPool(im.onNewReceiver, im.onTargetMiss)
+		}
 		im.consumerPools[g.mt].Start(g.sendingMessage)
 		g.StartChannels()
 		if g.gm != nil {
@@ -176,8 +568,35 @@ func (im *IM) init() {
 		}
 	}
 
+	im.uploadPolicy.SetUsageFunc(im.communication.StorageUsage)
+	im.communication.registerParsers()
+
 	im.UserManager.StartExpireCheck(time.Minute * 10)
 
+	if im.expirer != nil {
+		if err := im.expirer.Load(); err != nil {
+			log.Print(err)
+		}
+		im.expirer.Start()
+	}
+	if h, ok := im.history.(EvictingHistory); ok && im.reactions != nil {
+		h.OnEvict(im.reactions.Delete)
+	}
+	if im.scheduler != nil {
+		if err := im.scheduler.Load(); err != nil {
+			log.Print(err)
+		}
+		im.scheduler.Start()
+	}
+	if im.profiles != nil {
+		if err := im.profiles.Load(im.communication.imageProxy); err != nil {
+			log.Print(err)
+		}
+	}
+	go im.limiter.run()
+	go im.communication.imageProxy.run()
+	go im.communication.fileProxy.run()
+
 	route(im)
 }
 
@@ -201,5 +620,13 @@ func (im *IM) Start() {
 		panic("User maanger is not set")
 	}
 
+	//every registered type without channels set is delivered through its own channel group,
+	//including notices
+	for _, mt := range im.registry.Types() {
+		if _, ok := im.channelGroups[mt]; !ok {
+			im.SetChannel(NewBaseChannel, mt, 1, DefaultChannelBufferSize, nil)
+		}
+	}
+
 	im.init()
 }
@@ -0,0 +1,130 @@
+package IM
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	MentionAll = "all"			//Mention all members of a group with "@all"
+	DefaultMentionAllLimit = 100		//Max receivers of a group message mentioning all
+)
+
+var mentionPattern = regexp.MustCompile(`@([^\s@;:\033]+)`)
+
+/*
+* Parse mentions in the text of a group message, a mention is "@" followed by a user id
+* Only members of the group, which are the sender and the receivers of the message,
+* can be mentioned, and "@all" mentions every member
+*/
+func ParseMentions(text string, members []string) []string {
+	memberSet := make(map[string]uint8, len(members))
+	for _, m := range members {
+		memberSet[m] = 0
+	}
+
+	mentions := make([]string, 0)
+	seen := make(map[string]uint8)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		id := match[1]
+		if _, ok := seen[id]; ok {
+			continue
+		}
+
+		if _, ok := memberSet[id]; ok || id == MentionAll {
+			seen[id] = 0
+			mentions = append(mentions, id)
+		}
+	}
+
+	return mentions
+}
+
+/*
+* Parse mentions of a group text message before it's sent
+* Receivers of the message are members only if the server knows them as members too,
+* see GroupMembers, and "@all" is dropped if the message has more receivers than the limit
+*/
+func (im *IM) parseMentions(m Message) {
+	tm, ok := m.(*TextMessage)
+	if !ok || !tm.IsGroupMessage() {
+		return
+	}
+
+	text, ok := tm.Content().(string)
+	if !ok || !strings.Contains(text, "@") {
+		return
+	}
+
+	targets := strings.Split(tm.TargetId(), ";")
+	known := im.GroupMembers(tm.GroupName())
+	members := make([]string, 0, len(targets) + 1)
+	for _, t := range append(targets, tm.SenderId()) {
+		if _, ok := known[t]; ok || len(known) == 0 {
+			members = append(members, t)
+		}
+	}
+
+	mentions := ParseMentions(text, members)
+	if len(targets) > im.mentionAllLimit {
+		kept := mentions[:0]
+		for _, mention := range mentions {
+			if mention != MentionAll {
+				kept = append(kept, mention)
+			}
+		}
+		mentions = kept
+	}
+	tm.SetMentions(mentions)
+}
+
+/*
+* If a user is mentioned by a message
+*/
+func IsMentioned(m Message, id string) bool {
+	tm, ok := m.(*TextMessage)
+	if !ok {
+		return false
+	}
+
+	for _, mention := range tm.Mentions() {
+		if mention == id || mention == MentionAll {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* If a receiver who is offline should be notified of a group message
+* A mentioned receiver is always notified, otherwise a receiver who muted the group
+* or a receiver of a group message with too many receivers is not notified
+*/
+func (im *IM) shouldNotify(m Message, id string) bool {
+	if !m.IsGroupMessage() || m.Type() == NoticeMessageType {
+		return true
+	}
+	if IsMentioned(m, id) {
+		return true
+	}
+	if im.UserManager != nil && im.UserManager.IsMuted(id, m.GroupName()) {
+		return false
+	}
+	if im.groupNotifyLimit > 0 && strings.Count(m.TargetId(), ";") + 1 > im.groupNotifyLimit {
+		return false
+	}
+	return true
+}
+
+/*
+* Called by consumer pools when a receiver is offline
+*/
+func (im *IM) onTargetMiss(m Message, id string) error {
+	if IsExpired(m) {
+		return ErrMessageExpired
+	}
+	if !im.shouldNotify(m, id) {
+		return nil
+	}
+	return im.onMessageTargetMissCallback(m, id)
+}
@@ -0,0 +1,88 @@
+package IM
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	members := []string{ "a", "b", "c.d" }
+
+	cases := []struct {
+		text string
+		mentions []string
+	}{
+		{ "hi", []string{} },
+		{ "@a hi", []string{ "a" } },
+		{ "@a @b @a", []string{ "a", "b" } },
+		{ "@stranger @b", []string{ "b" } },
+		{ "@all meeting", []string{ "all" } },
+		{ "mail@a.com", []string{} },
+		{ "@c.d;@b:", []string{ "c.d", "b" } },
+		{ "@@a", []string{ "a" } },
+	}
+
+	for _, c := range cases {
+		if mentions := ParseMentions(c.text, members); !reflect.DeepEqual(mentions, c.mentions) {
+			t.Errorf("%q: got mentions %v, want %v", c.text, mentions, c.mentions)
+		}
+	}
+}
+
+func TestParseMentionsOfMessage(t *testing.T) {
+	im := NewIM("localhost")
+	im.SetMentionAllLimit(2)
+
+	cases := []struct {
+		name string
+		text string
+		targets string
+		group string
+		mentions []string
+	}{
+		{ "group", "@b @c", "b;c", "g", []string{ "b", "c" } },
+		{ "sender", "@a", "b", "g", []string{ "a" } },
+		{ "all", "@all", "b;c", "g", []string{ "all" } },
+		{ "all over limit", "@all @b", "b;c;d", "g", []string{ "b" } },
+		{ "not a group message", "@b", "b", "", nil },
+	}
+
+	for _, c := range cases {
+		m := NewTextMessage(c.text).(*TextMessage)
+		m.SetSenderId("a")
+		m.SetTargetId(c.targets)
+		if c.group != "" {
+			m.SetGroup(c.group)
+		}
+
+		im.parseMentions(m)
+		if !reflect.DeepEqual(m.Mentions(), c.mentions) {
+			t.Errorf("%s: got mentions %v, want %v", c.name, m.Mentions(), c.mentions)
+		}
+	}
+}
+
+func TestIsMentioned(t *testing.T) {
+	m := NewTextMessage("@b").(*TextMessage)
+	m.SetMentions([]string{ "b" })
+	all := NewTextMessage("@all").(*TextMessage)
+	all.SetMentions([]string{ MentionAll })
+
+	cases := []struct {
+		name string
+		m Message
+		id string
+		mentioned bool
+	}{
+		{ "mentioned", m, "b", true },
+		{ "not mentioned", m, "c", false },
+		{ "all", all, "c", true },
+		{ "picture", NewPictureMessage([]byte("png"), "png"), "b", false },
+	}
+
+	for _, c := range cases {
+		if mentioned := IsMentioned(c.m, c.id); mentioned != c.mentioned {
+			t.Errorf("%s: got %v, want %v", c.name, mentioned, c.mentioned)
+		}
+	}
+}
@@ -14,9 +14,17 @@ const (
 	TextMessageType = "TextMessage"
 	PictureMessageType = "PictureMessage"
 	FileMessageType = "FileMessage"
+	NoticeMessageType = "NoticeMessage"
+	LocationMessageType = "LocationMessage"
+	ContactCardMessageType = "ContactCardMessage"
+	VoiceMessageType = "VoiceMessage"
+	StickerMessageType = "StickerMessage"
 )
 
 
+var ErrMessageTimeout = errors.New("Message handle time out")
+var ErrMessageExpired = errors.New("Message expired")
+
 /*
 * Message defines base element and convert method
 */
@@ -40,6 +48,27 @@ type Message interface {
 	IsGroupMessage() bool			//If This Message Is Group Message
 	GroupName() string			//Group Name
 	SetGroup(string)			//Set Group
+
+	Sequence() uint64			//Sequence number in its conversation, 0 if not in ordering mode
+	SetSequence(uint64)			//Set sequence number
+	SequenceScope() uint64			//Id of the first message of the sequence space, see Sequencer
+	SetSequenceScope(uint64)		//Set sequence space
+
+	ParentId() uint64			//Id of the message replied to, 0 if it's not a reply
+	SetParentId(uint64)			//Set the message replied to
+
+	Expiry() (time.Duration, bool)		//TTL of the message and whether it counts from when it's read, 0 if it never expires
+	SetExpiry(time.Duration, bool)		//Set TTL of the message
+	ExpireAt() time.Time			//Time the message expires, zero if it's not counting down
+	SetExpireAt(time.Time)			//Set time the message expires
+}
+
+/*
+* If a message is expired and should not be delivered any more
+*/
+func IsExpired(m Message) bool {
+	t := m.ExpireAt()
+	return !t.IsZero() && !time.Now().Before(t)
 }
 
 
@@ -56,7 +85,16 @@ type DefaultMessage struct {
 	isGroup bool
 	groupName string
 
+	sequence uint64
+	sequenceScope uint64
+	parentId uint64
+
+	ttl time.Duration
+	expireAfterRead bool
+	expireAt time.Time
+
 	errorChan chan error
+	onFinish func()
 
 	content interface{}
 }
@@ -79,10 +117,27 @@ func (t *DefaultMessage) Wait(d time.Duration) error {
 	case err := <- t.errorChan :
 		return err
 	case <- time.After(d) :
-		return errors.New("Message handle time out")
+		return ErrMessageTimeout
 	}
 }
-func (t *DefaultMessage) Finish(e error) { t.errorChan <- e }
+func (t *DefaultMessage) Finish(e error) {
+	if t.onFinish != nil {
+		t.onFinish()
+	}
+
+	//only the first result is kept, a message may be finished by several receivers
+	select {
+	case t.errorChan <- e:
+	default:
+	}
+}
+
+/*
+* Set a function called when the message is finished, it may be called more than once
+*/
+func (t *DefaultMessage) OnFinish(f func()) {
+	t.onFinish = f
+}
 func (t *DefaultMessage) SetGroup(g string) {
 	t.isGroup = true
 	t.groupName = g
@@ -93,6 +148,19 @@ func (t *DefaultMessage) IsGroupMessage() bool {
 func (t *DefaultMessage) GroupName() string {
 	return t.groupName
 }
+func (t *DefaultMessage) Sequence() uint64 { return t.sequence }
+func (t *DefaultMessage) SetSequence(s uint64) { t.sequence = s }
+func (t *DefaultMessage) SequenceScope() uint64 { return t.sequenceScope }
+func (t *DefaultMessage) SetSequenceScope(s uint64) { t.sequenceScope = s }
+func (t *DefaultMessage) ParentId() uint64 { return t.parentId }
+func (t *DefaultMessage) SetParentId(id uint64) { t.parentId = id }
+func (t *DefaultMessage) Expiry() (time.Duration, bool) { return t.ttl, t.expireAfterRead }
+func (t *DefaultMessage) SetExpiry(ttl time.Duration, afterRead bool) {
+	t.ttl = ttl
+	t.expireAfterRead = afterRead
+}
+func (t *DefaultMessage) ExpireAt() time.Time { return t.expireAt }
+func (t *DefaultMessage) SetExpireAt(at time.Time) { t.expireAt = at }
 
 
 /*
@@ -102,11 +170,13 @@ func (t *DefaultMessage) GroupName() string {
 //TextMessage
 type TextMessage struct {
 	DefaultMessage
+
+	mentions []string			//Users mentioned in a group message
 }
 
 func NewTextMessage(content string) Message {
 	return &TextMessage{
-		DefaultMessage{
+		DefaultMessage : DefaultMessage{
 			messageType        : TextMessageType,
 			content                : content,
 			errorChan        : make(chan error, 1),
@@ -115,6 +185,8 @@ func NewTextMessage(content string) Message {
 }
 
 func (t *TextMessage) OnReceived() { log.Printf("Message received(%d), target: %v\n", t.Id(), t.TargetId()) }
+func (t *TextMessage) Mentions() []string { return t.mentions }
+func (t *TextMessage) SetMentions(mentions []string) { t.mentions = mentions }
 func (t *TextMessage) OnBinary() ([]byte, error) {
 	if s, ok := t.Content().(string); ok {
 		return []byte(s), nil
@@ -181,3 +253,34 @@ func (m *FileMessage) OnBinary() ([]byte, error) {
 func (m *FileMessage) FileName() string { return m.filename }
 
 
+//NoticeMessage
+//A notice is generated by the server to tell clients something happened, eg: a message is pending for scan
+//It's delivered as a frame whose type is the kind of the notice
+type NoticeMessage struct {
+	DefaultMessage
+
+	kind string
+	meta map[string]string
+}
+func NewNoticeMessage(kind string, content string) *NoticeMessage {
+	return &NoticeMessage{
+		DefaultMessage : DefaultMessage {
+			messageType	: NoticeMessageType,
+			content		: content,
+			errorChan	: make(chan error, 1),
+		},
+
+		kind		: kind,
+		meta		: make(map[string]string),
+	}
+}
+func (m *NoticeMessage) OnBinary() ([]byte, error) {
+	if s, ok := m.content.(string); ok {
+		return []byte(s), nil
+	} else {
+		return nil, errors.New("Invalid Notice message")
+	}
+}
+func (m *NoticeMessage) Kind() string { return m.kind }
+func (m *NoticeMessage) Meta() map[string]string { return m.meta }
+func (m *NoticeMessage) AddMeta(key string, content string) { m.meta[key] = content }
@@ -0,0 +1,432 @@
+package IM
+
+import (
+	"net/http"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"log"
+)
+
+const (
+	DefaultMessageAPIPath = "/messages"
+	DefaultDeliveryWait = time.Second
+
+	maxMultipartMemory = 32 << 20
+)
+
+/*
+* Delivery status returned by the message api
+*/
+const (
+	StatusDelivered = "delivered"		//Message is pushed to at least one receiver or handled by target miss callback
+	StatusQueued = "queued"			//Message is accepted but not delivered yet
+	StatusPending = "pending"		//Message is waiting for content scan
+	StatusFailed = "failed"			//Message is not delivered
+	StatusScheduled = "scheduled"		//Message is scheduled, id is the id of the schedule
+	StatusDuplicate = "duplicate"		//Message with the same client message id was sent before, id is the id of it
+)
+
+/*
+* Error codes returned by the message api
+*/
+const (
+	ErrorInvalidRequest = "invalid_request"
+	ErrorUnauthorized = "unauthorized"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorForbidden = "forbidden"
+	ErrorNotFound = "not_found"
+	ErrorTooLarge = "too_large"
+	ErrorUnsupportedType = "unsupported_type"
+	ErrorContentRejected = "content_rejected"
+	ErrorDeliveryFailed = "delivery_failed"
+	ErrorInternal = "internal_error"
+	ErrorRateLimited = "rate_limited"
+)
+
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest			: ErrorInvalidRequest,
+	http.StatusUnauthorized			: ErrorUnauthorized,
+	http.StatusMethodNotAllowed		: ErrorMethodNotAllowed,
+	http.StatusForbidden			: ErrorForbidden,
+	http.StatusNotFound			: ErrorNotFound,
+	http.StatusRequestEntityTooLarge	: ErrorTooLarge,
+	http.StatusUnsupportedMediaType		: ErrorUnsupportedType,
+	http.StatusUnprocessableEntity		: ErrorContentRejected,
+	http.StatusInternalServerError		: ErrorInternal,
+	http.StatusTooManyRequests		: ErrorRateLimited,
+}
+
+/*
+* Request body of the message api
+* Post with "Content-Type":"application/json", or with "Content-Type":"multipart/form-data"
+* where the json is in form field "message" and attachments are uploaded as files
+* An attachment refers to an uploaded file by the form field name in "part",
+* or carries base64 encoded content in "data"
+*
+* eg: {"type":"TextMessage","to":["u1"],"text":"hello","clientMsgId":"c1"}
+* eg: {"type":"TextMessage","to":["u1","u2"],"group":"g1","text":"hello"}
+* eg: {"type":"TextMessage","to":["u1"],"text":"agree","parentId":"123"}		//reply to message 123
+* eg: {"type":"TextMessage","to":["u1"],"text":"morning","sendAt":"2017-06-01T09:00:00+08:00"}
+* eg: {"type":"TextMessage","to":["u1"],"text":"reminder","delay":1800}				//send in 30 minutes
+* eg: {"type":"TextMessage","to":["u1"],"text":"secret","ttl":30,"expireAfterRead":true}		//vanish 30 seconds after read
+* eg: {"type":"LocationMessage","to":["u1"],"location":{"latitude":31.2,"longitude":121.5,"name":"Home"}}
+* eg: {"type":"VoiceMessage","to":["u1"],"voice":{"duration":3200,"waveform":[0,80,255]},"attachments":[{"name":"v.ogg","part":"file"}]}
+* eg: {"type":"PictureMessage","to":["u1"],"attachments":[{"name":"a.png","part":"file"}]}
+* eg: {"type":"PollMessage","to":["u1"],"content":{"question":"lunch?"},"params":{"k":"v"}}		//a type registered by RegisterMessageType
+*/
+type MessageRequest struct {
+	Type string			`json:"type"`
+	To []string			`json:"to"`
+	Group string			`json:"group,omitempty"`
+	Text string			`json:"text,omitempty"`
+	Attachments []Attachment	`json:"attachments,omitempty"`
+	ClientMsgId string		`json:"clientMsgId,omitempty"`
+	ParentId uint64			`json:"parentId,string,omitempty"`
+	SendAt string			`json:"sendAt,omitempty"`		//Send at a time in RFC3339
+	Delay int64			`json:"delay,omitempty"`		//Send after seconds
+	TTL int64			`json:"ttl,omitempty"`		//Seconds before the message expires
+	ExpireAfterRead bool		`json:"expireAfterRead,omitempty"`	//TTL counts from when the message is read
+
+	Location *Location		`json:"location,omitempty"`
+	Contact *ContactCard		`json:"contact,omitempty"`
+	Sticker *Sticker		`json:"sticker,omitempty"`
+	Voice *VoiceMeta		`json:"voice,omitempty"`		//Meta of a voice, the audio is an attachment
+
+	Content json.RawMessage		`json:"content,omitempty"`		//Content of a registered type, or use an attachment
+	Params map[string]string	`json:"params,omitempty"`		//Params of a registered type
+}
+
+type Attachment struct {
+	Name string			`json:"name"`
+	Part string			`json:"part,omitempty"`
+	Data []byte			`json:"data,omitempty"`
+}
+
+/*
+* Response body of the message api
+*/
+type MessageResponse struct {
+	Id string			`json:"id,omitempty"`
+	ClientMsgId string		`json:"clientMsgId,omitempty"`
+	Status string			`json:"status"`
+	Error *APIError			`json:"error,omitempty"`
+}
+
+type APIError struct {
+	Code string			`json:"code"`
+	Message string			`json:"message"`
+}
+
+/*
+* Convert an error to an api error and its http status
+*/
+func NewAPIError(err error) (int, *APIError) {
+	status := http.StatusBadRequest
+	if se, ok := err.(*SendError); ok {
+		status = se.Code
+	}
+
+	code, ok := apiErrorCodes[status]
+	if !ok {
+		code = ErrorInvalidRequest
+	}
+
+	return status, &APIError{ Code : code, Message : err.Error() }
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, clientMsgId string, err error) {
+	setRetryAfter(w, err)
+	status, apiErr := NewAPIError(err)
+	writeJSON(w, status, &MessageResponse{
+		ClientMsgId	: clientMsgId,
+		Status		: StatusFailed,
+		Error		: apiErr,
+	})
+}
+
+/*
+* If reading a body failed because it's over the limit of http.MaxBytesReader,
+* the error may be wrapped by the multipart reader
+*/
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+/*
+* Parse a message request, and read uploaded attachments of a multipart request
+* A body over max size is rejected with 413, and a malformed body with 400
+*/
+func parseMessageRequest(w http.ResponseWriter, r *http.Request, maxSize int64) (*MessageRequest, error) {
+	if maxSize > 0 && r.ContentLength > maxSize {
+		return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+	}
+	if maxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+
+	req := &MessageRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxMultipartMemory); err != nil {
+			if isBodyTooLarge(err) {
+				return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+			}
+			return nil, NewSendError(http.StatusBadRequest, "Invalid multipart body")
+		}
+		if err := json.Unmarshal([]byte(r.FormValue("message")), req); err != nil {
+			return nil, NewSendError(http.StatusBadRequest, "Invalid message json")
+		}
+
+		//all uploaded files are attachments if no attachment is declared
+		if len(req.Attachments) == 0 {
+			for part, fhs := range r.MultipartForm.File {
+				for _, fh := range fhs {
+					req.Attachments = append(req.Attachments, Attachment{ Name : fh.Filename, Part : part })
+				}
+			}
+		}
+
+		for i := range req.Attachments {
+			a := &req.Attachments[i]
+			if a.Part == "" {
+				continue
+			}
+
+			f, fh, err := r.FormFile(a.Part)
+			if err != nil {
+				return nil, NewSendError(http.StatusBadRequest, "Attachment part missed: " + a.Part)
+			}
+			a.Data, err = ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				if isBodyTooLarge(err) {
+					return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+				}
+				return nil, NewSendError(http.StatusBadRequest, "Fail to read attachment: " + a.Part)
+			}
+			if a.Name == "" {
+				a.Name = fh.Filename
+			}
+		}
+	} else {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+			}
+			return nil, NewSendError(http.StatusBadRequest, "Fail to read message body")
+		}
+		if err := json.Unmarshal(body, req); err != nil {
+			return nil, NewSendError(http.StatusBadRequest, "Invalid message json")
+		}
+	}
+
+	return req, nil
+}
+
+/*
+* Create a message from a message request
+*/
+func (req *MessageRequest) toMessage(policy *UploadPolicy, registry *MessageRegistry, senderId string) (Message, error) {
+	if req.Type == "" {
+		return nil, NewSendError(http.StatusBadRequest, "Message type missed")
+	}
+	if len(req.To) == 0 {
+		return nil, NewSendError(http.StatusBadRequest, "Target id missed")
+	}
+	if req.Group == "" && len(req.To) > 1 {
+		return nil, NewSendError(http.StatusBadRequest, "Group missed for several targets")
+	}
+
+	var body []byte
+	params := make(map[string]string)
+	switch req.Type {
+	case TextMessageType:
+		body = []byte(req.Text)
+	case PictureMessageType, FileMessageType, VoiceMessageType:
+		if len(req.Attachments) != 1 {
+			return nil, NewSendError(http.StatusBadRequest, "Exactly one attachment is needed")
+		}
+		body = req.Attachments[0].Data
+		params["name"] = req.Attachments[0].Name
+		if req.Type != FileMessageType {
+			params["name"] = strings.TrimPrefix(strings.ToLower(filepath.Ext(params["name"])), ".")
+		}
+		if req.Type == VoiceMessageType {
+			if req.Voice == nil {
+				return nil, NewSendError(http.StatusBadRequest, "Voice meta missed")
+			}
+			params["duration"] = strconv.FormatInt(req.Voice.Duration, 10)
+			params["waveform"] = EncodeWaveform(req.Voice.Waveform)
+		}
+	case LocationMessageType:
+		body, _ = json.Marshal(req.Location)
+	case ContactCardMessageType:
+		body, _ = json.Marshal(req.Contact)
+	case StickerMessageType:
+		body, _ = json.Marshal(req.Sticker)
+	default:
+		body = req.Content
+		if len(req.Attachments) > 0 {
+			body = req.Attachments[0].Data
+			params["name"] = req.Attachments[0].Name
+		}
+		for k, v := range req.Params {
+			params[k] = v
+		}
+	}
+
+	if max := policy.MaxSize(req.Type); max > 0 && int64(len(body)) > max {
+		return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+	}
+
+	m, err := registry.Decode(policy, senderId, req.Type, body, params)
+	if err != nil {
+		return nil, err
+	}
+
+	m.SetTargetId(strings.Join(req.To, ";"))
+	m.SetSenderId(senderId)
+	if req.Group != "" {
+		m.SetGroup(req.Group)
+	}
+	m.SetParentId(req.ParentId)
+
+	if req.TTL != 0 {
+		p := &ExpiryPolicy{ TTL : req.TTL, AfterRead : req.ExpireAfterRead }
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		m.SetExpiry(time.Duration(p.TTL) * time.Second, p.AfterRead)
+	}
+
+	return m, nil
+}
+
+/*
+* Time to send the message, zero if it's sent at once
+*/
+func (req *MessageRequest) sendAt() (time.Time, error) {
+	delay := ""
+	if req.Delay > 0 {
+		delay = strconv.FormatInt(req.Delay, 10)
+	}
+	return ParseSendAt(req.SendAt, delay)
+}
+
+/*
+* Serve the json message api
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body-------------------
+* MessageRequest in json
+*
+* Return MessageResponse in json, eg:
+* {"id":"12","clientMsgId":"c1","status":"delivered"}
+* {"id":"12","clientMsgId":"c1","status":"duplicate"}	//retried with the same clientMsgId
+* {"clientMsgId":"c1","status":"failed","error":{"code":"too_large","message":"Message too large"}}
+*/
+func (im *IM) ServeMessageAPI(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only post is allowed"))
+		return
+	}
+
+	if err := im.checkRate(RateSendIP, remoteIP(r)); err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+	if err := im.checkRate(RateSendUser, u.id); err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	req, err := parseMessageRequest(w, r, im.uploadPolicy.MaxRequestSize())
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	m, err := req.toMessage(im.uploadPolicy, im.registry, u.id)
+	if err != nil {
+		writeAPIError(w, req.ClientMsgId, err)
+		return
+	}
+	if err := im.checkSendRate(r, u.id, m.Type()); err != nil {
+		writeAPIError(w, req.ClientMsgId, err)
+		return
+	}
+
+	at, err := req.sendAt()
+	if err != nil {
+		writeAPIError(w, req.ClientMsgId, err)
+		return
+	}
+
+	id, dup, err := im.SendOrSchedule(m, req.ClientMsgId, at)
+	if err != nil {
+		writeAPIError(w, req.ClientMsgId, err)
+		return
+	}
+
+	res := &MessageResponse{
+		Id		: strconv.FormatUint(id, 10),
+		ClientMsgId	: req.ClientMsgId,
+	}
+
+	if dup {
+		res.Status = StatusDuplicate
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+
+	if !at.IsZero() {
+		res.Status = StatusScheduled
+		writeJSON(w, http.StatusAccepted, res)
+		return
+	}
+
+	if im.scanner != nil && im.asyncScan {
+		if _, _, ok := scannedContent(m); ok {
+			res.Status = StatusPending
+			writeJSON(w, http.StatusAccepted, res)
+			return
+		}
+	}
+
+	if err := m.Wait(DefaultDeliveryWait); err == nil {
+		res.Status = StatusDelivered
+		writeJSON(w, http.StatusOK, res)
+	} else if err == ErrMessageTimeout {
+		res.Status = StatusQueued
+		writeJSON(w, http.StatusAccepted, res)
+	} else {
+		res.Status = StatusFailed
+		res.Error = &APIError{ Code : ErrorDeliveryFailed, Message : err.Error() }
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,112 @@
+package IM
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newMultipartBody(t *testing.T, message string, file []byte) (string, []byte) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	if err := mw.WriteField("message", message); err != nil {
+		t.Fatal(err)
+	}
+	fw, err := mw.CreateFormFile("file", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(file)
+	mw.Close()
+	return mw.FormDataContentType(), buf.Bytes()
+}
+
+func TestParseMessageRequest(t *testing.T) {
+	text := `{"type":"TextMessage","to":["u1"],"text":"hello"}`
+	picture := `{"type":"PictureMessage","to":["u1"]}`
+	multipartType, multipartBody := newMultipartBody(t, picture, []byte("png"))
+	_, largeBody := newMultipartBody(t, picture, bytes.Repeat([]byte("x"), 4096))
+
+	cases := []struct {
+		name string
+		contentType string
+		body []byte
+		knownLength bool
+		code int
+		attachments int
+	}{
+		{ "json", "application/json", []byte(text), true, 0, 0 },
+		{ "json over max size", "application/json", []byte(strings.Repeat(" ", 2048) + text), true, http.StatusRequestEntityTooLarge, 0 },
+		{ "json over max size without length", "application/json", []byte(strings.Repeat(" ", 2048) + text), false, http.StatusRequestEntityTooLarge, 0 },
+		{ "invalid json", "application/json", []byte("{"), true, http.StatusBadRequest, 0 },
+		{ "multipart", multipartType, multipartBody, true, 0, 1 },
+		{ "multipart over max size without length", multipartType, largeBody, false, http.StatusRequestEntityTooLarge, 0 },
+		{ "malformed multipart", multipartType, []byte("--nothing\r\n"), true, http.StatusBadRequest, 0 },
+		{ "multipart without message", multipartType, multipartBody[:0], true, http.StatusBadRequest, 0 },
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/messages", bytes.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		if !c.knownLength {
+			r.ContentLength = -1
+		}
+
+		req, err := parseMessageRequest(httptest.NewRecorder(), r, 1024)
+		code := 0
+		if se, ok := err.(*SendError); ok {
+			code = se.Code
+		} else if err != nil {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, code, c.code)
+			continue
+		}
+		if err == nil && len(req.Attachments) != c.attachments {
+			t.Errorf("%s: got %d attachments, want %d", c.name, len(req.Attachments), c.attachments)
+		}
+	}
+}
+
+func TestMessageRequestToMessage(t *testing.T) {
+	policy := NewUploadPolicy()
+	registry := NewMessageRegistry()
+
+	cases := []struct {
+		name string
+		req *MessageRequest
+		code int
+		target string
+	}{
+		{ "text", &MessageRequest{ Type : TextMessageType, To : []string{ "u1" }, Text : "hi" }, 0, "u1" },
+		{ "group", &MessageRequest{ Type : TextMessageType, To : []string{ "u1", "u2" }, Group : "g", Text : "hi" }, 0, "u1;u2" },
+		{ "type missed", &MessageRequest{ To : []string{ "u1" }, Text : "hi" }, http.StatusBadRequest, "" },
+		{ "target missed", &MessageRequest{ Type : TextMessageType, Text : "hi" }, http.StatusBadRequest, "" },
+		{ "several targets without group", &MessageRequest{ Type : TextMessageType, To : []string{ "u1", "u2" }, Text : "hi" }, http.StatusBadRequest, "" },
+		{ "picture without attachment", &MessageRequest{ Type : PictureMessageType, To : []string{ "u1" } }, http.StatusBadRequest, "" },
+		{ "invalid TTL", &MessageRequest{ Type : TextMessageType, To : []string{ "u1" }, Text : "hi", TTL : -1 }, http.StatusBadRequest, "" },
+	}
+
+	for _, c := range cases {
+		m, err := c.req.toMessage(policy, registry, "sender")
+		code := 0
+		if se, ok := err.(*SendError); ok {
+			code = se.Code
+		} else if err != nil {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, code, c.code)
+			continue
+		}
+		if err == nil && (m.TargetId() != c.target || m.SenderId() != "sender") {
+			t.Errorf("%s: got message from %s to %s", c.name, m.SenderId(), m.TargetId())
+		}
+	}
+}
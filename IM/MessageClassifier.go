@@ -55,7 +55,7 @@ func (c *DefaultMessageClassifier) Classify(m Message) {
 
 	if g, ok := c.channelGroups[m.Type()]; ok {
 		select {
-		case g.incomingMessage <- m:
+		case g.incoming(m) <- m:
 		default:
 			log.Print("message discarded(%s)", m.Type())
 			m.Finish(errors.New("message discarded(channel group is busy)"))
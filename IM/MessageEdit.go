@@ -0,0 +1,164 @@
+package IM
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultEditWindow = time.Minute * 2
+
+	//Frame kinds of notices about changes of messages
+	MessageEdited = "MessageEdited"
+	MessageRecalled = "MessageRecalled"
+)
+
+/*
+* Request body of edit and recall api, text is only used by edit
+* eg: {"id":"123","text":"fixed typo"}
+*/
+type MessageUpdateRequest struct {
+	Id uint64			`json:"id,string"`
+	Text string			`json:"text,omitempty"`
+}
+
+/*
+* Check if a user can change a message in history
+*/
+func (im *IM) checkUpdate(id uint64, senderId string) (*HistoryRecord, error) {
+	if im.history == nil {
+		return nil, NewSendError(http.StatusNotFound, "History is not enabled")
+	}
+
+	r, ok := im.history.Get(id)
+	if !ok {
+		return nil, NewSendError(http.StatusNotFound, ErrRecordNotFound.Error())
+	}
+	if r.Sender != senderId {
+		return nil, NewSendError(http.StatusForbidden, "Only the sender can change the message")
+	}
+	if r.Recalled {
+		return nil, NewSendError(http.StatusForbidden, "Message is recalled")
+	}
+	if time.Now().Sub(r.Time) > im.editWindow {
+		return nil, NewSendError(http.StatusForbidden, "Message is too old to change")
+	}
+
+	return r, nil
+}
+
+/*
+* Edit a text message, only the sender can edit it in edit window
+* Receivers and other devices of the sender get a MessageEdited frame with the id of the message and the new text
+*/
+func (im *IM) EditMessage(id uint64, senderId string, text string) error {
+	r, err := im.checkUpdate(id, senderId)
+	if err != nil {
+		return err
+	}
+	if r.Type != TextMessageType {
+		return NewSendError(http.StatusBadRequest, "Only text message can be edited")
+	}
+	if max := im.uploadPolicy.MaxSize(TextMessageType); max > 0 && int64(len(text)) > max {
+		return NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+	}
+
+	err = im.history.Update(id, func(r *HistoryRecord) {
+		r.Content = []byte(text)
+		r.Edited = true
+		r.EditTime = time.Now()
+	})
+	if err != nil {
+		return NewSendError(http.StatusNotFound, err.Error())
+	}
+
+	im.notifyParticipants(MessageEdited, r, r.Sender, text)
+	return nil
+}
+
+/*
+* Recall a message, only the sender can recall it in edit window
+* Receivers and other devices of the sender get a MessageRecalled frame with the id of the message
+*/
+func (im *IM) RecallMessage(id uint64, senderId string) error {
+	r, err := im.checkUpdate(id, senderId)
+	if err != nil {
+		return err
+	}
+
+	err = im.history.Update(id, func(r *HistoryRecord) {
+		r.Content = nil
+		r.Recalled = true
+		r.EditTime = time.Now()
+	})
+	if err != nil {
+		return NewSendError(http.StatusNotFound, err.Error())
+	}
+
+	if im.reactions != nil {
+		im.reactions.Delete(id)
+	}
+	if im.expirer != nil {
+		im.expirer.Remove(id)
+	}
+
+	im.notifyParticipants(MessageRecalled, r, r.Sender, "")
+	return nil
+}
+
+/*
+* Serve edit and recall api
+* Post request should obey the following format:
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body-------------------
+* MessageUpdateRequest in json
+*
+* Return {"id":"xxx","status":"ok"} or an error in json
+*/
+func (im *IM) serveMessageUpdate(w http.ResponseWriter, r *http.Request, recall bool) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only post is allowed"))
+		return
+	}
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	body, err := readLimitedBody(r, im.uploadPolicy.MaxSize(TextMessageType) * 2)
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	req := &MessageUpdateRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+		return
+	}
+
+	if recall {
+		err = im.RecallMessage(req.Id, u.id)
+	} else {
+		err = im.EditMessage(req.Id, u.id, req.Text)
+	}
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{ "id" : strconv.FormatUint(req.Id, 10), "status" : "ok" })
+}
+func (im *IM) ServeEditMessage(w http.ResponseWriter, r *http.Request) {
+	im.serveMessageUpdate(w, r, false)
+}
+func (im *IM) ServeRecallMessage(w http.ResponseWriter, r *http.Request) {
+	im.serveMessageUpdate(w, r, true)
+}
@@ -0,0 +1,176 @@
+package IM
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	idEpoch = 1483228800000			//2017-01-01 00:00:00 UTC in milliseconds
+	idNodeBits = 10
+	idSequenceBits = 12
+	idMaxNode = 1 << idNodeBits - 1
+	idMaxSequence = 1 << idSequenceBits - 1
+
+	DefaultDedupWindow = time.Minute * 10
+)
+
+/*
+* Id generator generates unique 64-bit ids ordered by time
+* An id has the following structure:
+* 41 bits milliseconds since epoch | 10 bits node id | 12 bits sequence in the millisecond
+* so ids generated by different nodes never conflict as long as node ids are different
+*/
+type IdGenerator struct {
+	mutex sync.Mutex
+
+	node uint64
+	lastTime int64
+	sequence uint64
+}
+
+func NewIdGenerator(node uint16) *IdGenerator {
+	return &IdGenerator{
+		node		: uint64(node) & idMaxNode,
+	}
+}
+
+/*
+* Generate a new id, it never waits for the clock
+* When the clock moves backwards the last time is kept, and when sequence of the millisecond
+* runs out the next millisecond is used, so the time of ids may run ahead of the clock
+* for a while and ids are still unique and ordered
+*/
+func (g *IdGenerator) Next() uint64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now <= g.lastTime {
+		now = g.lastTime
+		g.sequence = (g.sequence + 1) & idMaxSequence
+		if g.sequence == 0 {
+			now++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastTime = now
+
+	return uint64(now - idEpoch) << (idNodeBits + idSequenceBits) | g.node << idSequenceBits | g.sequence
+}
+
+/*
+* Time when an id was generated
+*/
+func IdTime(id uint64) time.Time {
+	ms := int64(id >> (idNodeBits + idSequenceBits)) + idEpoch
+	return time.Unix(0, ms * int64(time.Millisecond))
+}
+
+
+/*
+* Send deduplicator remembers ids of messages sent with client message ids in a time window,
+* so that a message retried by a client with the same client message id is sent only once
+*/
+type SendDeduplicator struct {
+	mutex sync.Mutex
+
+	window time.Duration
+	sent map[string]*dedupRecord
+	lastSweep time.Time
+}
+
+type dedupRecord struct {
+	id uint64
+	time time.Time
+}
+
+func NewSendDeduplicator(window time.Duration) *SendDeduplicator {
+	return &SendDeduplicator{
+		window		: window,
+		sent		: make(map[string]*dedupRecord),
+		lastSweep	: time.Now(),
+	}
+}
+
+func dedupKey(senderId string, clientMsgId string) string {
+	return senderId + "\n" + clientMsgId
+}
+
+/*
+* Reserve an id for a client message, if the client message was sent in the window,
+* return the id of it and true, else return a new id generated by next and false
+*/
+func (d *SendDeduplicator) Reserve(senderId string, clientMsgId string, next func() uint64) (uint64, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(d.lastSweep) > d.window {
+		d.sweep(now)
+	}
+
+	key := dedupKey(senderId, clientMsgId)
+	if r, ok := d.sent[key]; ok && now.Sub(r.time) <= d.window {
+		return r.id, true
+	}
+
+	id := next()
+	d.sent[key] = &dedupRecord{ id : id, time : now }
+
+	return id, false
+}
+
+/*
+* Release a reserved client message, called when the message fails to be sent
+* so that it can be retried
+*/
+func (d *SendDeduplicator) Release(senderId string, clientMsgId string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.sent, dedupKey(senderId, clientMsgId))
+}
+
+/*
+* Delete records out of window
+* Note: caller must hold the mutex
+*/
+func (d *SendDeduplicator) sweep(now time.Time) {
+	for k, r := range d.sent {
+		if now.Sub(r.time) > d.window {
+			delete(d.sent, k)
+		}
+	}
+	d.lastSweep = now
+}
+
+/*
+* Send a message with a client message id, a message retried with the same
+* client message id by the same sender is not sent again
+* Return the id of the message and whether it's a duplicate
+* A message without client message id is always sent
+*/
+func (im *IM) SendIdempotent(m Message, clientMsgId string) (uint64, bool, error) {
+	return im.idempotent(m, clientMsgId, im.SendScannedMessage)
+}
+func (im *IM) idempotent(m Message, clientMsgId string, send func(Message) error) (uint64, bool, error) {
+	if clientMsgId == "" {
+		err := send(m)
+		return m.Id(), false, err
+	}
+
+	id, dup := im.dedup.Reserve(m.SenderId(), clientMsgId, im.nextMessageId)
+	if dup {
+		return id, true, nil
+	}
+
+	m.SetId(id)
+	if err := send(m); err != nil {
+		im.dedup.Release(m.SenderId(), clientMsgId)
+		return id, false, err
+	}
+
+	return id, false, nil
+}
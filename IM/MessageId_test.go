@@ -0,0 +1,112 @@
+package IM
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdGeneratorOrdered(t *testing.T) {
+	g := NewIdGenerator(3)
+	start := time.Now().Truncate(time.Millisecond)
+
+	last := uint64(0)
+	for i := 0; i < 10000; i++ {
+		id := g.Next()
+		if id <= last {
+			t.Fatalf("got id %d after %d", id, last)
+		}
+		if node := id >> idSequenceBits & idMaxNode; node != 3 {
+			t.Fatalf("got node %d in id %d", node, id)
+		}
+		last = id
+	}
+	if at := IdTime(last); at.Before(start) {
+		t.Errorf("got id time %v before %v", at, start)
+	}
+}
+
+func TestIdGeneratorClockBackwards(t *testing.T) {
+	g := NewIdGenerator(0)
+	future := time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond)
+
+	cases := []struct {
+		name string
+		sequence uint64
+		time int64
+	}{
+		{ "clock behind", 0, future },
+		{ "sequence runs out", idMaxSequence, future + 1 },
+	}
+
+	for _, c := range cases {
+		g.lastTime = future
+		g.sequence = c.sequence
+		id := g.Next()
+		if ms := int64(id >> (idNodeBits + idSequenceBits)) + idEpoch; ms != c.time {
+			t.Errorf("%s: got id at %d, want %d", c.name, ms, c.time)
+		}
+	}
+}
+
+func TestSendDeduplicator(t *testing.T) {
+	d := NewSendDeduplicator(time.Minute)
+	seq := uint64(0)
+	next := func() uint64 { seq++; return seq }
+
+	cases := []struct {
+		name string
+		sender string
+		clientMsgId string
+		release bool
+		id uint64
+		dup bool
+	}{
+		{ "new", "a", "1", false, 1, false },
+		{ "retried", "a", "1", false, 1, true },
+		{ "another sender", "b", "1", false, 2, false },
+		{ "another message", "a", "2", false, 3, false },
+		{ "released", "a", "1", true, 4, false },
+	}
+
+	for _, c := range cases {
+		if c.release {
+			d.Release(c.sender, c.clientMsgId)
+		}
+		id, dup := d.Reserve(c.sender, c.clientMsgId, next)
+		if id != c.id || dup != c.dup {
+			t.Errorf("%s: got %d, %v, want %d, %v", c.name, id, dup, c.id, c.dup)
+		}
+	}
+
+	d.sent[dedupKey("a", "2")].time = time.Now().Add(-time.Hour)
+	if id, dup := d.Reserve("a", "2", next); dup || id != 5 {
+		t.Errorf("got %d, %v for a message out of window", id, dup)
+	}
+}
+
+func TestIdempotentSendFailed(t *testing.T) {
+	im := NewIM("localhost")
+	fail := true
+	send := func(Message) error {
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	}
+
+	m := NewTextMessage("hi")
+	m.SetSenderId("a")
+	if _, _, err := im.idempotent(m, "1", send); err == nil {
+		t.Fatal("got no error")
+	}
+
+	fail = false
+	id, dup, err := im.idempotent(m, "1", send)
+	if err != nil || dup {
+		t.Errorf("retry after failure: got %v, %v", dup, err)
+	}
+	if again, dup, _ := im.idempotent(m, "1", send); !dup || again != id {
+		t.Errorf("got %d, %v, want duplicate of %d", again, dup, id)
+	}
+}
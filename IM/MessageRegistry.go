@@ -0,0 +1,269 @@
+package IM
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+* MessageType defines how a type of message is handled from end to end
+* ---Decode creates a message from the content sent by a user, nil means users can't send it
+* ---Headers maps request headers of the sender path to params passed to Decode
+* ---Validate checks a decoded message before it's sent, optional
+* ---Parse converts messages to frames sent to clients, see Communication.AddCommonMeta
+* ---Encode fills a history record besides the content got by OnBinary, eg: name of a file, optional
+* ---Binary is set if the content is a blob, history returns an url to fetch it instead of the content
+* ---Decode and Restore should match, Restore creates a message from a record kept in history
+*/
+type MessageType struct {
+	Name string
+
+	Decode func(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error)
+	Headers map[string]string
+	Validate func(Message) error
+
+	Parse func(c *Communication, ms []Message) []*Frame
+
+	Encode func(Message, *HistoryRecord)
+	Restore func(*HistoryRecord) (Message, error)
+	Binary bool
+}
+
+/*
+* Registry of message types, built-in types are registered when it's created
+*/
+type MessageRegistry struct {
+	mutex sync.RWMutex
+
+	types map[string]*MessageType
+}
+
+func NewMessageRegistry() *MessageRegistry {
+	r := &MessageRegistry{
+		types		: make(map[string]*MessageType),
+	}
+
+	for _, t := range builtinMessageTypes() {
+		r.Register(t)
+	}
+
+	return r
+}
+
+/*
+* Register a message type, a registered type with the same name is replaced
+*/
+func (r *MessageRegistry) Register(t *MessageType) error {
+	if t == nil || t.Name == "" {
+		return errors.New("Message type name missed")
+	}
+	if t.Parse == nil {
+		return errors.New("Frame parser of message type missed")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.types[t.Name] = t
+	return nil
+}
+
+func (r *MessageRegistry) Lookup(name string) (*MessageType, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	t, ok := r.types[name]
+	return t, ok
+}
+
+/*
+* Names of all registered types in order
+*/
+func (r *MessageRegistry) Types() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.types))
+	for name := range r.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+/*
+* Params of a message type read from request headers of the sender path
+*/
+func (r *MessageRegistry) HeaderParams(name string, header http.Header) map[string]string {
+	params := make(map[string]string)
+	if t, ok := r.Lookup(name); ok {
+		for h, p := range t.Headers {
+			params[p] = header.Get(h)
+		}
+	}
+	return params
+}
+
+/*
+* Create a message of a type from the content sent by a user and validate it
+*/
+func (r *MessageRegistry) Decode(policy *UploadPolicy, senderId string, name string, body []byte, params map[string]string) (Message, error) {
+	t, ok := r.Lookup(name)
+	if !ok {
+		return nil, NewSendError(http.StatusBadRequest, "Unknown message type")
+	}
+	if t.Decode == nil {
+		return nil, NewSendError(http.StatusBadRequest, "Message type can't be sent by users")
+	}
+
+	m, err := t.Decode(policy, senderId, body, params)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() != name {
+		return nil, NewSendError(http.StatusInternalServerError, "Decoded message type mismatch")
+	}
+
+	if t.Validate != nil {
+		if err := t.Validate(m); err != nil {
+			if _, ok := err.(*SendError); ok {
+				return nil, err
+			}
+			return nil, NewSendError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	return m, nil
+}
+
+/*
+* Create a history record of a message
+*/
+func (r *MessageRegistry) Record(m Message) (*HistoryRecord, error) {
+	rec, err := NewHistoryRecord(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := r.Lookup(m.Type()); ok && t.Encode != nil {
+		t.Encode(m, rec)
+	}
+
+	return rec, nil
+}
+
+/*
+* Create a message from a record kept in history
+*/
+func (r *MessageRegistry) Restore(rec *HistoryRecord) (Message, error) {
+	t, ok := r.Lookup(rec.Type)
+	if !ok || t.Restore == nil {
+		return nil, errors.New("Message type can't be restored: " + rec.Type)
+	}
+
+	m, err := t.Restore(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	m.SetId(rec.Id)
+	m.SetSenderId(rec.Sender)
+	m.SetTargetId(rec.Target)
+	if rec.Group != "" {
+		m.SetGroup(rec.Group)
+	}
+	m.SetParentId(rec.ParentId)
+	m.SetExpiry(time.Duration(rec.TTL) * time.Second, rec.ExpireAfterRead)
+	m.SetExpireAt(rec.ExpireAt)
+
+	return m, nil
+}
+
+/*
+* Built-in message types
+*/
+func builtinMessageTypes() []*MessageType {
+	return []*MessageType{
+		{
+			Name		: TextMessageType,
+			Decode		: decodeText,
+			Parse		: (*Communication).parseText,
+			Restore		: func(r *HistoryRecord) (Message, error) { return NewTextMessage(string(r.Content)), nil },
+		},
+		{
+			Name		: PictureMessageType,
+			Decode		: decodePicture,
+			Headers		: map[string]string{ "Pic-Suffix" : "name" },
+			Parse		: (*Communication).parseImage,
+			Encode		: func(m Message, r *HistoryRecord) {
+				if pm, ok := m.(*PictureMessage); ok {
+					r.Name = pm.Suffix()
+				}
+			},
+			Restore		: func(r *HistoryRecord) (Message, error) { return NewPictureMessage(r.Content, r.Name), nil },
+			Binary		: true,
+		},
+		{
+			Name		: FileMessageType,
+			Decode		: decodeFile,
+			Headers		: map[string]string{ "File-Name" : "name" },
+			Parse		: (*Communication).parseFile,
+			Encode		: func(m Message, r *HistoryRecord) {
+				if fm, ok := m.(*FileMessage); ok {
+					r.Name = fm.FileName()
+				}
+			},
+			Restore		: func(r *HistoryRecord) (Message, error) { return NewFileMessage(r.Content, r.Name), nil },
+			Binary		: true,
+		},
+		{
+			Name		: VoiceMessageType,
+			Decode		: decodeVoice,
+			Headers		: map[string]string{ "Voice-Format" : "name", "Voice-Duration" : "duration", "Voice-Waveform" : "waveform" },
+			Parse		: (*Communication).parseVoice,
+			Encode		: encodeVoice,
+			Restore		: restoreVoice,
+			Binary		: true,
+		},
+		{
+			Name		: LocationMessageType,
+			Decode		: decodeLocation,
+			Parse		: (*Communication).parseJSON,
+			Restore		: restoreLocation,
+		},
+		{
+			Name		: ContactCardMessageType,
+			Decode		: decodeContactCard,
+			Parse		: (*Communication).parseJSON,
+			Restore		: restoreContactCard,
+		},
+		{
+			Name		: StickerMessageType,
+			Decode		: decodeSticker,
+			Parse		: (*Communication).parseJSON,
+			Restore		: restoreSticker,
+		},
+		{
+			//notices are generated by the server only and never kept in history
+			Name		: NoticeMessageType,
+			Parse		: (*Communication).parseNotice,
+		},
+	}
+}
+
+/*
+* Register a message type, so that it can be sent through the sender path and message api,
+* delivered to clients and kept in history
+* Start adds a channel group for each registered type without one set by SetChannel, so it
+* must be registered before Start
+* Note: messages of a custom type are limited by the max size of upload policy only,
+* they skip the content scanner, the upload quota and the file type policy. Decode may call
+* checkUpload with the policy and sender passed to it to check the quota and file type
+*/
+func (im *IM) RegisterMessageType(t *MessageType) error {
+	return im.registry.Register(t)
+}
@@ -0,0 +1,150 @@
+package IM
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const pollMessageType = "PollMessage"
+
+func newPollMessage(question string) Message {
+	m := NewTextMessage(question).(*TextMessage)
+	m.ResetMessage(pollMessageType, question)
+	return m
+}
+
+func TestMessageRegistryRegister(t *testing.T) {
+	r := NewMessageRegistry()
+
+	cases := []struct {
+		name string
+		t *MessageType
+		ok bool
+	}{
+		{ "nil", nil, false },
+		{ "name missed", &MessageType{ Parse : (*Communication).parseJSON }, false },
+		{ "parser missed", &MessageType{ Name : pollMessageType }, false },
+		{ "custom", &MessageType{ Name : pollMessageType, Parse : (*Communication).parseJSON }, true },
+	}
+
+	for _, c := range cases {
+		if err := r.Register(c.t); (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+		}
+	}
+
+	if _, ok := r.Lookup(pollMessageType); !ok {
+		t.Errorf("registered type not found")
+	}
+	for _, name := range []string{ TextMessageType, PictureMessageType, FileMessageType, NoticeMessageType } {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("built-in type %s not found", name)
+		}
+	}
+}
+
+func TestMessageRegistryDecode(t *testing.T) {
+	r := NewMessageRegistry()
+	r.Register(&MessageType{
+		Name		: pollMessageType,
+		Decode		: func(p *UploadPolicy, sender string, body []byte, params map[string]string) (Message, error) {
+			return newPollMessage(string(body)), nil
+		},
+		Validate	: func(m Message) error {
+			if m.Content().(string) == "" {
+				return errors.New("Question missed")
+			}
+			return nil
+		},
+		Parse		: (*Communication).parseJSON,
+	})
+	r.Register(&MessageType{
+		Name		: "Mismatched",
+		Decode		: func(p *UploadPolicy, sender string, body []byte, params map[string]string) (Message, error) {
+			return NewTextMessage(string(body)), nil
+		},
+		Parse		: (*Communication).parseJSON,
+	})
+
+	cases := []struct {
+		name string
+		messageType string
+		body string
+		code int
+	}{
+		{ "text", TextMessageType, "hi", 0 },
+		{ "custom", pollMessageType, "lunch?", 0 },
+		{ "custom not valid", pollMessageType, "", http.StatusBadRequest },
+		{ "unknown", "Unknown", "hi", http.StatusBadRequest },
+		{ "notice", NoticeMessageType, "hi", http.StatusBadRequest },
+		{ "type mismatched", "Mismatched", "hi", http.StatusInternalServerError },
+	}
+
+	for _, c := range cases {
+		m, err := r.Decode(NewUploadPolicy(), "sender", c.messageType, []byte(c.body), map[string]string{})
+		if code := sendErrorCode(err); code != c.code || err != nil && code == 0 {
+			t.Errorf("%s: got error %v, want code %d", c.name, err, c.code)
+			continue
+		}
+		if err == nil && m.Type() != c.messageType {
+			t.Errorf("%s: got message of %s", c.name, m.Type())
+		}
+	}
+}
+
+func TestMessageRegistryRecordRestore(t *testing.T) {
+	r := NewMessageRegistry()
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	cases := []struct {
+		name string
+		m Message
+		group string
+		content string
+	}{
+		{ "text", NewTextMessage("hi"), "", "hi" },
+		{ "file", NewFileMessage([]byte("data"), "a.txt"), "", "data" },
+		{ "sticker", NewStickerMessage(&Sticker{ Pack : "cats", Sticker : "cat_1" }), "g", `{"pack":"cats","sticker":"cat_1"}` },
+	}
+
+	for _, c := range cases {
+		c.m.SetId(7)
+		c.m.SetSenderId("a")
+		c.m.SetTargetId("b")
+		if c.group != "" {
+			c.m.SetGroup(c.group)
+		}
+		c.m.SetParentId(3)
+		c.m.SetExpiry(time.Minute, true)
+		c.m.SetExpireAt(expireAt)
+
+		rec, err := r.Record(c.m)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if string(rec.Content) != c.content {
+			t.Errorf("%s: got content %q, want %q", c.name, rec.Content, c.content)
+		}
+
+		m, err := r.Restore(rec)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		ttl, afterRead := m.Expiry()
+		if m.Type() != c.m.Type() || m.Id() != 7 || m.SenderId() != "a" || m.TargetId() != "b" || m.GroupName() != c.group ||
+			m.ParentId() != 3 || ttl != time.Minute || !afterRead || !m.ExpireAt().Equal(expireAt) {
+			t.Errorf("%s: got restored message %+v", c.name, m)
+		}
+		if bs, _ := m.OnBinary(); string(bs) != c.content {
+			t.Errorf("%s: got restored content %q", c.name, bs)
+		}
+	}
+
+	if _, err := r.Restore(&HistoryRecord{ Type : NoticeMessageType }); err == nil {
+		t.Errorf("restored a notice")
+	}
+}
@@ -0,0 +1,640 @@
+package IM
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxReports = 10000			//Reports kept, the oldest handled reports are dropped first
+	MaxReportReason = 500			//Max characters of the reason of a report
+	DefaultReportLimit = 100
+	DefaultReportFile = "reports.json"	//Reports are saved in this file next to the audit file
+
+	//Status of reports
+	ReportPending = "pending"
+	ReportResolved = "resolved"
+	ReportDismissed = "dismissed"
+
+	//Actions of moderators
+	ModerateRemove = "remove"
+	ModerateMute = "mute"
+	ModerateUnmute = "unmute"
+	ModerateBan = "ban"
+	ModerateUnban = "unban"
+	ModerateDismiss = "dismiss"
+
+	//Frame kinds of notices about moderation
+	MessageRemoved = "MessageRemoved"
+	UserMuted = "UserMuted"
+	UserBanned = "UserBanned"
+	UserRoomBanned = "UserRoomBanned"
+	RestrictionLifted = "RestrictionLifted"
+	ReportHandled = "ReportHandled"
+)
+
+/*
+* A message reported by a user, sender, group and snippet of the message are kept
+* so that moderators can review it even after the message is removed
+*/
+type Report struct {
+	Id uint64			`json:"id,string"`
+	MessageId uint64		`json:"messageId,string"`
+	Reporter string			`json:"reporter"`
+	Reason string			`json:"reason"`
+	Sender string			`json:"sender"`
+	Group string			`json:"group,omitempty"`
+	Snippet string			`json:"snippet"`
+	Created time.Time		`json:"created"`
+	Status string			`json:"status"`
+	Action string			`json:"action,omitempty"`		//Action taken when the report is handled
+	Handled time.Time		`json:"handled,omitempty"`
+}
+
+/*
+* Review queue of reports kept in memory, in order of id, and saved in a file if it's set
+*/
+type ReportQueue struct {
+	mutex sync.Mutex
+
+	next uint64
+	reports map[uint64]*Report
+	reported map[string]uint64			//Reporter and message -> id of the report, so a message is reported once by a user
+
+	path string
+}
+
+func NewReportQueue() *ReportQueue {
+	return &ReportQueue{
+		reports		: make(map[uint64]*Report),
+		reported	: make(map[string]uint64),
+	}
+}
+
+/*
+* Reports saved in the file of a report queue
+*/
+type reportFile struct {
+	Next uint64			`json:"next,string"`
+	Reports []*Report		`json:"reports"`
+}
+
+/*
+* Create a report queue saved in a file, reports in the file are loaded
+*/
+func NewFileReportQueue(path string) (*ReportQueue, error) {
+	q := NewReportQueue()
+	q.path = path
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rf := &reportFile{}
+	if err := json.Unmarshal(bs, rf); err != nil {
+		return nil, err
+	}
+	q.next = rf.Next
+	for _, r := range rf.Reports {
+		q.reports[r.Id] = r
+		q.reported[reportKey(r.Reporter, r.MessageId)] = r.Id
+	}
+	return q, nil
+}
+
+/*
+* Save all reports to the file
+* Note: caller must hold the mutex
+*/
+func (q *ReportQueue) save() {
+	if q.path == "" {
+		return
+	}
+
+	rf := &reportFile{ Next : q.next, Reports : make([]*Report, 0, len(q.reports)) }
+	for _, r := range q.reports {
+		rf.Reports = append(rf.Reports, r)
+	}
+	sort.Slice(rf.Reports, func(i, j int) bool { return rf.Reports[i].Id < rf.Reports[j].Id })
+
+	bs, err := json.Marshal(rf)
+	if err == nil {
+		err = writeFileAtomic(q.path, bs)
+	}
+	if err != nil {
+		log.Print("Fail to save reports:", err)
+	}
+}
+
+func reportKey(reporter string, messageId uint64) string {
+	return reporter + "\n" + strconv.FormatUint(messageId, 10)
+}
+
+/*
+* Add a report, return the report already added if the user reported the message before
+*/
+func (q *ReportQueue) Add(r *Report) *Report {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	key := reportKey(r.Reporter, r.MessageId)
+	if id, ok := q.reported[key]; ok {
+		c := *q.reports[id]
+		return &c
+	}
+
+	if len(q.reports) >= MaxReports {
+		q.drop()
+	}
+
+	q.next++
+	r.Id = q.next
+	r.Status = ReportPending
+	q.reports[r.Id] = r
+	q.reported[key] = r.Id
+	q.save()
+
+	c := *r
+	return &c
+}
+
+/*
+* Drop the oldest report, handled reports are dropped before pending ones
+*/
+func (q *ReportQueue) drop() {
+	var oldest, oldestPending uint64
+	for id, r := range q.reports {
+		if r.Status == ReportPending {
+			if oldestPending == 0 || id < oldestPending {
+				oldestPending = id
+			}
+		} else if oldest == 0 || id < oldest {
+			oldest = id
+		}
+	}
+	if oldest == 0 {
+		oldest = oldestPending
+	}
+
+	if r, ok := q.reports[oldest]; ok {
+		delete(q.reported, reportKey(r.Reporter, r.MessageId))
+		delete(q.reports, oldest)
+	}
+}
+
+func (q *ReportQueue) Get(id uint64) (*Report, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	r, ok := q.reports[id]
+	if !ok {
+		return nil, false
+	}
+	c := *r
+	return &c, true
+}
+
+/*
+* Reports in a status in order of id, all reports if status is empty
+*/
+func (q *ReportQueue) List(status string, limit int) []*Report {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	rs := make([]*Report, 0)
+	for _, r := range q.reports {
+		if status == "" || r.Status == status {
+			c := *r
+			rs = append(rs, &c)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Id < rs[j].Id })
+
+	if len(rs) > limit {
+		rs = rs[:limit]
+	}
+	return rs
+}
+
+/*
+* Close all pending reports of a message, return reports closed
+*/
+func (q *ReportQueue) Close(messageId uint64, status string, action string) []*Report {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	rs := make([]*Report, 0)
+	for _, r := range q.reports {
+		if r.MessageId != messageId || r.Status != ReportPending {
+			continue
+		}
+
+		r.Status = status
+		r.Action = action
+		r.Handled = now
+		c := *r
+		rs = append(rs, &c)
+	}
+	if len(rs) > 0 {
+		q.save()
+	}
+	return rs
+}
+
+/*
+* Ban a user from a group until a time, the user can't send to the group and doesn't
+* receive messages of it, zero time lifts the ban
+*/
+func (m *UserManager) BanFromRoom(id string, group string, until time.Time, reason string) {
+	u := m.managedUser(id)
+
+	u.mutex.Lock()
+	if until.IsZero() {
+		delete(u.roomBans, group)
+	} else {
+		u.roomBans[group] = until
+		u.restrictReason = reason
+	}
+	u.mutex.Unlock()
+
+	m.save(u)
+}
+
+/*
+* Report a message in history, only a participant of the message can report it
+*/
+func (im *IM) ReportMessage(id uint64, reporter string, reason string) (*Report, error) {
+	if im.history == nil {
+		return nil, NewSendError(http.StatusNotFound, "History is not enabled")
+	}
+
+	r, ok := im.history.Get(id)
+	if !ok || !r.IsParticipant(reporter) {
+		return nil, NewSendError(http.StatusNotFound, ErrRecordNotFound.Error())
+	}
+	if r.Sender == reporter {
+		return nil, NewSendError(http.StatusBadRequest, "Can't report a message sent by yourself")
+	}
+	if r.Removed {
+		return nil, NewSendError(http.StatusBadRequest, "Message is removed")
+	}
+	if rs := []rune(reason); len(rs) > MaxReportReason {
+		reason = string(rs[:MaxReportReason])
+	}
+
+	return im.reports.Add(&Report{
+		MessageId	: r.Id,
+		Reporter	: reporter,
+		Reason		: reason,
+		Sender		: r.Sender,
+		Group		: r.Group,
+		Snippet		: r.Snippet(DefaultQuoteLength),
+		Created		: time.Now(),
+	}), nil
+}
+
+/*
+* Remove a message from history for a moderator, the message is recalled and all
+* participants get a MessageRemoved frame with the id of the message and the reason
+*/
+func (im *IM) RemoveMessage(id uint64, reason string) error {
+	if im.history == nil {
+		return NewSendError(http.StatusNotFound, "History is not enabled")
+	}
+
+	r, ok := im.history.Get(id)
+	if !ok {
+		return NewSendError(http.StatusNotFound, ErrRecordNotFound.Error())
+	}
+	if r.Removed {
+		return nil
+	}
+
+	err := im.history.Update(id, func(r *HistoryRecord) {
+		r.Content = nil
+		r.Recalled = true
+		r.Removed = true
+		r.EditTime = time.Now()
+	})
+	if err != nil {
+		return NewSendError(http.StatusNotFound, err.Error())
+	}
+
+	if im.reactions != nil {
+		im.reactions.Delete(id)
+	}
+	if im.expirer != nil {
+		im.expirer.Remove(id)
+	}
+	if len(r.Content) > 0 {
+		im.purgeContent(ContentDigest(r.Content), r.Sender)
+	}
+
+	im.notifyParticipants(MessageRemoved, r, r.Sender, reason)
+	return nil
+}
+
+/*
+* Tell a user it's restricted or a restriction is lifted, the frame of a ban is sent
+* before live streams of the user are closed, so it may be missed by clients
+*/
+func (im *IM) notifyRestriction(kind string, id string, group string, until time.Time, reason string) {
+	n := NewNoticeMessage(kind, reason)
+	n.SetSenderId(id)
+	n.SetTargetId(id)
+	if group != "" {
+		n.AddMeta(Group, group)
+	}
+	if !until.IsZero() && !until.Equal(forever) {
+		n.AddMeta(Until, strconv.FormatInt(until.UnixNano() / int64(time.Millisecond), 10))
+	}
+	im.SendMessage(n)
+}
+
+/*
+* Tell reporters their reports are handled
+*/
+func (im *IM) notifyReporters(rs []*Report) {
+	for _, r := range rs {
+		n := NewNoticeMessage(ReportHandled, r.Status)
+		n.SetSenderId(r.Reporter)
+		n.SetTargetId(r.Reporter)
+		n.AddMeta(ReportId, strconv.FormatUint(r.Id, 10))
+		n.AddMeta(MessageId, strconv.FormatUint(r.MessageId, 10))
+		im.SendMessage(n)
+	}
+}
+
+/*
+* Request body of report api
+* eg: {"id":"123","reason":"spam"}
+*/
+type ReportRequest struct {
+	Id uint64			`json:"id,string"`
+	Reason string			`json:"reason"`
+}
+
+/*
+* Request body of moderation api, the message and the sender of a report are used
+* if the report is set, a ban for a report of a group message bans the sender from the group,
+* and all pending reports of the message are closed
+* eg: {"report":"7","action":"remove","reason":"spam"}
+* eg: {"report":"7","action":"dismiss"}
+* eg: {"message":"123","action":"remove"}
+* eg: {"user":"u1","action":"mute","duration":3600,"reason":"flood"}
+* eg: {"user":"u1","action":"ban","group":"g1","duration":86400}	//ban from a group
+* eg: {"user":"u1","action":"ban"}					//ban globally until it's lifted
+* eg: {"user":"u1","action":"unban","group":"g1"}
+*/
+type ModerationRequest struct {
+	Action string			`json:"action"`
+	Report uint64			`json:"report,string,omitempty"`
+	Message uint64			`json:"message,string,omitempty"`
+	User string			`json:"user,omitempty"`
+	Group string			`json:"group,omitempty"`
+	Duration int64			`json:"duration,omitempty"`			//Seconds of a mute or ban, 0 means until it's lifted
+	Reason string			`json:"reason,omitempty"`
+}
+
+/*
+* Do a moderation action, return reports closed by it
+*/
+func (im *IM) moderate(req *ModerationRequest) ([]*Report, error) {
+	if req.Report != 0 {
+		rep, ok := im.reports.Get(req.Report)
+		if !ok {
+			return nil, NewSendError(http.StatusNotFound, "No such report")
+		}
+		req.Message = rep.MessageId
+		if req.User == "" {
+			req.User = rep.Sender
+		}
+		if req.Group == "" && req.Action == ModerateBan {
+			req.Group = rep.Group
+		}
+	}
+
+	until := forever
+	if req.Duration < 0 {
+		return nil, NewSendError(http.StatusBadRequest, "Invalid duration")
+	} else if req.Duration > 0 {
+		until = time.Now().Add(time.Duration(req.Duration) * time.Second)
+	}
+
+	switch req.Action {
+	case ModerateRemove, ModerateDismiss:
+		if req.Message == 0 {
+			return nil, NewSendError(http.StatusBadRequest, "Message missed")
+		}
+	case ModerateMute, ModerateUnmute, ModerateBan, ModerateUnban:
+		if req.User == "" {
+			return nil, NewSendError(http.StatusBadRequest, "User missed")
+		}
+	default:
+		return nil, NewSendError(http.StatusBadRequest, "Invalid action")
+	}
+
+	switch req.Action {
+	case ModerateRemove:
+		if err := im.RemoveMessage(req.Message, req.Reason); err != nil {
+			return nil, err
+		}
+	case ModerateMute:
+		im.UserManager.Mute(req.User, until, req.Reason)
+		im.notifyRestriction(UserMuted, req.User, "", until, req.Reason)
+	case ModerateUnmute:
+		im.UserManager.Mute(req.User, time.Time{}, "")
+		im.notifyRestriction(RestrictionLifted, req.User, "", time.Time{}, "")
+	case ModerateBan:
+		if req.Group != "" {
+			im.UserManager.BanFromRoom(req.User, req.Group, until, req.Reason)
+			im.notifyRestriction(UserRoomBanned, req.User, req.Group, until, req.Reason)
+		} else {
+			im.notifyRestriction(UserBanned, req.User, "", until, req.Reason)
+			im.UserManager.Ban(req.User, until, req.Reason)
+		}
+	case ModerateUnban:
+		if req.Group != "" {
+			im.UserManager.BanFromRoom(req.User, req.Group, time.Time{}, "")
+		} else {
+			im.UserManager.Ban(req.User, time.Time{}, "")
+		}
+		im.notifyRestriction(RestrictionLifted, req.User, req.Group, time.Time{}, "")
+	}
+
+	if req.Message == 0 {
+		return nil, nil
+	}
+	status := ReportResolved
+	if req.Action == ModerateDismiss {
+		status = ReportDismissed
+	}
+	rs := im.reports.Close(req.Message, status, req.Action)
+	im.notifyReporters(rs)
+	return rs, nil
+}
+
+/*
+* Serve report api for users
+* Post request reports a message, return {"report":"xxx","status":"pending"} in json,
+* the reporter gets a ReportHandled frame when the report is handled
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body-------------------
+* ReportRequest in json
+*/
+func (im *IM) ServeReport(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only post is allowed"))
+		return
+	}
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	body, err := readLimitedBody(r, 16 * 1024)
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+	req := &ReportRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+		return
+	}
+
+	rep, err := im.ReportMessage(req.Id, u.id, req.Reason)
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{ "report" : strconv.FormatUint(rep.Id, 10), "status" : rep.Status })
+}
+
+/*
+* Serve moderation api for moderators, every request is audited, including views of the
+* review queue and requests with a wrong secret key
+* Get request returns {"reports":[...]} in order of id, filtered by query param "status",
+* pending by default, "all" for all reports, and limited by "limit"
+* Post request does an action with ModerationRequest in json, return {"reports":[...]}
+* with reports closed by the action
+* Affected users get MessageRemoved, UserMuted, UserBanned, UserRoomBanned or
+* RestrictionLifted frames, and reporters get ReportHandled frames
+* --------------headers:---------------
+* "Secret-Key":"xxxxx"
+* --------------body(post only)--------
+* ModerationRequest in json
+*/
+func (im *IM) ServeModeration(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	entry := AuditEntry{ Actor : r.RemoteAddr }
+	fail := func(err error) {
+		entry.Result = err.Error()
+		im.audit.Record(entry)
+		writeAPIError(w, "", err)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry.Action = "moderate.list"
+		entry.Detail = r.URL.RawQuery
+	case http.MethodPost:
+		entry.Action = "moderate.unknown"
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+		return
+	}
+
+	if !im.UserManager.CheckSecretKey(r.Header.Get("Secret-Key")) {
+		fail(NewSendError(http.StatusUnauthorized, "Invalid secret key"))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		status := q.Get("status")
+		if status == "" {
+			status = ReportPending
+		} else if status == "all" {
+			status = ""
+		}
+		limit, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = DefaultReportLimit
+		}
+		rs := im.reports.List(status, limit)
+		im.audit.Record(entry)
+		writeJSON(w, http.StatusOK, map[string][]*Report{ "reports" : rs })
+		return
+	}
+
+	body, err := readLimitedBody(r, 64 * 1024)
+	if err != nil {
+		fail(err)
+		return
+	}
+	req := &ModerationRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		fail(NewSendError(http.StatusBadRequest, "Invalid request json"))
+		return
+	}
+
+	entry.Action = "moderate." + req.Action
+	entry.Target = req.User
+	entry.Detail = moderationDetail(req)
+	rs, err := im.moderate(req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	im.audit.Record(entry)
+
+	if rs == nil {
+		rs = make([]*Report, 0)
+	}
+	writeJSON(w, http.StatusOK, map[string][]*Report{ "reports" : rs })
+}
+
+/*
+* Params of a moderation request kept in audit log
+*/
+func moderationDetail(req *ModerationRequest) string {
+	ps := make([]string, 0)
+	if req.Report != 0 {
+		ps = append(ps, fmt.Sprintf("report=%d", req.Report))
+	}
+	if req.Message != 0 {
+		ps = append(ps, fmt.Sprintf("message=%d", req.Message))
+	}
+	if req.Group != "" {
+		ps = append(ps, "group=" + req.Group)
+	}
+	if req.Duration > 0 {
+		ps = append(ps, fmt.Sprintf("duration=%ds", req.Duration))
+	}
+	if req.Reason != "" {
+		ps = append(ps, "reason=" + req.Reason)
+	}
+	return strings.Join(ps, " ")
+}
@@ -0,0 +1,148 @@
+package IM
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReportQueue(t *testing.T) {
+	q := NewReportQueue()
+
+	adds := []struct {
+		reporter string
+		messageId uint64
+		id uint64
+	}{
+		{ "a", 1, 1 },
+		{ "b", 1, 2 },
+		{ "a", 1, 1 },
+		{ "a", 2, 3 },
+	}
+	for _, c := range adds {
+		r := q.Add(&Report{ Reporter : c.reporter, MessageId : c.messageId, Reason : "spam" })
+		if r.Id != c.id || r.Status != ReportPending {
+			t.Errorf("%s reporting %d: got report %d in %s, want %d", c.reporter, c.messageId, r.Id, r.Status, c.id)
+		}
+	}
+
+	if closed := q.Close(1, ReportResolved, ModerateRemove); len(closed) != 2 {
+		t.Errorf("closed %d reports of message 1, want 2", len(closed))
+	}
+	if closed := q.Close(1, ReportDismissed, ModerateDismiss); len(closed) != 0 {
+		t.Errorf("closed %d reports closed before", len(closed))
+	}
+
+	lists := []struct {
+		status string
+		limit int
+		ids []uint64
+	}{
+		{ "", 10, []uint64{ 1, 2, 3 } },
+		{ "", 2, []uint64{ 1, 2 } },
+		{ ReportPending, 10, []uint64{ 3 } },
+		{ ReportResolved, 10, []uint64{ 1, 2 } },
+		{ ReportDismissed, 10, []uint64{} },
+	}
+	for _, c := range lists {
+		ids := make([]uint64, 0)
+		for _, r := range q.List(c.status, c.limit) {
+			ids = append(ids, r.Id)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%q: got reports %v, want %v", c.status, ids, c.ids)
+		}
+	}
+
+	r, ok := q.Get(2)
+	if !ok || r.Status != ReportResolved || r.Action != ModerateRemove || r.Handled.IsZero() {
+		t.Errorf("got report %+v", r)
+	}
+	if _, ok := q.Get(4); ok {
+		t.Errorf("got a report never added")
+	}
+}
+
+func TestFileReportQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DefaultReportFile)
+
+	q, err := NewFileReportQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Add(&Report{ Reporter : "a", MessageId : 1 })
+	q.Add(&Report{ Reporter : "b", MessageId : 2 })
+	q.Close(2, ReportDismissed, ModerateDismiss)
+
+	loaded, err := NewFileReportQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		id uint64
+		status string
+	}{
+		{ 1, ReportPending },
+		{ 2, ReportDismissed },
+	}
+	for _, c := range cases {
+		r, ok := loaded.Get(c.id)
+		if !ok || r.Status != c.status {
+			t.Errorf("report %d: got %+v, want status %s", c.id, r, c.status)
+		}
+	}
+
+	//ids go on from the saved queue and reports saved are still deduplicated
+	if r := loaded.Add(&Report{ Reporter : "a", MessageId : 1 }); r.Id != 1 {
+		t.Errorf("got report %d for a message reported before", r.Id)
+	}
+	if r := loaded.Add(&Report{ Reporter : "c", MessageId : 1 }); r.Id != 3 {
+		t.Errorf("got report %d, want 3", r.Id)
+	}
+}
+
+func TestServeModerationAudit(t *testing.T) {
+	im := NewIM("localhost")
+	im.UserManager = NewUserManager("secret")
+	im.reports = NewReportQueue()
+	audit, err := NewAuditLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.audit = audit
+
+	cases := []struct {
+		name string
+		method string
+		key string
+		body string
+		code int
+		action string
+		ok bool
+	}{
+		{ "queue view", http.MethodGet, "secret", "", http.StatusOK, "moderate.list", true },
+		{ "queue view with wrong key", http.MethodGet, "wrong", "", http.StatusUnauthorized, "moderate.list", false },
+		{ "action with wrong key", http.MethodPost, "wrong", `{"action":"mute","user":"u1"}`, http.StatusUnauthorized, "moderate.unknown", false },
+		{ "invalid json", http.MethodPost, "secret", "{", http.StatusBadRequest, "moderate.unknown", false },
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/moderation?status=all", strings.NewReader(c.body))
+		r.Header.Set("Secret-Key", c.key)
+		w := httptest.NewRecorder()
+		im.ServeModeration(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, w.Code, c.code)
+		}
+		es := im.audit.Entries("", 1)
+		if len(es) != 1 || es[0].Action != c.action || (es[0].Result == "ok") != c.ok {
+			t.Errorf("%s: got audit entries %+v", c.name, es)
+		}
+		im.audit.Record(AuditEntry{ Action : "separator" })
+	}
+}
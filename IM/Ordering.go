@@ -0,0 +1,151 @@
+package IM
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOrderingShards = 64
+	DefaultSequenceIdle = time.Hour			//Sequence spaces not used in this period are dropped
+)
+
+/*
+* Key of the conversation a message belongs to
+* A group message belongs to its group, and a message between two users belongs
+* to the pair of them no matter who is the sender
+*/
+func ConversationKey(m Message) string {
+	return conversationKey(m.SenderId(), m.TargetId(), m.GroupName())
+}
+func conversationKey(sender string, target string, group string) string {
+	if group != "" {
+		return "group:" + group
+	}
+
+	ids := []string{ sender, target }
+	sort.Strings(ids)
+	return "user:" + ids[0] + ";" + ids[1]
+}
+
+/*
+* Index of the partition a key belongs to
+*/
+func partitionIndex(key string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+/*
+* Sequencer assigns sequence numbers to messages of each conversation
+* In ordering mode, messages of a conversation are always classified by the same classifier,
+* handled by the same channel and dispatched by the same consumer, so they arrive in
+* the order of their sequence numbers. Sequence is counted per conversation and message type,
+* because different types of messages are handled by different channel groups
+*
+* The lock of the shard a conversation belongs to is held until the message is classified,
+* so sequence numbers are in the same order as messages entering channels
+*
+* Sequence numbers of a conversation and message type are counted in a sequence space,
+* a space not used for idle is dropped, and the next message starts a new space whose
+* scope is the id of the message, so clients know sequence numbers restart
+*/
+type Sequencer struct {
+	shards []*sequenceShard
+	idle time.Duration
+}
+
+type sequenceShard struct {
+	mutex sync.Mutex
+	sequences map[string]*sequenceSpace
+	lastSweep time.Time
+}
+
+type sequenceSpace struct {
+	scope uint64
+	sequence uint64
+	used time.Time
+}
+
+func NewSequencer(shardNum int) *Sequencer {
+	if shardNum < 1 {
+		shardNum = 1
+	}
+
+	s := &Sequencer{
+		shards		: make([]*sequenceShard, shardNum),
+		idle		: DefaultSequenceIdle,
+	}
+	for i := range s.shards {
+		s.shards[i] = &sequenceShard{
+			sequences	: make(map[string]*sequenceSpace),
+			lastSweep	: time.Now(),
+		}
+	}
+
+	return s
+}
+
+/*
+* Assign next sequence number to the message and call f with it while holding the shard lock
+*/
+func (s *Sequencer) Sequence(m Message, key string, f func(Message)) {
+	shard := s.shards[partitionIndex(key, len(s.shards))]
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(shard.lastSweep) > s.idle {
+		shard.sweep(now, s.idle)
+	}
+
+	seqKey := key + "\n" + m.Type()
+	space, ok := shard.sequences[seqKey]
+	if !ok || now.Sub(space.used) > s.idle {
+		space = &sequenceSpace{ scope : m.Id() }
+		shard.sequences[seqKey] = space
+	}
+	space.sequence++
+	space.used = now
+	m.SetSequence(space.sequence)
+	m.SetSequenceScope(space.scope)
+
+	f(m)
+}
+
+/*
+* Drop sequence spaces not used for idle
+* Note: caller must hold the mutex
+*/
+func (shard *sequenceShard) sweep(now time.Time, idle time.Duration) {
+	for k, space := range shard.sequences {
+		if now.Sub(space.used) > idle {
+			delete(shard.sequences, k)
+		}
+	}
+	shard.lastSweep = now
+}
+
+/*
+* Classify a message in ordering mode
+* Notices are not sequenced, they are dispatched as soon as possible
+*/
+func (im *IM) classifyOrdered(m Message) {
+	key := ConversationKey(m)
+	index := partitionIndex(key, len(im.classifiers))
+
+	if m.Type() == NoticeMessageType {
+		im.classifiers[index].Classify(m)
+		return
+	}
+
+	im.sequencer.Sequence(m, key, im.classifiers[index].Classify)
+}
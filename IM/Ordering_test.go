@@ -0,0 +1,81 @@
+package IM
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConversationKey(t *testing.T) {
+	cases := []struct {
+		sender string
+		target string
+		group string
+		key string
+	}{
+		{ "a", "b", "", "user:a;b" },
+		{ "b", "a", "", "user:a;b" },
+		{ "a", "a", "", "user:a;a" },
+		{ "a", "b;c", "g", "group:g" },
+	}
+
+	for _, c := range cases {
+		if key := conversationKey(c.sender, c.target, c.group); key != c.key {
+			t.Errorf("%s to %s in %q: got key %q, want %q", c.sender, c.target, c.group, key, c.key)
+		}
+	}
+}
+
+func TestPartitionIndex(t *testing.T) {
+	for _, key := range []string{ "user:a;b", "group:g", "" } {
+		if i := partitionIndex(key, 1); i != 0 {
+			t.Errorf("%q: got partition %d of 1", key, i)
+		}
+		i := partitionIndex(key, 8)
+		if i < 0 || i >= 8 || partitionIndex(key, 8) != i {
+			t.Errorf("%q: got partition %d of 8", key, i)
+		}
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	s := NewSequencer(4)
+
+	cases := []struct {
+		name string
+		id uint64
+		key string
+		picture bool
+		idle bool
+		sequence uint64
+		scope uint64
+	}{
+		{ "first", 1, "user:a;b", false, false, 1, 1 },
+		{ "second", 2, "user:a;b", false, false, 2, 1 },
+		{ "another conversation", 3, "group:g", false, false, 1, 3 },
+		{ "another type", 4, "user:a;b", true, false, 1, 4 },
+		{ "third", 5, "user:a;b", false, false, 3, 1 },
+		{ "after idle", 6, "user:a;b", false, true, 1, 6 },
+		{ "after new space", 7, "user:a;b", false, false, 2, 6 },
+	}
+
+	for _, c := range cases {
+		var m Message = NewTextMessage("hi")
+		if c.picture {
+			m = NewPictureMessage([]byte("png"), "png")
+		}
+		m.SetId(c.id)
+		if c.idle {
+			for _, shard := range s.shards {
+				for _, space := range shard.sequences {
+					space.used = time.Now().Add(-2 * DefaultSequenceIdle)
+				}
+			}
+		}
+
+		called := false
+		s.Sequence(m, c.key, func(Message) { called = true })
+		if !called || m.Sequence() != c.sequence || m.SequenceScope() != c.scope {
+			t.Errorf("%s: got sequence %d in %d, want %d in %d", c.name, m.Sequence(), m.SequenceScope(), c.sequence, c.scope)
+		}
+	}
+}
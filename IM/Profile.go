@@ -0,0 +1,579 @@
+package IM
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultProfileRootPath = "IM_PROFILE"
+
+	MaxDisplayNameLength = 64
+	MaxStatusLength = 140
+	MaxProfileFields = 20
+	MaxProfileFieldLength = 256
+	MaxAvatarSize = 512 * 1024
+
+	//Frame kind of the notice telling contacts that a profile changed, content is the profile in json
+	ProfileChanged = "ProfileChanged"
+)
+
+//Mime types of avatars and their suffixes
+var avatarTypes = map[string]string{
+	"image/png"	: "png",
+	"image/jpeg"	: "jpg",
+	"image/gif"	: "gif",
+	"image/webp"	: "webp",
+}
+
+/*
+* Profile of a user
+*/
+type Profile struct {
+	Id string				`json:"id"`
+	DisplayName string			`json:"displayName,omitempty"`
+	Avatar string				`json:"avatar,omitempty"`		//Durable url of the avatar in file proxy
+	Status string				`json:"status,omitempty"`
+	Fields map[string]string		`json:"fields,omitempty"`		//Custom fields
+	Updated time.Time			`json:"updated"`
+}
+
+/*
+* A profile kept in profile store, with the digest of the avatar so that it's added to
+* file proxy again after restart, the avatar itself is kept by the store apart from profiles
+*/
+type ProfileRecord struct {
+	Profile
+	AvatarDigest string			`json:"avatarDigest,omitempty"`
+	AvatarSuffix string			`json:"avatarSuffix,omitempty"`
+}
+
+/*
+* ProfileStore keeps profiles and avatars of users, an avatar is keyed by the user id
+* and the digest of its content
+*/
+type ProfileStore interface {
+	Save(*ProfileRecord) error				//Save a profile
+	Delete(string) error					//Delete a profile by user id
+	Load() ([]*ProfileRecord, error)			//Load all profiles
+
+	SaveAvatar(string, string, []byte) error		//Save an avatar by user id and digest
+	Avatar(string, string) ([]byte, error)			//Get an avatar by user id and digest
+	DeleteAvatar(string, string) error			//Delete an avatar by user id and digest
+}
+
+/*
+* Profile store kept in memory, which doesn't survive restart
+*/
+type MemoryProfileStore struct {
+	mutex sync.Mutex
+	profiles map[string]*ProfileRecord
+	avatars map[string][]byte
+}
+
+func NewMemoryProfileStore() *MemoryProfileStore {
+	return &MemoryProfileStore{
+		profiles	: make(map[string]*ProfileRecord),
+		avatars		: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryProfileStore) Save(r *ProfileRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := *r
+	s.profiles[r.Id] = &c
+	return nil
+}
+
+func (s *MemoryProfileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.profiles, id)
+	return nil
+}
+
+func (s *MemoryProfileStore) Load() ([]*ProfileRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rs := make([]*ProfileRecord, 0, len(s.profiles))
+	for _, r := range s.profiles {
+		c := *r
+		rs = append(rs, &c)
+	}
+	return rs, nil
+}
+
+func (s *MemoryProfileStore) SaveAvatar(id string, digest string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.avatars[id + "\n" + digest] = data
+	return nil
+}
+
+func (s *MemoryProfileStore) Avatar(id string, digest string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if data, ok := s.avatars[id + "\n" + digest]; ok {
+		return data, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s *MemoryProfileStore) DeleteAvatar(id string, digest string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.avatars, id + "\n" + digest)
+	return nil
+}
+
+/*
+* Profile store which saves each profile in a json file under the root, named by hex of the user id,
+* and each avatar in a file named by hex of the user id and the digest of the avatar
+*/
+type FileProfileStore struct {
+	root string
+}
+
+func NewFileProfileStore(root string) (*FileProfileStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileProfileStore{ root : root }, nil
+}
+
+func (s *FileProfileStore) path(id string) string {
+	return filepath.Join(s.root, hex.EncodeToString([]byte(id)) + ".json")
+}
+func (s *FileProfileStore) avatarPath(id string, digest string) string {
+	return filepath.Join(s.root, hex.EncodeToString([]byte(id)) + "." + digest + ".avatar")
+}
+
+func (s *FileProfileStore) Save(r *ProfileRecord) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path(r.Id), bs)
+}
+
+func (s *FileProfileStore) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileProfileStore) SaveAvatar(id string, digest string, data []byte) error {
+	return writeFileAtomic(s.avatarPath(id, digest), data)
+}
+
+func (s *FileProfileStore) Avatar(id string, digest string) ([]byte, error) {
+	return ioutil.ReadFile(s.avatarPath(id, digest))
+}
+
+func (s *FileProfileStore) DeleteAvatar(id string, digest string) error {
+	if err := os.Remove(s.avatarPath(id, digest)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileProfileStore) Load() ([]*ProfileRecord, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := make([]*ProfileRecord, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(s.root, f.Name()))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		r := &ProfileRecord{}
+		if err := json.Unmarshal(bs, r); err != nil || r.Id == "" {
+			log.Printf("Broken profile: %s\n", f.Name())
+			continue
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
+/*
+* Changes of a profile, fields not set are not changed, and a custom field set to
+* empty string is deleted
+* eg: {"displayName":"Alice","status":"At work","fields":{"city":"Paris","title":""}}
+*/
+type ProfileUpdate struct {
+	DisplayName *string			`json:"displayName,omitempty"`
+	Status *string				`json:"status,omitempty"`
+	Fields map[string]string		`json:"fields,omitempty"`
+}
+
+/*
+* Text of a profile is carried in frame meta, so it can't contain control characters
+*/
+func checkProfileText(s string, max int, name string) error {
+	if len(s) > max {
+		return NewSendError(http.StatusBadRequest, name + " too long")
+	}
+	for _, c := range s {
+		if c < 0x20 || c == 0x7f {
+			return NewSendError(http.StatusBadRequest, "Invalid " + strings.ToLower(name))
+		}
+	}
+	return nil
+}
+
+func (u *ProfileUpdate) Validate() error {
+	if u.DisplayName != nil {
+		if err := checkProfileText(*u.DisplayName, MaxDisplayNameLength, "Display name"); err != nil {
+			return err
+		}
+	}
+	if u.Status != nil {
+		if err := checkProfileText(*u.Status, MaxStatusLength, "Status"); err != nil {
+			return err
+		}
+	}
+	for k, v := range u.Fields {
+		if k == "" {
+			return NewSendError(http.StatusBadRequest, "Invalid field")
+		}
+		if err := checkProfileText(k, MaxProfileFieldLength, "Field"); err != nil {
+			return err
+		}
+		if err := checkProfileText(v, MaxProfileFieldLength, "Field"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Profiles keeps profiles of users in memory and saves them in a store,
+* avatars are kept only by the store, and served by file proxy as stored files
+*/
+type Profiles struct {
+	mutex sync.RWMutex
+
+	store ProfileStore
+	proxy *FileProxy
+	profiles map[string]*ProfileRecord
+}
+
+func NewProfiles(store ProfileStore) *Profiles {
+	return &Profiles{
+		store		: store,
+		profiles	: make(map[string]*ProfileRecord),
+	}
+}
+
+/*
+* Load profiles from store, and add avatars to the file proxy
+* The proxy is kept even if the store fails, so that avatars can still be set
+*/
+func (p *Profiles) Load(proxy *FileProxy) error {
+	p.mutex.Lock()
+	p.proxy = proxy
+	p.mutex.Unlock()
+
+	rs, err := p.store.Load()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, r := range rs {
+		if r.AvatarDigest != "" {
+			r.Avatar = p.addAvatar(r.Id, r.AvatarDigest, r.AvatarSuffix)
+		}
+		p.profiles[r.Id] = r
+	}
+	return nil
+}
+
+/*
+* Add an avatar to file proxy, return its url
+*/
+func (p *Profiles) addAvatar(id string, digest string, suffix string) string {
+	return p.proxy.AddStoredFileWithRestfulAPI(digest, suffix, id, func() []byte {
+		data, err := p.store.Avatar(id, digest)
+		if err != nil {
+			log.Print("Fail to load avatar:", err)
+			return nil
+		}
+		return data
+	})
+}
+
+/*
+* Get the profile of a user, a user without profile gets an empty one
+*/
+func (p *Profiles) Get(id string) (Profile, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	r, ok := p.profiles[id]
+	if !ok {
+		return Profile{ Id : id }, false
+	}
+
+	pf := r.Profile
+	pf.Fields = make(map[string]string, len(r.Fields))
+	for k, v := range r.Fields {
+		pf.Fields[k] = v
+	}
+	return pf, true
+}
+
+/*
+* Change a profile and save it
+*/
+func (p *Profiles) change(id string, f func(*ProfileRecord) error) (Profile, error) {
+	p.mutex.Lock()
+	r, ok := p.profiles[id]
+	if !ok {
+		r = &ProfileRecord{ Profile : Profile{ Id : id } }
+	}
+
+	c := *r
+	c.Fields = make(map[string]string, len(r.Fields))
+	for k, v := range r.Fields {
+		c.Fields[k] = v
+	}
+	if err := f(&c); err != nil {
+		p.mutex.Unlock()
+		return Profile{}, err
+	}
+	c.Updated = time.Now()
+
+	if err := p.store.Save(&c); err != nil {
+		p.mutex.Unlock()
+		log.Print("Fail to save profile:", err)
+		return Profile{}, NewSendError(http.StatusInternalServerError, "Fail to save profile")
+	}
+	p.profiles[id] = &c
+	p.mutex.Unlock()
+
+	pf, _ := p.Get(id)
+	return pf, nil
+}
+
+func (p *Profiles) Update(id string, u *ProfileUpdate) (Profile, error) {
+	if err := u.Validate(); err != nil {
+		return Profile{}, err
+	}
+
+	return p.change(id, func(r *ProfileRecord) error {
+		if u.DisplayName != nil {
+			r.DisplayName = *u.DisplayName
+		}
+		if u.Status != nil {
+			r.Status = *u.Status
+		}
+		for k, v := range u.Fields {
+			if v == "" {
+				delete(r.Fields, k)
+			} else {
+				r.Fields[k] = v
+			}
+		}
+		if len(r.Fields) > MaxProfileFields {
+			return NewSendError(http.StatusBadRequest, "Too many fields")
+		}
+		return nil
+	})
+}
+
+/*
+* Set the avatar of a user, the old one is deleted from the store and file proxy
+* once the profile is saved
+* Set nil data to remove the avatar
+*/
+func (p *Profiles) SetAvatar(id string, data []byte) (Profile, error) {
+	suffix := ""
+	digest := ""
+	if data != nil {
+		if len(data) > MaxAvatarSize {
+			return Profile{}, NewSendError(http.StatusRequestEntityTooLarge, "Avatar too large")
+		}
+		t, ok := avatarTypes[SniffMimeType(data)]
+		if !ok {
+			return Profile{}, NewSendError(http.StatusUnsupportedMediaType, "Avatar must be png, jpeg, gif or webp")
+		}
+		suffix = t
+		digest = ContentDigest(data)
+	}
+
+	p.mutex.RLock()
+	proxy := p.proxy
+	p.mutex.RUnlock()
+	if proxy == nil {
+		return Profile{}, NewSendError(http.StatusServiceUnavailable, "Profiles are not loaded")
+	}
+
+	if data != nil {
+		if err := p.store.SaveAvatar(id, digest, data); err != nil {
+			log.Print("Fail to save avatar:", err)
+			return Profile{}, NewSendError(http.StatusInternalServerError, "Fail to save avatar")
+		}
+	}
+
+	old := ""
+	pf, err := p.change(id, func(r *ProfileRecord) error {
+		old = r.AvatarDigest
+
+		r.AvatarDigest = digest
+		r.AvatarSuffix = suffix
+		r.Avatar = ""
+		if digest != "" {
+			r.Avatar = p.addAvatar(id, digest, suffix)
+		}
+		return nil
+	})
+
+	//the one not in use is deleted, either the old one or the new one
+	unused := old
+	if err != nil {
+		unused = digest
+	}
+	if unused != "" && old != digest {
+		proxy.DeleteDurableFile(unused, id)
+		if derr := p.store.DeleteAvatar(id, unused); derr != nil {
+			log.Print("Fail to delete avatar:", derr)
+		}
+	}
+
+	return pf, err
+}
+
+/*
+* Tell contacts and other devices of a user that the profile changed
+*/
+func (im *IM) notifyProfile(pf Profile) {
+	bs, err := json.Marshal(&pf)
+	if err != nil {
+		return
+	}
+
+	targets := []string{ pf.Id }
+	if u, ok := im.UserManager.UserById(pf.Id); ok {
+		targets = append(targets, u.Contacts()...)
+	}
+	for _, t := range targets {
+		n := NewNoticeMessage(ProfileChanged, string(bs))
+		n.SetSenderId(pf.Id)
+		n.SetTargetId(t)
+		im.SendMessage(n)
+	}
+}
+
+/*
+* Add display name and avatar of the sender to a frame if it's enabled
+*/
+func (im *IM) addProfileMeta(f *Frame, m Message) {
+	if im.profiles == nil || !im.embedProfile {
+		return
+	}
+
+	if pf, ok := im.profiles.Get(m.SenderId()); ok {
+		if pf.DisplayName != "" {
+			f.AddMeta(SenderName, pf.DisplayName)
+		}
+		if pf.Avatar != "" {
+			f.AddMeta(SenderAvatar, pf.Avatar)
+		}
+	}
+}
+
+/*
+* Serve profile api
+* Get request returns the profile of the user set by query param "id", or the profile
+* of the caller if it's not set
+* Post request updates the profile of the caller with ProfileUpdate in json
+* Put request sets the avatar of the caller, the body is the image
+* Delete request removes the avatar of the caller
+* Profile is returned in json, and contacts get a ProfileChanged frame when it changes
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+*/
+func (im *IM) ServeProfile(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	var pf Profile
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			id = u.id
+		}
+		pf, _ = im.profiles.Get(id)
+		writeJSON(w, http.StatusOK, &pf)
+		return
+	case http.MethodPost:
+		body, err := readLimitedBody(r, 16 * 1024)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		req := &ProfileUpdate{}
+		if err := json.Unmarshal(body, req); err != nil {
+			writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+			return
+		}
+		pf, err = im.profiles.Update(u.id, req)
+	case http.MethodPut:
+		body, rerr := readLimitedBody(r, MaxAvatarSize)
+		if rerr != nil {
+			writeAPIError(w, "", rerr)
+			return
+		}
+		pf, err = im.profiles.SetAvatar(u.id, body)
+	case http.MethodDelete:
+		pf, err = im.profiles.SetAvatar(u.id, nil)
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get, post, put and delete are allowed"))
+		return
+	}
+
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	im.notifyProfile(pf)
+	writeJSON(w, http.StatusOK, &pf)
+}
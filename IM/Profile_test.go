@@ -0,0 +1,91 @@
+package IM
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func stringPtr(s string) *string { return &s }
+
+func TestProfilesUpdate(t *testing.T) {
+	p := NewProfiles(NewMemoryProfileStore())
+
+	cases := []struct {
+		name string
+		update *ProfileUpdate
+		code int
+		displayName string
+		fields map[string]string
+	}{
+		{ "display name", &ProfileUpdate{ DisplayName : stringPtr("Alice") }, 0, "Alice", map[string]string{} },
+		{ "fields", &ProfileUpdate{ Fields : map[string]string{ "city" : "Paris", "title" : "CTO" } }, 0, "Alice", map[string]string{ "city" : "Paris", "title" : "CTO" } },
+		{ "field deleted", &ProfileUpdate{ Fields : map[string]string{ "title" : "" } }, 0, "Alice", map[string]string{ "city" : "Paris" } },
+		{ "display name too long", &ProfileUpdate{ DisplayName : stringPtr(strings.Repeat("a", MaxDisplayNameLength + 1)) }, http.StatusBadRequest, "Alice", map[string]string{ "city" : "Paris" } },
+		{ "control character", &ProfileUpdate{ Status : stringPtr("a\nb") }, http.StatusBadRequest, "Alice", map[string]string{ "city" : "Paris" } },
+		{ "empty field name", &ProfileUpdate{ Fields : map[string]string{ "" : "a" } }, http.StatusBadRequest, "Alice", map[string]string{ "city" : "Paris" } },
+	}
+
+	for _, c := range cases {
+		_, err := p.Update("a", c.update)
+		if code := sendErrorCode(err); code != c.code || err != nil && code == 0 {
+			t.Errorf("%s: got error %v, want code %d", c.name, err, c.code)
+		}
+		pf, _ := p.Get("a")
+		if pf.DisplayName != c.displayName || !reflect.DeepEqual(pf.Fields, c.fields) {
+			t.Errorf("%s: got profile %+v", c.name, pf)
+		}
+	}
+
+	if pf, ok := p.Get("b"); ok || pf.Id != "b" {
+		t.Errorf("got profile %+v of a user without one", pf)
+	}
+}
+
+func TestFileProfileStoreRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewFileProfileStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png := []byte("\x89PNG\r\n\x1a\nfirst")
+	second := []byte("\x89PNG\r\n\x1a\nsecond")
+
+	p := NewProfiles(store)
+	proxy := NewFileProxy("files", "localhost")
+	if err := p.Load(proxy); err != nil {
+		t.Fatal(err)
+	}
+	p.Update("a", &ProfileUpdate{ DisplayName : stringPtr("Alice"), Fields : map[string]string{ "city" : "Paris" } })
+	if _, err := p.SetAvatar("a", png); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SetAvatar("a", second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SetAvatar("a", []byte("text")); sendErrorCode(err) != http.StatusUnsupportedMediaType {
+		t.Errorf("got error %v setting a text avatar", err)
+	}
+
+	if _, err := store.Avatar("a", ContentDigest(png)); err == nil {
+		t.Errorf("replaced avatar is kept by the store")
+	}
+
+	loaded := NewProfiles(store)
+	loadedProxy := NewFileProxy("files", "localhost")
+	if err := loaded.Load(loadedProxy); err != nil {
+		t.Fatal(err)
+	}
+	pf, ok := loaded.Get("a")
+	if !ok || pf.DisplayName != "Alice" || pf.Fields["city"] != "Paris" || !strings.HasSuffix(pf.Avatar, ".png") {
+		t.Fatalf("got loaded profile %+v", pf)
+	}
+
+	hash := strings.Split(strings.TrimPrefix(pf.Avatar, "localhost/files/"), "/")[0]
+	for i := 0; i < 2; i++ {
+		if data, err := loadedProxy.FetchFile(hash); err != nil || string(data) != string(second) {
+			t.Errorf("fetch %d: got avatar %q, %v", i, data, err)
+		}
+	}
+}
@@ -8,6 +8,22 @@ const (
 
 	Sender = "Sender"
 	Group = "Group"
+	MessageId = "Id"
+	Sequence = "Seq"
+	SequenceScope = "SeqScope"
+	Parent = "Parent"
+	Quote = "Quote"
+	Mentions = "Mentions"
+	Duration = "Duration"
+	Waveform = "Waveform"
+	Expire = "Expire"
+	TTL = "TTL"
+	Contact = "Contact"
+	SenderName = "SenderName"
+	SenderAvatar = "SenderAvatar"
+	Until = "Until"
+	ReportId = "Report"
+	ScheduleId = "Schedule"
 )
 
 
@@ -25,6 +41,29 @@ const (
 *
 * FrameType has 3 type of value:
 * TextMessage 、 PictureMessage 、 FileMessage
+* or the kind of a notice message, eg: ScanPending
+*
+* Meta "Id" is the id of the message, a notice referring to a message carries its id
+* Meta "Seq" is the sequence number of the message in its conversation in ordering mode,
+* clients can detect missing messages by gaps of sequence numbers
+* Meta "SeqScope" is the sequence space "Seq" is counted in, sequence numbers are counted per
+* conversation and frame type, and a space idle for a while is dropped, so the next message
+* starts a new space from 1 with a new scope, the scope is the id of the first message of the space
+* Meta "Parent" is the id of the message replied to, and "Quote" is a short snippet of it, which is
+* set only for receivers who take part in the message replied to
+* Meta "Mentions" is the users mentioned by a group text message, format:"user1;user2" or "all"
+* Meta "Expire" is the time a message expires in unix milliseconds, clients should delete it then
+* Meta "TTL" is seconds before a message expires after it's read, it's set if the message is not read before
+* Meta "SenderName" and "SenderAvatar" are the display name and the avatar url of the sender,
+* they are set only if embedding profiles is enabled
+* Meta "Contact" is the other user of a friend request or contact notice
+* Meta "Until" is when a mute or ban ends in unix milliseconds, it's not set if the restriction lasts
+* until it's lifted, and "Report" is the id of a report handled by moderators
+* Meta "Schedule" is the id of a scheduled message, it's sent with a new id in "Id"
+* Meta "Duration" and "Waveform" are the duration in milliseconds and the waveform("p1,p2,...") of a voice
+*
+* Content of a location, contact card or sticker frame is json, and content of a picture,
+* file or voice frame is an url to fetch it
 */
 type Frame struct {
 	FrameType string
@@ -37,14 +76,14 @@ type Frame struct {
 */
 func (f *Frame) ToBytes() []byte {
 	meta := ""
-	if len(f.Meta) == 0 {
+	if len(f.Meta) != 0 {
 		for k, v := range f.Meta {
 			meta += fmt.Sprintf("%s:%s\033", k, v)
 		}
 	} else {
 		meta = "\033"
 	}
-	frame := fmt.Sprintf("%s\033%s%s\033%s", f.FrameType, f.Meta, Meta2ContentSep, f.FrameContent)
+	frame := fmt.Sprintf("%s\033%s%s\033%s", f.FrameType, meta, Meta2ContentSep, f.FrameContent)
 
 	return []byte(frame)
 }
@@ -59,6 +98,7 @@ func (f *Frame) AddMeta(key string, content string) {
 func NewFrame(ftype string, fcontent string) *Frame {
 	return &Frame{
 		FrameType	: ftype,
+		Meta		: make(map[string]string),
 		FrameContent	: fcontent,
 	}
 }
\ No newline at end of file
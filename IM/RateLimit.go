@@ -0,0 +1,315 @@
+package IM
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultLimiterShards = 32
+	DefaultLimiterIdle = time.Minute * 10		//Buckets not used in this period are swept
+
+	//Scopes of rate limits, a scope of sends can be limited for a message type, see MessageRateScope
+	RateSendUser = "send.user"
+	RateSendIP = "send.ip"
+	RateRegisterIP = "register.ip"
+	RateConnectUser = "connect.user"
+	RateConnectIP = "connect.ip"
+)
+
+/*
+* Rate of a token bucket, PerSecond tokens are added every second and at most Burst tokens are kept
+*/
+type Rate struct {
+	PerSecond float64		`json:"perSecond"`
+	Burst int			`json:"burst"`
+}
+
+/*
+* Scope of sends of a message type, eg: MessageRateScope(RateSendUser, PictureMessageType)
+*/
+func MessageRateScope(scope string, messageType string) string {
+	return scope + ":" + messageType
+}
+
+type tokenBucket struct {
+	tokens float64
+	last time.Time
+	rate Rate				//Rate of the last take
+}
+
+/*
+* Take a token from the bucket, return the time to wait for a token if it's empty
+*/
+func (b *tokenBucket) take(rate Rate, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(float64(rate.Burst), b.tokens + now.Sub(b.last).Seconds() * rate.PerSecond)
+	b.last = now
+	b.rate = rate
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate.PerSecond * float64(time.Second))
+}
+
+/*
+* If the bucket is full again at now, a full bucket is the same as no bucket
+*/
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens + now.Sub(b.last).Seconds() * b.rate.PerSecond >= float64(b.rate.Burst)
+}
+
+type limiterShard struct {
+	mutex sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+/*
+* Counters of a scope
+*/
+type ScopeMetrics struct {
+	Rate Rate			`json:"rate"`
+	Allowed uint64			`json:"allowed"`
+	Rejected uint64			`json:"rejected"`
+}
+
+type RateLimiterMetrics struct {
+	Buckets int				`json:"buckets"`
+	Scopes map[string]ScopeMetrics		`json:"scopes"`
+}
+
+type rateScope struct {
+	rate Rate
+	allowed uint64
+	rejected uint64
+}
+
+/*
+* RateLimiter keeps a token bucket for each key of each scope, buckets are kept in
+* shards so that keys in different shards don't contend for the same mutex
+*/
+type RateLimiter struct {
+	mutex sync.RWMutex
+	scopes map[string]*rateScope
+
+	shards []*limiterShard
+}
+
+func NewRateLimiter(shardNum int) *RateLimiter {
+	if shardNum < 1 {
+		shardNum = 1
+	}
+
+	l := &RateLimiter{
+		scopes		: make(map[string]*rateScope),
+		shards		: make([]*limiterShard, shardNum),
+	}
+	for i := range l.shards {
+		l.shards[i] = &limiterShard{ buckets : make(map[string]*tokenBucket) }
+	}
+	return l
+}
+
+/*
+* Set the rate of a scope, a rate with no token per second removes the limit
+*/
+func (l *RateLimiter) SetRate(scope string, rate Rate) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if rate.PerSecond <= 0 {
+		delete(l.scopes, scope)
+		return
+	}
+	if rate.Burst < 1 {
+		rate.Burst = 1
+	}
+
+	if s, ok := l.scopes[scope]; ok {
+		s.rate = rate
+	} else {
+		l.scopes[scope] = &rateScope{ rate : rate }
+	}
+}
+
+/*
+* Take a token for a key in a scope, return the time to wait if it's limited
+* A scope without rate is never limited
+*/
+func (l *RateLimiter) Allow(scope string, key string) (bool, time.Duration) {
+	l.mutex.RLock()
+	s, ok := l.scopes[scope]
+	var rate Rate
+	if ok {
+		rate = s.rate
+	}
+	l.mutex.RUnlock()
+	if !ok {
+		return true, 0
+	}
+
+	k := scope + "\n" + key
+	shard := l.shards[partitionIndex(k, len(l.shards))]
+	now := time.Now()
+
+	shard.mutex.Lock()
+	b, ok := shard.buckets[k]
+	if !ok {
+		b = &tokenBucket{ tokens : float64(rate.Burst), last : now }
+		shard.buckets[k] = b
+	}
+	allowed, wait := b.take(rate, now)
+	shard.mutex.Unlock()
+
+	if allowed {
+		atomic.AddUint64(&s.allowed, 1)
+	} else {
+		atomic.AddUint64(&s.rejected, 1)
+	}
+	return allowed, wait
+}
+
+/*
+* Delete buckets not used for a while which are full again, a bucket refilled slower
+* than idle is kept until it's full
+*/
+func (l *RateLimiter) Sweep(idle time.Duration) {
+	now := time.Now()
+	for _, shard := range l.shards {
+		shard.mutex.Lock()
+		for k, b := range shard.buckets {
+			if now.Sub(b.last) > idle && b.full(now) {
+				delete(shard.buckets, k)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+func (l *RateLimiter) Metrics() RateLimiterMetrics {
+	m := RateLimiterMetrics{ Scopes : make(map[string]ScopeMetrics) }
+
+	l.mutex.RLock()
+	for name, s := range l.scopes {
+		m.Scopes[name] = ScopeMetrics{
+			Rate		: s.rate,
+			Allowed		: atomic.LoadUint64(&s.allowed),
+			Rejected	: atomic.LoadUint64(&s.rejected),
+		}
+	}
+	l.mutex.RUnlock()
+
+	for _, shard := range l.shards {
+		shard.mutex.Lock()
+		m.Buckets += len(shard.buckets)
+		shard.mutex.Unlock()
+	}
+	return m
+}
+
+func (l *RateLimiter) run() {
+	ticker := time.NewTicker(DefaultLimiterIdle)
+	for range ticker.C {
+		l.Sweep(DefaultLimiterIdle)
+	}
+}
+
+/*
+* Address of the client without port
+*/
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+* Check rate of a key in a scope, return a 429 error with the time to retry if it's limited
+*/
+func (im *IM) checkRate(scope string, key string) error {
+	if ok, wait := im.limiter.Allow(scope, key); !ok {
+		err := NewSendError(http.StatusTooManyRequests, "Too many requests")
+		err.RetryAfter = wait
+		return err
+	}
+	return nil
+}
+
+/*
+* Check rates of a send by the user and by the address of the request for the message type,
+* rates of all sends by the user and by the address are checked before the request is read
+*/
+func (im *IM) checkSendRate(r *http.Request, senderId string, messageType string) error {
+	ip := remoteIP(r)
+	checks := [][2]string{
+		{ MessageRateScope(RateSendUser, messageType), senderId },
+		{ MessageRateScope(RateSendIP, messageType), ip },
+	}
+	for _, c := range checks {
+		if err := im.checkRate(c[0], c[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+* Validate the check code of a sender and check the rate of all sends by the user,
+* so that a limited user is rejected before the request is read
+*/
+func (im *IM) validateSender(checkCode string) (*User, error) {
+	u, err := im.Validate(checkCode)
+	if err != nil {
+		return nil, err
+	}
+	if err := im.checkRate(RateSendUser, u.id); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+/*
+* Wrap a handler with a rate limit by the address of requests
+*/
+func (im *IM) limitByIP(scope string, f func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := im.checkRate(scope, remoteIP(r)); err != nil {
+			WriteSendError(w, err)
+			return
+		}
+		f(w, r)
+	}
+}
+
+/*
+* Set Retry-After header of a rate limited response
+*/
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if se, ok := err.(*SendError); ok && se.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(se.RetryAfter.Seconds()))))
+	}
+}
+
+/*
+* Serve metrics of rate limits in json
+* --------------headers:---------------
+* "Secret-Key":"xxxxx"
+*/
+func (im *IM) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	if !im.UserManager.CheckSecretKey(r.Header.Get("Secret-Key")) {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Secret key not match"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rateLimits"	: im.limiter.Metrics(),
+	})
+}
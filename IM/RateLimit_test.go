@@ -0,0 +1,96 @@
+package IM
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	rate := Rate{ PerSecond : 2, Burst : 3 }
+	start := time.Now()
+
+	cases := []struct {
+		name string
+		tokens float64
+		elapsed time.Duration
+		allowed bool
+		left float64
+		wait time.Duration
+	}{
+		{ "full bucket", 3, 0, true, 2, 0 },
+		{ "refill is capped by burst", 3, time.Minute, true, 2, 0 },
+		{ "refilled while idle", 0, time.Second, true, 1, 0 },
+		{ "empty bucket", 0, 0, false, 0, time.Second / 2 },
+		{ "half a token", 0, time.Second / 4, false, 0.5, time.Second / 4 },
+	}
+
+	for _, c := range cases {
+		b := &tokenBucket{ tokens : c.tokens, last : start }
+		allowed, wait := b.take(rate, start.Add(c.elapsed))
+		if allowed != c.allowed || wait != c.wait {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", c.name, allowed, wait, c.allowed, c.wait)
+		}
+		if b.tokens != c.left {
+			t.Errorf("%s: got %v tokens left, want %v", c.name, b.tokens, c.left)
+		}
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(4)
+	l.SetRate("send", Rate{ PerSecond : 0.001, Burst : 2 })
+
+	cases := []struct {
+		scope string
+		key string
+		allowed bool
+	}{
+		{ "send", "u1", true },
+		{ "send", "u1", true },
+		{ "send", "u1", false },
+		{ "send", "u2", true },
+		{ "other", "u1", true },
+	}
+
+	for i, c := range cases {
+		if allowed, _ := l.Allow(c.scope, c.key); allowed != c.allowed {
+			t.Errorf("case %d: %s of %s got %v, want %v", i, c.scope, c.key, allowed, c.allowed)
+		}
+	}
+
+	m := l.Metrics()
+	if s := m.Scopes["send"]; s.Allowed != 3 || s.Rejected != 1 {
+		t.Errorf("got metrics %+v", s)
+	}
+
+	l.SetRate("send", Rate{})
+	if allowed, _ := l.Allow("send", "u1"); !allowed {
+		t.Errorf("a scope without rate is limited")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name string
+		bucket tokenBucket
+		kept bool
+	}{
+		{ "used recently", tokenBucket{ tokens : 0, last : now, rate : Rate{ PerSecond : 1, Burst : 1 } }, true },
+		{ "idle and refilled", tokenBucket{ tokens : 0, last : now.Add(-time.Hour), rate : Rate{ PerSecond : 1, Burst : 10 } }, false },
+		{ "idle but refilling", tokenBucket{ tokens : 0, last : now.Add(-time.Hour), rate : Rate{ PerSecond : 0.001, Burst : 10 } }, true },
+	}
+
+	l := NewRateLimiter(1)
+	for _, c := range cases {
+		b := c.bucket
+		l.shards[0].buckets[c.name] = &b
+	}
+	l.Sweep(time.Minute)
+
+	for _, c := range cases {
+		if _, ok := l.shards[0].buckets[c.name]; ok != c.kept {
+			t.Errorf("%s: kept %v, want %v", c.name, ok, c.kept)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package IM
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MaxEmojiLength = 32
+
+	//Frame kinds of notices about reactions, content of the frame is the emoji
+	//and sender of the frame is the user who reacts
+	ReactionAdded = "ReactionAdded"
+	ReactionRemoved = "ReactionRemoved"
+)
+
+/*
+* Aggregated reactions of an emoji on a message
+*/
+type ReactionSummary struct {
+	Emoji string			`json:"emoji"`
+	Count int			`json:"count"`
+	Reactors []string		`json:"reactors"`
+}
+
+/*
+* Reaction store keeps reactions of users on messages
+*/
+type ReactionStore interface {
+	Add(uint64, string, string) bool			//Add an emoji of a user on a message, return false if it exists
+	Remove(uint64, string, string) bool			//Remove an emoji of a user on a message, return false if it doesn't exist
+	Reactions(uint64) []ReactionSummary			//Aggregated reactions of a message
+	Delete(uint64)						//Delete all reactions of a message
+}
+
+/*
+* Reaction store kept in memory
+*/
+type MemoryReactionStore struct {
+	mutex sync.RWMutex
+
+	reactions map[uint64]map[string]map[string]time.Time		//message id -> emoji -> reactor -> time
+}
+
+func NewMemoryReactionStore() *MemoryReactionStore {
+	return &MemoryReactionStore{
+		reactions	: make(map[uint64]map[string]map[string]time.Time),
+	}
+}
+
+func (s *MemoryReactionStore) Add(id uint64, user string, emoji string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	emojis, ok := s.reactions[id]
+	if !ok {
+		emojis = make(map[string]map[string]time.Time)
+		s.reactions[id] = emojis
+	}
+	reactors, ok := emojis[emoji]
+	if !ok {
+		reactors = make(map[string]time.Time)
+		emojis[emoji] = reactors
+	}
+
+	if _, ok := reactors[user]; ok {
+		return false
+	}
+	reactors[user] = time.Now()
+	return true
+}
+
+func (s *MemoryReactionStore) Remove(id uint64, user string, emoji string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	reactors, ok := s.reactions[id][emoji]
+	if !ok {
+		return false
+	}
+	if _, ok := reactors[user]; !ok {
+		return false
+	}
+
+	delete(reactors, user)
+	if len(reactors) == 0 {
+		delete(s.reactions[id], emoji)
+	}
+	if len(s.reactions[id]) == 0 {
+		delete(s.reactions, id)
+	}
+	return true
+}
+
+/*
+* Reactions are ordered by count, and reactors of an emoji are ordered by time they react
+*/
+func (s *MemoryReactionStore) Reactions(id uint64) []ReactionSummary {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	summaries := make([]ReactionSummary, 0, len(s.reactions[id]))
+	for emoji, reactors := range s.reactions[id] {
+		users := make([]string, 0, len(reactors))
+		for u := range reactors {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return reactors[users[i]].Before(reactors[users[j]]) })
+
+		summaries = append(summaries, ReactionSummary{
+			Emoji		: emoji,
+			Count		: len(users),
+			Reactors	: users,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Count != summaries[j].Count {
+			return summaries[i].Count > summaries[j].Count
+		}
+		return summaries[i].Emoji < summaries[j].Emoji
+	})
+
+	return summaries
+}
+
+func (s *MemoryReactionStore) Delete(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.reactions, id)
+}
+
+/*
+* An emoji can't be empty or contain characters used by frames
+*/
+func checkEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > MaxEmojiLength {
+		return NewSendError(http.StatusBadRequest, "Invalid emoji")
+	}
+	if strings.ContainsAny(emoji, " \t\r\n:;\033") {
+		return NewSendError(http.StatusBadRequest, "Invalid emoji")
+	}
+	return nil
+}
+
+/*
+* Send a notice to all participants of a record, including its sender
+*/
+func (im *IM) notifyParticipants(kind string, r *HistoryRecord, senderId string, content string) {
+	newNotice := func(target string) *NoticeMessage {
+		n := NewNoticeMessage(kind, content)
+		n.SetSenderId(senderId)
+		n.SetTargetId(target)
+		if r.Group != "" {
+			n.SetGroup(r.Group)
+		}
+		n.AddMeta(MessageId, strconv.FormatUint(r.Id, 10))
+		return n
+	}
+
+	if r.Group != "" {
+		im.SendMessage(newNotice(strings.Join(r.Participants(), ";")))
+	} else {
+		im.SendMessage(newNotice(r.Target))
+		if r.Sender != r.Target {
+			im.SendMessage(newNotice(r.Sender))
+		}
+	}
+}
+
+/*
+* Add or remove a reaction of a user on a message, the user must take part in the conversation
+* Participants get a ReactionAdded or ReactionRemoved frame when reactions change
+*/
+func (im *IM) React(id uint64, userId string, emoji string, remove bool) error {
+	if err := checkEmoji(emoji); err != nil {
+		return err
+	}
+	if im.history == nil || im.reactions == nil {
+		return NewSendError(http.StatusNotFound, "Reactions are not enabled")
+	}
+
+	r, ok := im.history.Get(id)
+	if !ok || !r.IsParticipant(userId) {
+		return NewSendError(http.StatusNotFound, ErrRecordNotFound.Error())
+	}
+	if r.Recalled {
+		return NewSendError(http.StatusBadRequest, "Message is recalled")
+	}
+
+	if remove {
+		if im.reactions.Remove(id, userId, emoji) {
+			im.notifyParticipants(ReactionRemoved, r, userId, emoji)
+		}
+	} else {
+		if im.reactions.Add(id, userId, emoji) {
+			im.notifyParticipants(ReactionAdded, r, userId, emoji)
+		}
+	}
+
+	return nil
+}
+
+/*
+* Request body of reaction api
+* eg: {"id":"123","emoji":"+1"}
+* eg: {"id":"123","emoji":"+1","remove":true}
+*/
+type ReactionRequest struct {
+	Id uint64			`json:"id,string"`
+	Emoji string			`json:"emoji"`
+	Remove bool			`json:"remove,omitempty"`
+}
+
+/*
+* Serve reaction api
+* Post request should obey the following format:
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body-------------------
+* ReactionRequest in json
+*
+* Return {"id":"xxx","reactions":[...]} in json with aggregated reactions of the message
+*/
+func (im *IM) ServeReaction(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only post is allowed"))
+		return
+	}
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	body, err := readLimitedBody(r, 1024)
+	if err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	req := &ReactionRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+		return
+	}
+
+	if err := im.React(req.Id, u.id, req.Emoji, req.Remove); err != nil {
+		writeAPIError(w, "", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id"		: strconv.FormatUint(req.Id, 10),
+		"reactions"	: im.reactions.Reactions(req.Id),
+	})
+}
@@ -0,0 +1,81 @@
+package IM
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemoryReactionStore(t *testing.T) {
+	s := NewMemoryReactionStore()
+
+	ops := []struct {
+		name string
+		remove bool
+		user string
+		emoji string
+		ok bool
+	}{
+		{ "add", false, "a", "+1", true },
+		{ "add again", false, "a", "+1", false },
+		{ "another user", false, "b", "+1", true },
+		{ "another emoji", false, "a", "heart", true },
+		{ "third emoji", false, "c", "smile", true },
+		{ "remove", true, "c", "smile", true },
+		{ "remove again", true, "c", "smile", false },
+		{ "remove never added", true, "b", "heart", false },
+	}
+	for _, op := range ops {
+		var ok bool
+		if op.remove {
+			ok = s.Remove(1, op.user, op.emoji)
+		} else {
+			ok = s.Add(1, op.user, op.emoji)
+		}
+		if ok != op.ok {
+			t.Errorf("%s: got %v, want %v", op.name, ok, op.ok)
+		}
+	}
+
+	want := []ReactionSummary{
+		{ Emoji : "+1", Count : 2, Reactors : []string{ "a", "b" } },
+		{ Emoji : "heart", Count : 1, Reactors : []string{ "a" } },
+	}
+	if got := s.Reactions(1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got reactions %+v, want %+v", got, want)
+	}
+
+	s.Remove(1, "a", "+1")
+	s.Remove(1, "b", "+1")
+	s.Remove(1, "a", "heart")
+	if _, ok := s.reactions[1]; ok {
+		t.Errorf("reactions of a message are kept after all are removed")
+	}
+
+	s.Add(2, "a", "+1")
+	s.Delete(2)
+	if got := s.Reactions(2); len(got) != 0 {
+		t.Errorf("got reactions %+v of a deleted message", got)
+	}
+}
+
+func TestCheckEmoji(t *testing.T) {
+	cases := []struct {
+		emoji string
+		ok bool
+	}{
+		{ "+1", true },
+		{ "\U0001F600", true },
+		{ "", false },
+		{ "a b", false },
+		{ "a;b", false },
+		{ "a:b", false },
+		{ "line\n", false },
+		{ "123456789012345678901234567890123", false },
+	}
+
+	for _, c := range cases {
+		if err := checkEmoji(c.emoji); (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.emoji, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package IM
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+* Revocation list keeps revoked tokens until they expire, and users whose tokens
+* issued before a time are all revoked, eg: logout on all devices
+*/
+type RevocationList struct {
+	mutex sync.RWMutex
+
+	tokens map[string]time.Time			//token id -> expire time of the token
+	users map[string]int64				//user id -> tokens issued at or before it(unix nanoseconds) are revoked
+	devices map[string]int64			//user id and device id -> tokens of the device issued at or before it are revoked
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		tokens		: make(map[string]time.Time),
+		users		: make(map[string]int64),
+		devices		: make(map[string]int64),
+	}
+}
+
+/*
+* Revocation list kept in user store, so that revoked tokens stay revoked after restart
+*/
+type RevocationRecord struct {
+	Tokens map[string]time.Time		`json:"tokens"`
+	Users map[string]int64			`json:"users"`
+	Devices map[string]int64		`json:"devices"`
+}
+
+func NewRevocationListFromRecord(r *RevocationRecord) *RevocationList {
+	l := NewRevocationList()
+	for id, exp := range r.Tokens {
+		l.tokens[id] = exp
+	}
+	for id, before := range r.Users {
+		l.users[id] = before
+	}
+	for key, before := range r.Devices {
+		l.devices[key] = before
+	}
+	return l
+}
+
+func (l *RevocationList) Record() *RevocationRecord {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	r := &RevocationRecord{
+		Tokens		: make(map[string]time.Time, len(l.tokens)),
+		Users		: make(map[string]int64, len(l.users)),
+		Devices		: make(map[string]int64, len(l.devices)),
+	}
+	for id, exp := range l.tokens {
+		r.Tokens[id] = exp
+	}
+	for id, before := range l.users {
+		r.Users[id] = before
+	}
+	for key, before := range l.devices {
+		r.Devices[key] = before
+	}
+	return r
+}
+
+func (l *RevocationList) RevokeToken(claims *TokenClaims) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.tokens[claims.Id] = time.Unix(claims.ExpiresAt, 0)
+}
+
+/*
+* Revoke all tokens of a user issued before now
+*/
+func (l *RevocationList) RevokeUser(id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.users[id] = time.Now().UnixNano()
+}
+
+/*
+* Revoke all tokens of a device issued before now, eg: sign out the device remotely
+*/
+func (l *RevocationList) RevokeDevice(id string, device string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.devices[id + "\n" + device] = time.Now().UnixNano()
+}
+
+/*
+* Revoke a token unless it's revoked, return false if it's revoked already
+* The check and the revocation are done under the same lock, so a single use token,
+* eg: a refresh token, is used only once by concurrent requests
+*/
+func (l *RevocationList) Use(claims *TokenClaims) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.isRevoked(claims) {
+		return false
+	}
+	l.tokens[claims.Id] = time.Unix(claims.ExpiresAt, 0)
+	return true
+}
+
+func (l *RevocationList) IsRevoked(claims *TokenClaims) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.isRevoked(claims)
+}
+
+/*
+* Time a token is issued in unix nanoseconds, a token without nanoseconds is taken as
+* issued at the start of its second, so it's revoked by a revocation in the same second
+*/
+func issuedAt(claims *TokenClaims) int64 {
+	if claims.IssuedAtNano != 0 {
+		return claims.IssuedAtNano
+	}
+	return claims.IssuedAt * int64(time.Second)
+}
+
+/*
+* Note: caller must hold the mutex
+*/
+func (l *RevocationList) isRevoked(claims *TokenClaims) bool {
+	if _, ok := l.tokens[claims.Id]; ok {
+		return true
+	}
+	issued := issuedAt(claims)
+	if before, ok := l.users[claims.Subject]; ok && issued <= before {
+		return true
+	}
+	if claims.Device == "" {
+		return false
+	}
+	if before, ok := l.devices[claims.Subject + "\n" + claims.Device]; ok && issued <= before {
+		return true
+	}
+	return false
+}
+
+/*
+* Delete entries of tokens which are expired anyway
+*/
+func (l *RevocationList) Sweep() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for id, exp := range l.tokens {
+		if now.After(exp) {
+			delete(l.tokens, id)
+		}
+	}
+	for id, before := range l.users {
+		if now.Sub(time.Unix(0, before)) > DefaultRefreshExpire {
+			delete(l.users, id)
+		}
+	}
+	for key, before := range l.devices {
+		if now.Sub(time.Unix(0, before)) > DefaultRefreshExpire {
+			delete(l.devices, key)
+		}
+	}
+}
+
+/*
+* Close live streams of a user, called when tokens of the user are revoked
+* Only streams of the device are closed if device is set
+*/
+func (im *IM) closeStreams(id string, device string) {
+	for _, p := range im.consumerPools {
+		if rs, ok := p.Receivers(id); ok {
+			if device == "" {
+				rs.ClearReceivers()
+			} else {
+				rs.ClearDevice(device)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package IM
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevocationList(t *testing.T) {
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+
+	l := NewRevocationList()
+	l.RevokeUser("u1")
+	l.RevokeDevice("u2", "phone")
+	l.RevokeToken(&TokenClaims{ Id : "revoked", ExpiresAt : before.Add(time.Hour).Unix() })
+
+	time.Sleep(time.Millisecond)
+	after := time.Now()
+
+	claims := func(id string, subject string, device string, issued time.Time) *TokenClaims {
+		return &TokenClaims{
+			Id		: id,
+			Subject		: subject,
+			Device		: device,
+			IssuedAt	: issued.Unix(),
+			IssuedAtNano	: issued.UnixNano(),
+			ExpiresAt	: issued.Add(time.Hour).Unix(),
+		}
+	}
+	secondsOnly := claims("t", "u1", "", before)
+	secondsOnly.IssuedAtNano = 0
+
+	cases := []struct {
+		name string
+		claims *TokenClaims
+		revoked bool
+	}{
+		{ "user token issued before", claims("t", "u1", "", before), true },
+		{ "user token issued after in the same second", claims("t", "u1", "", after), false },
+		{ "user token without nanoseconds", secondsOnly, true },
+		{ "device token issued before", claims("t", "u2", "phone", before), true },
+		{ "device token issued after", claims("t", "u2", "phone", after), false },
+		{ "other device", claims("t", "u2", "pad", before), false },
+		{ "token of the user without device", claims("t", "u2", "", before), false },
+		{ "revoked token", claims("revoked", "u3", "", after), true },
+		{ "other user", claims("t", "u3", "", before), false },
+	}
+
+	for _, c := range cases {
+		if revoked := l.IsRevoked(c.claims); revoked != c.revoked {
+			t.Errorf("%s: revoked %v, want %v", c.name, revoked, c.revoked)
+		}
+	}
+
+	//revocations survive a round trip of the record
+	r := NewRevocationListFromRecord(l.Record())
+	for _, c := range cases {
+		if revoked := r.IsRevoked(c.claims); revoked != c.revoked {
+			t.Errorf("%s: revoked %v after restore, want %v", c.name, revoked, c.revoked)
+		}
+	}
+}
+
+func TestRevocationListUse(t *testing.T) {
+	l := NewRevocationList()
+	c := &TokenClaims{ Id : "refresh", Subject : "u1", IssuedAtNano : time.Now().UnixNano(), ExpiresAt : time.Now().Add(time.Hour).Unix() }
+
+	uses := []bool{ true, false, false }
+	for i, want := range uses {
+		if got := l.Use(c); got != want {
+			t.Errorf("use %d: got %v, want %v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package IM
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"log"
+)
+
+const (
+	MaxLocationTextLength = 256
+	MaxContactFieldLength = 256
+	MaxVoiceDuration = time.Minute * 5
+	MaxWaveformLength = 256
+)
+
+var stickerIdPattern = regexp.MustCompile(`^[A-Za-z0-9_\-.]{1,64}$`)
+
+/*
+* A location shared by a user
+*/
+type Location struct {
+	Latitude float64		`json:"latitude"`
+	Longitude float64		`json:"longitude"`
+	Name string			`json:"name,omitempty"`
+	Address string			`json:"address,omitempty"`
+}
+
+func (l *Location) Validate() error {
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return errors.New("Invalid coordinate")
+	}
+	if len(l.Name) > MaxLocationTextLength || len(l.Address) > MaxLocationTextLength {
+		return errors.New("Location name or address too long")
+	}
+	return nil
+}
+
+/*
+* A contact card shared by a user, UserId is the id of the user in IM
+*/
+type ContactCard struct {
+	UserId string			`json:"userId"`
+	Name string			`json:"name,omitempty"`
+	Phone string			`json:"phone,omitempty"`
+	Email string			`json:"email,omitempty"`
+}
+
+func (c *ContactCard) Validate() error {
+	if c.UserId == "" {
+		return errors.New("Contact user id missed")
+	}
+	for _, f := range []string{ c.UserId, c.Name, c.Phone, c.Email } {
+		if len(f) > MaxContactFieldLength {
+			return errors.New("Contact field too long")
+		}
+	}
+	return nil
+}
+
+/*
+* A sticker in a sticker pack
+*/
+type Sticker struct {
+	Pack string			`json:"pack"`
+	Sticker string			`json:"sticker"`
+}
+
+func (s *Sticker) Validate() error {
+	if !stickerIdPattern.MatchString(s.Pack) || !stickerIdPattern.MatchString(s.Sticker) {
+		return errors.New("Invalid sticker")
+	}
+	return nil
+}
+
+/*
+* Meta of a voice note, waveform is a list of peaks in 0-255 to draw the voice
+*/
+type VoiceMeta struct {
+	Duration int64			`json:"duration"`		//Milliseconds
+	Waveform []int			`json:"waveform,omitempty"`
+}
+
+func (v *VoiceMeta) Validate() error {
+	if v.Duration <= 0 || time.Duration(v.Duration) * time.Millisecond > MaxVoiceDuration {
+		return errors.New("Invalid voice duration")
+	}
+	if len(v.Waveform) > MaxWaveformLength {
+		return errors.New("Waveform too long")
+	}
+	for _, p := range v.Waveform {
+		if p < 0 || p > 255 {
+			return errors.New("Invalid waveform")
+		}
+	}
+	return nil
+}
+
+/*
+* Encode waveform as "p1,p2,p3..."
+*/
+func EncodeWaveform(waveform []int) string {
+	ps := make([]string, len(waveform))
+	for i, p := range waveform {
+		ps[i] = strconv.Itoa(p)
+	}
+	return strings.Join(ps, ",")
+}
+func DecodeWaveform(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	ps := strings.Split(s, ",")
+	waveform := make([]int, len(ps))
+	for i, p := range ps {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, errors.New("Invalid waveform")
+		}
+		waveform[i] = n
+	}
+	return waveform, nil
+}
+
+
+//LocationMessage
+type LocationMessage struct {
+	DefaultMessage
+}
+func NewLocationMessage(l *Location) *LocationMessage {
+	return &LocationMessage{
+		DefaultMessage : DefaultMessage {
+			messageType	: LocationMessageType,
+			content		: l,
+			errorChan	: make(chan error, 1),
+		},
+	}
+}
+func (m *LocationMessage) OnBinary() ([]byte, error) {
+	if l, ok := m.content.(*Location); ok {
+		return json.Marshal(l)
+	} else {
+		return nil, errors.New("Invalid Location message")
+	}
+}
+
+
+//ContactCardMessage
+type ContactCardMessage struct {
+	DefaultMessage
+}
+func NewContactCardMessage(c *ContactCard) *ContactCardMessage {
+	return &ContactCardMessage{
+		DefaultMessage : DefaultMessage {
+			messageType	: ContactCardMessageType,
+			content		: c,
+			errorChan	: make(chan error, 1),
+		},
+	}
+}
+func (m *ContactCardMessage) OnBinary() ([]byte, error) {
+	if c, ok := m.content.(*ContactCard); ok {
+		return json.Marshal(c)
+	} else {
+		return nil, errors.New("Invalid ContactCard message")
+	}
+}
+
+
+//StickerMessage
+type StickerMessage struct {
+	DefaultMessage
+}
+func NewStickerMessage(s *Sticker) *StickerMessage {
+	return &StickerMessage{
+		DefaultMessage : DefaultMessage {
+			messageType	: StickerMessageType,
+			content		: s,
+			errorChan	: make(chan error, 1),
+		},
+	}
+}
+func (m *StickerMessage) OnBinary() ([]byte, error) {
+	if s, ok := m.content.(*Sticker); ok {
+		return json.Marshal(s)
+	} else {
+		return nil, errors.New("Invalid Sticker message")
+	}
+}
+
+
+//VoiceMessage
+//Content is the audio, which is delivered through file proxy like a file
+type VoiceMessage struct {
+	DefaultMessage
+
+	format string				//Suffix of the audio, eg: "ogg"
+	meta VoiceMeta
+}
+func NewVoiceMessage(content []byte, format string, meta VoiceMeta) *VoiceMessage {
+	return &VoiceMessage{
+		DefaultMessage : DefaultMessage {
+			messageType	: VoiceMessageType,
+			content		: content,
+			errorChan	: make(chan error, 1),
+		},
+
+		format		: format,
+		meta		: meta,
+	}
+}
+func (m *VoiceMessage) OnReceived() { log.Print("Voice message received") }
+func (m *VoiceMessage) OnBinary() ([]byte, error) {
+	if bs, ok := m.content.([]byte); ok {
+		return bs, nil
+	} else {
+		return nil, errors.New("Invalid Voice message")
+	}
+}
+func (m *VoiceMessage) Format() string { return m.format }
+func (m *VoiceMessage) Duration() int64 { return m.meta.Duration }
+func (m *VoiceMessage) Waveform() []int { return m.meta.Waveform }
+
+
+/*
+* Decode a json body into v and validate it
+*/
+func decodeRichContent(body []byte, v interface{ Validate() error }) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return NewSendError(http.StatusBadRequest, "Invalid message content")
+	}
+	if err := v.Validate(); err != nil {
+		return NewSendError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+/*
+* Decoders of rich message types, see MessageType
+* Location, contact card and sticker are sent in json, voice is sent as audio with
+* params "name"(format of the audio), "duration"(milliseconds) and "waveform"("p1,p2,...")
+*/
+func decodeLocation(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	l := &Location{}
+	if err := decodeRichContent(body, l); err != nil {
+		return nil, err
+	}
+
+	//a missing coordinate is not taken as 0
+	coordinate := struct {
+		Latitude *float64		`json:"latitude"`
+		Longitude *float64		`json:"longitude"`
+	}{}
+	if json.Unmarshal(body, &coordinate); coordinate.Latitude == nil || coordinate.Longitude == nil {
+		return nil, NewSendError(http.StatusBadRequest, "Coordinate missed")
+	}
+	return NewLocationMessage(l), nil
+}
+func decodeContactCard(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	c := &ContactCard{}
+	if err := decodeRichContent(body, c); err != nil {
+		return nil, err
+	}
+	return NewContactCardMessage(c), nil
+}
+func decodeSticker(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	s := &Sticker{}
+	if err := decodeRichContent(body, s); err != nil {
+		return nil, err
+	}
+	return NewStickerMessage(s), nil
+}
+func decodeVoice(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	format := strings.TrimPrefix(strings.ToLower(params["name"]), ".")
+	if format == "" {
+		return nil, NewSendError(http.StatusBadRequest, "Voice format missed")
+	}
+
+	duration, err := strconv.ParseInt(params["duration"], 10, 64)
+	if err != nil {
+		return nil, NewSendError(http.StatusBadRequest, "Invalid voice duration")
+	}
+	waveform, err := DecodeWaveform(params["waveform"])
+	if err != nil {
+		return nil, NewSendError(http.StatusBadRequest, err.Error())
+	}
+
+	meta := VoiceMeta{ Duration : duration, Waveform : waveform }
+	if err := meta.Validate(); err != nil {
+		return nil, NewSendError(http.StatusBadRequest, err.Error())
+	}
+	if err := checkUpload(policy, senderId, filepath.Ext("." + format), body); err != nil {
+		return nil, err
+	}
+	return NewVoiceMessage(body, format, meta), nil
+}
+
+/*
+* Restore rich messages from history records
+*/
+func restoreLocation(r *HistoryRecord) (Message, error) {
+	l := &Location{}
+	if err := json.Unmarshal(r.Content, l); err != nil {
+		return nil, err
+	}
+	return NewLocationMessage(l), nil
+}
+func restoreContactCard(r *HistoryRecord) (Message, error) {
+	c := &ContactCard{}
+	if err := json.Unmarshal(r.Content, c); err != nil {
+		return nil, err
+	}
+	return NewContactCardMessage(c), nil
+}
+func restoreSticker(r *HistoryRecord) (Message, error) {
+	s := &Sticker{}
+	if err := json.Unmarshal(r.Content, s); err != nil {
+		return nil, err
+	}
+	return NewStickerMessage(s), nil
+}
+func restoreVoice(r *HistoryRecord) (Message, error) {
+	duration, _ := strconv.ParseInt(r.Meta[Duration], 10, 64)
+	waveform, _ := DecodeWaveform(r.Meta[Waveform])
+	return NewVoiceMessage(r.Content, r.Name, VoiceMeta{ Duration : duration, Waveform : waveform }), nil
+}
+func encodeVoice(m Message, r *HistoryRecord) {
+	if vm, ok := m.(*VoiceMessage); ok {
+		r.Name = vm.Format()
+		r.Meta = map[string]string{
+			Duration	: strconv.FormatInt(vm.Duration(), 10),
+			Waveform	: EncodeWaveform(vm.Waveform()),
+		}
+	}
+}
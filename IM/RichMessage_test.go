@@ -0,0 +1,88 @@
+package IM
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeRichMessages(t *testing.T) {
+	policy := NewUploadPolicy()
+	voice := func(name string, duration string, waveform string) map[string]string {
+		return map[string]string{ "name" : name, "duration" : duration, "waveform" : waveform }
+	}
+
+	cases := []struct {
+		name string
+		decode func(*UploadPolicy, string, []byte, map[string]string) (Message, error)
+		body string
+		params map[string]string
+		code int
+	}{
+		{ "location", decodeLocation, `{"latitude":31.2,"longitude":121.5,"name":"office"}`, nil, 0 },
+		{ "location at 0,0", decodeLocation, `{"latitude":0,"longitude":0}`, nil, 0 },
+		{ "location without longitude", decodeLocation, `{"latitude":31.2}`, nil, http.StatusBadRequest },
+		{ "location out of range", decodeLocation, `{"latitude":91,"longitude":0}`, nil, http.StatusBadRequest },
+		{ "location in invalid json", decodeLocation, `{`, nil, http.StatusBadRequest },
+		{ "contact card", decodeContactCard, `{"userId":"u1","name":"U"}`, nil, 0 },
+		{ "contact card without user", decodeContactCard, `{"name":"U"}`, nil, http.StatusBadRequest },
+		{ "sticker", decodeSticker, `{"pack":"cats","sticker":"cat_1"}`, nil, 0 },
+		{ "sticker with invalid id", decodeSticker, `{"pack":"cats","sticker":"../cat"}`, nil, http.StatusBadRequest },
+		{ "voice", decodeVoice, "ogg", voice("ogg", "1500", "0,128,255"), 0 },
+		{ "voice without format", decodeVoice, "ogg", voice("", "1500", ""), http.StatusBadRequest },
+		{ "voice without duration", decodeVoice, "ogg", voice("ogg", "", ""), http.StatusBadRequest },
+		{ "voice too long", decodeVoice, "ogg", voice("ogg", "300001", ""), http.StatusBadRequest },
+		{ "voice with invalid waveform", decodeVoice, "ogg", voice("ogg", "1500", "0,256"), http.StatusBadRequest },
+	}
+
+	for _, c := range cases {
+		m, err := c.decode(policy, "sender", []byte(c.body), c.params)
+		if code := sendErrorCode(err); code != c.code || err != nil && code == 0 {
+			t.Errorf("%s: got error %v, want code %d", c.name, err, c.code)
+			continue
+		}
+		if err == nil && m == nil {
+			t.Errorf("%s: got no message", c.name)
+		}
+	}
+}
+
+func TestWaveform(t *testing.T) {
+	cases := []struct {
+		s string
+		waveform []int
+		encoded string
+		ok bool
+	}{
+		{ "", nil, "", true },
+		{ "0,128,255", []int{ 0, 128, 255 }, "0,128,255", true },
+		{ "1, 2", []int{ 1, 2 }, "1,2", true },
+		{ "1,a", nil, "", false },
+	}
+
+	for _, c := range cases {
+		waveform, err := DecodeWaveform(c.s)
+		if (err == nil) != c.ok || !reflect.DeepEqual(waveform, c.waveform) {
+			t.Errorf("%q: got %v, %v", c.s, waveform, err)
+			continue
+		}
+		if encoded := EncodeWaveform(waveform); encoded != c.encoded {
+			t.Errorf("%q: encoded as %q, want %q", c.s, encoded, c.encoded)
+		}
+	}
+}
+
+func TestVoiceRecord(t *testing.T) {
+	m := NewVoiceMessage([]byte("ogg"), "ogg", VoiceMeta{ Duration : 1500, Waveform : []int{ 1, 2 } })
+	r := &HistoryRecord{ Content : []byte("ogg") }
+	encodeVoice(m, r)
+
+	restored, err := restoreVoice(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := restored.(*VoiceMessage)
+	if vm.Format() != "ogg" || vm.Duration() != 1500 || !reflect.DeepEqual(vm.Waveform(), []int{ 1, 2 }) {
+		t.Errorf("got voice %s of %dms %v", vm.Format(), vm.Duration(), vm.Waveform())
+	}
+}
@@ -2,6 +2,7 @@ package IM
 
 import (
 	"net/http"
+	"strconv"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/context"
 	"log"
@@ -44,6 +45,10 @@ func route(im *IM) {
 	router := NewRouter()
 	//router.RouteFunc(im.communicationPath, im.communication.Start)
 	beego.Any(im.communicationPath + "/:checkCode", func(c *context.Context) {
+		if err := im.checkRate(RateConnectIP, remoteIP(c.Request)); err != nil {
+			WriteSendError(c.ResponseWriter.ResponseWriter, err)
+			return
+		}
 		checkCode := c.Input.Param(":checkCode")
 		im.communication.Start(c.ResponseWriter.ResponseWriter, c.Request, checkCode)
 	})
@@ -61,15 +66,86 @@ func route(im *IM) {
 
 	//route message sender
 	router.RouteFunc(im.senderPath, func(w http.ResponseWriter, r *http.Request) {
-		m := SendMessageHandleFunc(r, im.Validate)
-		if m != nil {
-			im.SendMessage(m)
+		if err := im.checkRate(RateSendIP, remoteIP(r)); err != nil {
+			WriteSendError(w, err)
+		} else if m, err := SendMessageHandleFunc(r, im.validateSender, im.uploadPolicy, im.registry); err != nil {
+			WriteSendError(w, err)
+		} else if err := im.checkSendRate(r, m.SenderId(), m.Type()); err != nil {
+			WriteSendError(w, err)
+		} else if at, err := ParseSendAt(r.Header.Get("Send-At"), r.Header.Get("Send-Delay")); err != nil {
+			WriteSendError(w, err)
+		} else if id, _, err := im.SendOrSchedule(m, r.Header.Get("Client-Msg-Id"), at); err != nil {
+			WriteSendError(w, err)
+		} else {
+			w.Header().Set("Message-Id", strconv.FormatUint(id, 10))
 		}
 	})
 
+	//route json message api
+	if im.messageAPIPath != "" {
+		router.RouteFunc(im.messageAPIPath, im.ServeMessageAPI)
+	}
+
+	//route batch api
+	if im.batchPath != "" {
+		router.RouteFunc(im.batchPath, im.ServeBatchAPI)
+	}
+
+	//route history and message change api
+	if im.historyPath != "" && im.history != nil {
+		router.RouteFunc(im.historyPath, im.ServeHistory)
+	}
+	if im.threadPath != "" && im.history != nil {
+		router.RouteFunc(im.threadPath, im.ServeThread)
+	}
+	if im.reactionPath != "" && im.history != nil && im.reactions != nil {
+		router.RouteFunc(im.reactionPath, im.ServeReaction)
+	}
+	if im.schedulePath != "" && im.scheduler != nil {
+		router.RouteFunc(im.schedulePath, im.ServeSchedule)
+	}
+	if im.expiryPath != "" && im.expirer != nil {
+		router.RouteFunc(im.expiryPath, im.ServeExpiry)
+	}
+	if im.editPath != "" {
+		router.RouteFunc(im.editPath, im.ServeEditMessage)
+	}
+	if im.recallPath != "" {
+		router.RouteFunc(im.recallPath, im.ServeRecallMessage)
+	}
+
 	//route user manage function
-	router.RouteFunc(im.registerURL, im.UserManager.ServeRegister)
+	router.RouteFunc(im.registerURL, im.limitByIP(RateRegisterIP, im.UserManager.ServeRegister))
 	router.RouteFunc(im.updateSecretURL, im.UserManager.ServeUpdateKey)
+	if im.refreshURL != "" {
+		router.RouteFunc(im.refreshURL, im.UserManager.ServeRefresh)
+	}
+	if im.revokeURL != "" {
+		router.RouteFunc(im.revokeURL, im.UserManager.ServeRevoke)
+	}
+	if im.sessionPath != "" {
+		router.RouteFunc(im.sessionPath, im.ServeSessions)
+	}
+	if im.contactPath != "" {
+		router.RouteFunc(im.contactPath, im.ServeContacts)
+	}
+	if im.metricsPath != "" {
+		router.RouteFunc(im.metricsPath, im.ServeMetrics)
+	}
+	if im.adminPath != "" {
+		router.RouteFunc(im.adminPath, im.ServeAdmin)
+	}
+	if im.reports != nil {
+		if im.reportPath != "" {
+			router.RouteFunc(im.reportPath, im.ServeReport)
+		}
+		if im.moderationPath != "" {
+			router.RouteFunc(im.moderationPath, im.ServeModeration)
+		}
+	}
+	if im.profilePath != "" && im.profiles != nil {
+		router.RouteFunc(im.profilePath, im.ServeProfile)
+	}
 
 	beego.Run(im.host[7:])
 }
\ No newline at end of file
@@ -63,6 +63,15 @@ func (b *SSEBroker) ClearFilter() {
 	b.filters = make([]MessageFilter, 0)
 }
 func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
+	return b.StartDeviceProxy(id, nil, nil, w, nil)
+}
+
+/*
+* Start a proxy of a device, messages returned by backlog are pushed before live messages,
+* and the cursor of the device moves forward with messages pushed
+* filter applies to this connection only, after filters added to the broker, it may be nil
+*/
+func (b *SSEBroker) StartDeviceProxy(id string, d *Device, filter MessageFilter, w http.ResponseWriter, backlog func() []Message) error {
 	//check for sse
 	f, ok := w.(http.Flusher)
 	if !ok {
@@ -80,9 +89,14 @@ func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
 	parserNum := len(b.parses)
 	receivers := make([]*MessageReceiver, parserNum)
 
+	device := ""
+	if d != nil {
+		device = d.id
+	}
+
 	count := 0
 	for mt := range b.parses{
-		if rec, err := b.im.ReceiveMessages(id, mt, b.race); err == nil {
+		if rec, err := b.im.ReceiveDeviceMessages(id, device, mt, b.race); err == nil {
 			receivers[count] = rec
 			count++
 		} else {
@@ -94,9 +108,10 @@ func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
 	if count == 0 {
 		return errors.New("No usable receiver")
 	}
+	receivers = receivers[:count]
 
 	//init select cases
-	cases := make([]reflect.SelectCase, parserNum)
+	cases := make([]reflect.SelectCase, count)
 
 	for i, r := range receivers {
 		cases[i] = reflect.SelectCase{ Dir : reflect.SelectRecv, Chan : reflect.ValueOf(r.ReceiveChan) }
@@ -124,7 +139,16 @@ func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
 			close(finish)
 		}()
 
-		ms := make([]Message, 1)
+		//receivers are registered before backlog is read, so messages sent in between
+		//may be in both of them
+		pushed := make(map[uint64]bool)
+		if backlog != nil {
+			for _, message := range backlog() {
+				pushed[message.Id()] = true
+				b.push(w, f, id, message, d, filter)
+			}
+		}
+
 		for {
 			_, m, ok := reflect.Select(cases)
 
@@ -132,23 +156,8 @@ func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
 				break
 			}
 
-			if message, ok := m.Interface().(Message); ok {
-				ms[0] = message
-			}
-
-			if len(b.filters) != 0 {
-				b.mutex.Lock()
-				for _, filter := range b.filters {
-					ms = filter.Filter(ms)
-				}
-				b.mutex.Unlock()
-			}
-
-			if len(ms) > 0 {
-				for _, frame := range b.parses[ms[0].Type()].ParseMessage(ms) {
-					w.Write(frame.ToBytes())
-					f.Flush()
-				}
+			if message, ok := m.Interface().(Message); ok && !pushed[message.Id()] {
+				b.push(w, f, id, message, d, filter)
 			}
 		}
 	}()
@@ -157,4 +166,38 @@ func (b *SSEBroker) StartProxy(id string, w http.ResponseWriter) error {
 
 	log.Print("connection closed")
 	return nil
+}
+
+/*
+* Filter, parse and write a message to the stream of a receiver
+*/
+func (b *SSEBroker) push(w http.ResponseWriter, f http.Flusher, receiver string, m Message, d *Device, connFilter MessageFilter) {
+	//message expired while it's held in receiver buffer
+	if IsExpired(m) {
+		return
+	}
+	if d != nil {
+		d.Advance(m.Id())
+	}
+
+	ms := []Message{ m }
+	if len(b.filters) != 0 {
+		b.mutex.Lock()
+		for _, filter := range b.filters {
+			ms = filter.Filter(ms)
+		}
+		b.mutex.Unlock()
+	}
+	if connFilter != nil {
+		ms = connFilter.Filter(ms)
+	}
+
+	if len(ms) > 0 {
+		for _, frame := range b.parses[ms[0].Type()].ParseMessage(ms) {
+			b.im.hideQuote(frame, ms[0], receiver)
+			w.Write(frame.ToBytes())
+			f.Flush()
+		}
+		b.im.onMessageRead(ms[0])
+	}
 }
\ No newline at end of file
@@ -0,0 +1,493 @@
+package IM
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultScheduleRootPath = "IM_SCHEDULE"
+	MaxScheduleAhead = time.Hour * 24 * 30		//Messages can't be scheduled later than this
+	MaxScheduledPerUser = 100			//Max pending scheduled messages of a user
+
+	//Frame kinds of the notices sent to the sender when a scheduled message is sent or fails to send
+	ScheduleSent = "ScheduleSent"
+	ScheduleFailed = "ScheduleFailed"
+)
+
+var ErrScheduleNotFound = errors.New("No such scheduled message")
+
+/*
+* A message waiting to be sent at a time
+* Id is the id of the schedule returned to the sender, to list or cancel it, the message is
+* given a new id when it's sent, so ids of messages follow the order they are delivered in
+*/
+type ScheduledMessage struct {
+	Id uint64			`json:"id,string"`
+	SendAt time.Time		`json:"sendAt"`
+	Created time.Time		`json:"created"`
+	Record *HistoryRecord		`json:"record"`
+	Content []byte			`json:"content"`
+
+	index int			//Index in the heap
+}
+
+/*
+* A scheduled message in json returned by schedule api
+*/
+type ScheduledItem struct {
+	Id uint64			`json:"id,string"`
+	Type string			`json:"type"`
+	Target string			`json:"target"`
+	Group string			`json:"group,omitempty"`
+	Snippet string			`json:"snippet"`
+	SendAt time.Time		`json:"sendAt"`
+	Created time.Time		`json:"created"`
+}
+
+/*
+* Schedule store persists pending scheduled messages so that they survive restart
+*/
+type ScheduleStore interface {
+	Save(*ScheduledMessage) error				//Save a scheduled message
+	Delete(uint64) error					//Delete a scheduled message when it's sent or cancelled
+	Load() ([]*ScheduledMessage, error)			//Load all pending scheduled messages
+}
+
+/*
+* Schedule store keeping a json file for each scheduled message in a directory
+*/
+type FileScheduleStore struct {
+	root string
+}
+
+func NewFileScheduleStore(root string) (*FileScheduleStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileScheduleStore{ root : root }, nil
+}
+
+func (s *FileScheduleStore) path(id uint64) string {
+	return filepath.Join(s.root, strconv.FormatUint(id, 10) + ".json")
+}
+
+func (s *FileScheduleStore) Save(sm *ScheduledMessage) error {
+	bs, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(sm.Id), bs)
+}
+
+func (s *FileScheduleStore) Delete(id uint64) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileScheduleStore) Load() ([]*ScheduledMessage, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	sms := make([]*ScheduledMessage, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		bs, err := ioutil.ReadFile(filepath.Join(s.root, f.Name()))
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		sm := &ScheduledMessage{}
+		if err := json.Unmarshal(bs, sm); err != nil || sm.Record == nil {
+			log.Printf("Broken scheduled message: %s\n", f.Name())
+			continue
+		}
+		sms = append(sms, sm)
+	}
+
+	return sms, nil
+}
+
+/*
+* Min-heap of scheduled messages ordered by send time
+*/
+type scheduleQueue []*ScheduledMessage
+
+func (q scheduleQueue) Len() int { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].SendAt.Before(q[j].SendAt) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *scheduleQueue) Push(x interface{}) {
+	sm := x.(*ScheduledMessage)
+	sm.index = len(*q)
+	*q = append(*q, sm)
+}
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	sm := old[len(old) - 1]
+	old[len(old) - 1] = nil
+	sm.index = -1
+	*q = old[:len(old) - 1]
+	return sm
+}
+
+/*
+* Scheduler keeps scheduled messages in a min-heap and fires them when they are due
+*/
+type Scheduler struct {
+	mutex sync.Mutex
+
+	queue scheduleQueue
+	pending map[uint64]*ScheduledMessage
+	store ScheduleStore
+
+	fire func(*ScheduledMessage)
+	wake chan int
+}
+
+func NewScheduler(store ScheduleStore, fire func(*ScheduledMessage)) *Scheduler {
+	return &Scheduler{
+		queue		: make(scheduleQueue, 0),
+		pending		: make(map[uint64]*ScheduledMessage),
+		store		: store,
+		fire		: fire,
+		wake		: make(chan int, 1),
+	}
+}
+
+/*
+* Load pending scheduled messages from store, messages due while the server was down are fired at once
+*/
+func (s *Scheduler) Load() error {
+	sms, err := s.store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, sm := range sms {
+		if _, ok := s.pending[sm.Id]; ok {
+			continue
+		}
+		s.pending[sm.Id] = sm
+		heap.Push(&s.queue, sm)
+	}
+	return nil
+}
+
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+func (s *Scheduler) run() {
+	timer := time.NewTimer(time.Hour)
+
+	for {
+		now := time.Now()
+		due := make([]*ScheduledMessage, 0)
+		wait := time.Hour
+
+		s.mutex.Lock()
+		for len(s.queue) > 0 && !s.queue[0].SendAt.After(now) {
+			sm := heap.Pop(&s.queue).(*ScheduledMessage)
+			delete(s.pending, sm.Id)
+			due = append(due, sm)
+		}
+		if len(s.queue) > 0 {
+			wait = s.queue[0].SendAt.Sub(now)
+		}
+		s.mutex.Unlock()
+
+		//a message is deleted from store before it's fired, so it's never sent twice after a crash
+		for _, sm := range due {
+			if err := s.store.Delete(sm.Id); err != nil {
+				log.Print(err)
+			}
+			s.fireMessage(sm)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) fireMessage(sm *ScheduledMessage) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Print("Scheduler error:", err)
+		}
+	}()
+
+	s.fire(sm)
+}
+
+/*
+* Add a scheduled message, it's persisted before it's accepted
+* Messages of a user are counted and added under the same lock, so the limit holds
+* for concurrent requests
+*/
+func (s *Scheduler) Add(sm *ScheduledMessage) error {
+	s.mutex.Lock()
+	count := 0
+	for _, p := range s.pending {
+		if p.Record.Sender == sm.Record.Sender {
+			count++
+		}
+	}
+
+	if count >= MaxScheduledPerUser {
+		s.mutex.Unlock()
+		return NewSendError(http.StatusForbidden, "Too many scheduled messages")
+	}
+	if err := s.store.Save(sm); err != nil {
+		s.mutex.Unlock()
+		log.Print(err)
+		return NewSendError(http.StatusInternalServerError, "Fail to save scheduled message")
+	}
+
+	s.pending[sm.Id] = sm
+	heap.Push(&s.queue, sm)
+	s.mutex.Unlock()
+
+	select {
+	case s.wake <- 1:
+	default:
+	}
+	return nil
+}
+
+/*
+* Cancel a scheduled message, only its sender can cancel it
+*/
+func (s *Scheduler) Cancel(id uint64, senderId string) error {
+	s.mutex.Lock()
+	sm, ok := s.pending[id]
+	if !ok || sm.Record.Sender != senderId {
+		s.mutex.Unlock()
+		return ErrScheduleNotFound
+	}
+	heap.Remove(&s.queue, sm.index)
+	delete(s.pending, id)
+	s.mutex.Unlock()
+
+	return s.store.Delete(id)
+}
+
+/*
+* Pending scheduled messages of a sender ordered by send time
+*/
+func (s *Scheduler) List(senderId string) []*ScheduledMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sms := make([]*ScheduledMessage, 0)
+	for _, sm := range s.pending {
+		if sm.Record.Sender == senderId {
+			sms = append(sms, sm)
+		}
+	}
+	sort.Slice(sms, func(i, j int) bool { return sms[i].SendAt.Before(sms[j].SendAt) })
+
+	return sms
+}
+
+/*
+* Parse the send time of a message, at is a time in RFC3339 and delay is seconds from now
+* Return zero time if neither is set or delay is 0, the message is sent at once then
+*/
+func ParseSendAt(at string, delay string) (time.Time, error) {
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, NewSendError(http.StatusBadRequest, "Invalid send time")
+		}
+		return t, nil
+	}
+	if delay != "" {
+		d, err := strconv.ParseInt(delay, 10, 64)
+		if err != nil || d < 0 {
+			return time.Time{}, NewSendError(http.StatusBadRequest, "Invalid send delay")
+		}
+		if d == 0 {
+			return time.Time{}, nil
+		}
+		return time.Now().Add(time.Duration(d) * time.Second), nil
+	}
+	return time.Time{}, nil
+}
+
+/*
+* Schedule a message to be sent at a time, the id of the message is the id of the schedule,
+* and the message is sent with a new id, see fireScheduled
+* Content scan and other checks are done when it's sent, and policies of receivers are
+* checked both now and when it's sent
+*/
+func (im *IM) Schedule(m Message, at time.Time) error {
+	if im.scheduler == nil {
+		return NewSendError(http.StatusBadRequest, "Scheduled message is not enabled")
+	}
+	if at.Before(time.Now()) {
+		return NewSendError(http.StatusBadRequest, "Send time is in the past")
+	}
+	if at.After(time.Now().Add(MaxScheduleAhead)) {
+		return NewSendError(http.StatusBadRequest, "Send time is too late")
+	}
+	if err := im.checkParent(m); err != nil {
+		return err
+	}
+	if err := im.checkPolicy(m); err != nil {
+		return err
+	}
+
+	if m.Id() == 0 {
+		m.SetId(im.nextMessageId())
+	}
+
+	r, err := im.registry.Record(m)
+	if err != nil {
+		return NewSendError(http.StatusBadRequest, err.Error())
+	}
+	content := r.Content
+	r.Content = nil
+
+	return im.scheduler.Add(&ScheduledMessage{
+		Id		: m.Id(),
+		SendAt		: at,
+		Created		: time.Now(),
+		Record		: r,
+		Content		: content,
+	})
+}
+
+/*
+* Send a message if at is zero, or schedule it, see SendIdempotent
+*/
+func (im *IM) SendOrSchedule(m Message, clientMsgId string, at time.Time) (uint64, bool, error) {
+	if at.IsZero() {
+		return im.SendIdempotent(m, clientMsgId)
+	}
+	return im.idempotent(m, clientMsgId, func(m Message) error { return im.Schedule(m, at) })
+}
+
+/*
+* Send a scheduled message when it's due with a new id, since devices catch up by ids of
+* messages delivered, and a message sent with the id given when it's scheduled would be
+* older than messages delivered before it
+* The sender is told the id the message is sent with, or the error if it fails
+*/
+func (im *IM) fireScheduled(sm *ScheduledMessage) {
+	r := *sm.Record
+	r.Id = im.nextMessageId()
+	r.Content = sm.Content
+
+	m, err := im.registry.Restore(&r)
+	if err == nil {
+		err = im.SendScannedMessage(m)
+	}
+
+	var n *NoticeMessage
+	if err != nil {
+		log.Print(err)
+		n = NewNoticeMessage(ScheduleFailed, err.Error())
+		n.AddMeta(MessageId, strconv.FormatUint(sm.Id, 10))
+	} else {
+		n = NewNoticeMessage(ScheduleSent, "")
+		n.AddMeta(MessageId, strconv.FormatUint(r.Id, 10))
+		n.AddMeta(ScheduleId, strconv.FormatUint(sm.Id, 10))
+	}
+	n.SetSenderId(r.Sender)
+	n.SetTargetId(r.Sender)
+	im.SendMessage(n)
+}
+
+/*
+* Serve schedule api
+* Get request lists scheduled messages of the user, return {"scheduled":[...]} in json
+* Post request cancels a scheduled message, return {"id":"xxx","status":"cancelled"} in json
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------body(post only)--------
+* {"id":"xxx"}
+*/
+func (im *IM) ServeSchedule(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		items := make([]*ScheduledItem, 0)
+		for _, sm := range im.scheduler.List(u.id) {
+			rec := *sm.Record
+			rec.Content = sm.Content
+			items = append(items, &ScheduledItem{
+				Id		: sm.Id,
+				Type		: rec.Type,
+				Target		: rec.Target,
+				Group		: rec.Group,
+				Snippet		: rec.Snippet(DefaultQuoteLength),
+				SendAt		: sm.SendAt,
+				Created		: sm.Created,
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{ "scheduled" : items })
+	case http.MethodPost:
+		body, err := readLimitedBody(r, 1024)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		req := &MessageUpdateRequest{}
+		if err := json.Unmarshal(body, req); err != nil {
+			writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid request json"))
+			return
+		}
+
+		if err := im.scheduler.Cancel(req.Id, u.id); err != nil {
+			writeAPIError(w, "", NewSendError(http.StatusNotFound, err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{ "id" : strconv.FormatUint(req.Id, 10), "status" : "cancelled" })
+	default:
+		writeAPIError(w, "", NewSendError(http.StatusMethodNotAllowed, "Only get and post are allowed"))
+	}
+}
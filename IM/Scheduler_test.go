@@ -0,0 +1,172 @@
+package IM
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+* Schedule store kept in memory for tests
+*/
+type memoryScheduleStore struct {
+	mutex sync.Mutex
+	messages map[uint64]*ScheduledMessage
+}
+
+func newMemoryScheduleStore() *memoryScheduleStore {
+	return &memoryScheduleStore{ messages : make(map[uint64]*ScheduledMessage) }
+}
+
+func (s *memoryScheduleStore) Save(sm *ScheduledMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages[sm.Id] = sm
+	return nil
+}
+func (s *memoryScheduleStore) Delete(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.messages, id)
+	return nil
+}
+func (s *memoryScheduleStore) Load() ([]*ScheduledMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sms := make([]*ScheduledMessage, 0, len(s.messages))
+	for _, sm := range s.messages {
+		sms = append(sms, sm)
+	}
+	return sms, nil
+}
+
+func newScheduledMessage(id uint64, sender string, at time.Time) *ScheduledMessage {
+	return &ScheduledMessage{
+		Id		: id,
+		SendAt		: at,
+		Created		: time.Now(),
+		Record		: &HistoryRecord{ Id : id, Type : "text", Sender : sender, Target : "b" },
+	}
+}
+
+func TestSchedulerAddCancel(t *testing.T) {
+	store := newMemoryScheduleStore()
+	s := NewScheduler(store, func(*ScheduledMessage) {})
+	now := time.Now()
+
+	for i := 1; i <= MaxScheduledPerUser; i++ {
+		if err := s.Add(newScheduledMessage(uint64(i), "a", now.Add(time.Duration(MaxScheduledPerUser - i) * time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Add(newScheduledMessage(1000, "a", now.Add(time.Hour))); err == nil {
+		t.Errorf("scheduled more than %d messages", MaxScheduledPerUser)
+	}
+	if err := s.Add(newScheduledMessage(1001, "other", now.Add(time.Hour))); err != nil {
+		t.Errorf("a user is limited by messages of another: %v", err)
+	}
+
+	list := s.List("a")
+	if len(list) != MaxScheduledPerUser {
+		t.Fatalf("got %d scheduled messages, want %d", len(list), MaxScheduledPerUser)
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i].SendAt.Before(list[i - 1].SendAt) {
+			t.Fatalf("scheduled messages are not ordered by send time")
+		}
+	}
+
+	cases := []struct {
+		name string
+		id uint64
+		sender string
+		err error
+	}{
+		{ "by sender", 1, "a", nil },
+		{ "cancelled", 1, "a", ErrScheduleNotFound },
+		{ "by another user", 2, "other", ErrScheduleNotFound },
+		{ "unknown", 2000, "a", ErrScheduleNotFound },
+	}
+	for _, c := range cases {
+		if err := s.Cancel(c.id, c.sender); err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+	}
+
+	if _, ok := store.messages[1]; ok {
+		t.Errorf("cancelled message is still saved")
+	}
+	if _, ok := store.messages[2]; !ok {
+		t.Errorf("message cancelled by another user is deleted")
+	}
+	if err := s.Add(newScheduledMessage(1000, "a", now.Add(time.Hour))); err != nil {
+		t.Errorf("got error %v after a message is cancelled", err)
+	}
+}
+
+func TestSchedulerFire(t *testing.T) {
+	store := newMemoryScheduleStore()
+	now := time.Now()
+	store.Save(newScheduledMessage(1, "a", now.Add(-time.Minute)))		//due while the server was down
+
+	fired := make(chan uint64, 3)
+	s := NewScheduler(store, func(sm *ScheduledMessage) { fired <- sm.Id })
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+
+	s.Add(newScheduledMessage(3, "a", now.Add(time.Hour)))
+	s.Add(newScheduledMessage(2, "a", now.Add(50 * time.Millisecond)))
+
+	for _, want := range []uint64{ 1, 2 } {
+		select {
+		case id := <-fired:
+			if id != want {
+				t.Errorf("got message %d fired, want %d", id, want)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("message %d is not fired", want)
+		}
+	}
+
+	if len(s.List("a")) != 1 {
+		t.Errorf("fired messages are still pending")
+	}
+	if _, ok := store.messages[2]; ok {
+		t.Errorf("fired message is still saved")
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		at string
+		delay string
+		want time.Time
+		valid bool
+	}{
+		{ "", "", time.Time{}, true },
+		{ "2026-01-02T03:04:05Z", "", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), true },
+		{ "2026-01-02T03:04:05Z", "60", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), true },
+		{ "", "60", now.Add(time.Minute), true },
+		{ "", "0", time.Time{}, true },
+		{ "2026-01-02", "", time.Time{}, false },
+		{ "", "-1", time.Time{}, false },
+		{ "", "1m", time.Time{}, false },
+	}
+
+	for _, c := range cases {
+		got, err := ParseSendAt(c.at, c.delay)
+		if (err == nil) != c.valid {
+			t.Errorf("%q %q: got error %v", c.at, c.delay, err)
+			continue
+		}
+		if d := got.Sub(c.want); d < 0 || d > time.Second {
+			t.Errorf("%q %q: got %v, want %v", c.at, c.delay, got, c.want)
+		}
+	}
+}
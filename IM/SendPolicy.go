@@ -0,0 +1,126 @@
+package IM
+
+import (
+	"net/http"
+	"strings"
+)
+
+/*
+* The sender is told a message is rejected in the same way whether it's blocked or
+* not allowed by the receive mode of the receiver, so that a block is never leaked
+*/
+var ErrMessageRejected = NewSendError(http.StatusForbidden, "Message rejected")
+
+var ErrSenderMuted = NewSendError(http.StatusForbidden, "Sender is muted")
+
+var ErrSenderBanned = NewSendError(http.StatusForbidden, "Sender is banned")
+
+var ErrSenderRoomBanned = NewSendError(http.StatusForbidden, "Sender is banned from the group")
+
+/*
+* A function to look up a user, either UserManager.UserById or UserManager.CachedUser
+*/
+type userLookup func(string) (*User, bool)
+
+/*
+* If a user accepts messages from the sender, the policy of a user unknown to this
+* server is applied by the broker when the user connects
+*/
+func accepts(lookup userLookup, id string, sender string) bool {
+	u, ok := lookup(id)
+	if !ok {
+		return true
+	}
+	return u.userFilter.IsReceived(sender)
+}
+
+/*
+* If a user is banned from a group
+*/
+func bannedFrom(lookup userLookup, id string, group string) bool {
+	u, ok := lookup(id)
+	return ok && u.BannedFrom(group)
+}
+
+/*
+* A muted or banned sender can't send, nor can a sender banned from the group of the message
+*/
+func checkSender(lookup userLookup, m Message) error {
+	u, ok := lookup(m.SenderId())
+	if !ok {
+		return nil
+	}
+	muted, banned, _ := u.Restriction()
+	if banned {
+		return ErrSenderBanned
+	}
+	if muted {
+		return ErrSenderMuted
+	}
+	if m.IsGroupMessage() && u.BannedFrom(m.GroupName()) {
+		return ErrSenderRoomBanned
+	}
+	return nil
+}
+
+/*
+* Enforce black lists and receive modes of receivers before a message is sent,
+* receivers of a group message who don't accept the sender are removed from its targets,
+* and the message is rejected only if no receiver accepts it
+* Receivers banned from the group are removed from targets as well
+* Notices are generated by the server and are not checked, and a restricted sender can't send
+*/
+func (im *IM) checkPolicy(m Message) error {
+	if im.UserManager == nil {
+		return nil
+	}
+	return enforcePolicy(im.UserManager.UserById, m)
+}
+
+/*
+* Enforce policies again when a message enters channels, since a scheduled or scanned
+* message may be sent after the sender is restricted or blocked, and messages sent by
+* SendMessage are not checked before
+* Only users cached by the user manager are checked, so that the user store is never
+* read on the way to channels
+*/
+func (im *IM) recheckPolicy(m Message) error {
+	if im.UserManager == nil {
+		return nil
+	}
+	return enforcePolicy(im.UserManager.CachedUser, m)
+}
+
+func enforcePolicy(lookup userLookup, m Message) error {
+	if m.Type() == NoticeMessageType {
+		return nil
+	}
+	if err := checkSender(lookup, m); err != nil {
+		return err
+	}
+
+	sender := m.SenderId()
+
+	if !m.IsGroupMessage() {
+		if m.TargetId() != sender && !accepts(lookup, m.TargetId(), sender) {
+			return ErrMessageRejected
+		}
+		return nil
+	}
+
+	targets := strings.Split(m.TargetId(), ";")
+	kept := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if t == sender || (accepts(lookup, t, sender) && !bannedFrom(lookup, t, m.GroupName())) {
+			kept = append(kept, t)
+		}
+	}
+
+	if len(kept) == 0 {
+		return ErrMessageRejected
+	}
+	if len(kept) != len(targets) {
+		m.SetTargetId(strings.Join(kept, ";"))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package IM
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnforcePolicy(t *testing.T) {
+	users := make(map[string]*User)
+	for _, id := range []string{ "sender", "open", "blocker", "closed", "friend", "banned", "muted" } {
+		users[id] = NewUser(id, "", DefaultTokenExpire, DefaultReceive)
+	}
+	users["blocker"].userFilter.AddToBlackList([]string{ "sender" })
+	users["closed"].userFilter.recMode = DefaultReject
+	users["friend"].userFilter.recMode = ContactsOnly
+	users["friend"].userFilter.AddContacts([]string{ "sender" })
+	users["banned"].roomBans["g"] = time.Now().Add(time.Hour)
+	users["muted"].mutedUntil = time.Now().Add(time.Hour)
+	users["banned everywhere"] = NewUser("banned everywhere", "", DefaultTokenExpire, DefaultReceive)
+	users["banned everywhere"].bannedUntil = time.Now().Add(time.Hour)
+
+	lookup := func(id string) (*User, bool) {
+		u, ok := users[id]
+		return u, ok
+	}
+
+	cases := []struct {
+		name string
+		sender string
+		target string
+		group string
+		err error
+		targets string
+	}{
+		{ "accepted", "sender", "open", "", nil, "open" },
+		{ "unknown receiver", "sender", "stranger", "", nil, "stranger" },
+		{ "to self", "blocker", "blocker", "", nil, "blocker" },
+		{ "blocked", "sender", "blocker", "", ErrMessageRejected, "blocker" },
+		{ "rejected by receive mode", "sender", "closed", "", ErrMessageRejected, "closed" },
+		{ "contact", "sender", "friend", "", nil, "friend" },
+		{ "muted sender", "muted", "open", "", ErrSenderMuted, "open" },
+		{ "banned sender", "banned everywhere", "open", "", ErrSenderBanned, "open" },
+		{ "group fan-out", "sender", "open;blocker;closed;friend;banned", "g", nil, "open;friend" },
+		{ "group keeps sender", "sender", "sender;blocker", "g", nil, "sender" },
+		{ "group without receivers", "sender", "blocker;closed", "g", ErrMessageRejected, "blocker;closed" },
+		{ "sender banned from group", "banned", "open", "g", ErrSenderRoomBanned, "open" },
+		{ "sender banned from another group", "banned", "open", "h", nil, "open" },
+	}
+
+	for _, c := range cases {
+		m := NewTextMessage("hi")
+		m.SetSenderId(c.sender)
+		m.SetTargetId(c.target)
+		if c.group != "" {
+			m.SetGroup(c.group)
+		}
+
+		if err := enforcePolicy(lookup, m); err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+		}
+		if m.TargetId() != c.targets {
+			t.Errorf("%s: got targets %q, want %q", c.name, m.TargetId(), c.targets)
+		}
+	}
+}
@@ -2,9 +2,109 @@ package IM
 
 import (
 	"net/http"
+	"io"
 	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"time"
 	"github.com/labstack/gommon/log"
 )
+
+/*
+* Error returned by the sender path, the code is the http status code
+* written back to the sender
+*/
+type SendError struct {
+	Code int
+	Reason string
+	RetryAfter time.Duration		//Time to wait before retry when the sender is rate limited
+}
+
+func (e *SendError) Error() string { return e.Reason }
+
+func NewSendError(code int, reason string) *SendError {
+	return &SendError{
+		Code		: code,
+		Reason		: reason,
+	}
+}
+
+/*
+* Write a send error back to the sender
+*/
+func WriteSendError(w http.ResponseWriter, err error) {
+	setRetryAfter(w, err)
+	if se, ok := err.(*SendError); ok {
+		http.Error(w, se.Reason, se.Code)
+	} else {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+/*
+* Read the body of a request, return a 413 error if it's larger than max size
+*/
+func readLimitedBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if maxSize > 0 && r.ContentLength > maxSize {
+		return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+	}
+
+	var reader io.Reader = r.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(r.Body, maxSize + 1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, NewSendError(http.StatusBadRequest, "Fail to read message body")
+	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return nil, NewSendError(http.StatusRequestEntityTooLarge, "Message too large")
+	}
+
+	return body, nil
+}
+
+/*
+* Check an uploaded file against the upload policy
+*/
+func checkUpload(policy *UploadPolicy, senderId string, ext string, body []byte) error {
+	if err := policy.CheckFileType(ext, body); err != nil {
+		return err
+	}
+	return policy.CheckQuota(senderId, int64(len(body)))
+}
+
+/*
+* Decoders of built-in message types, see MessageType
+* param "name" is the suffix of a picture or the file name of a file
+*/
+func decodeText(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	return NewTextMessage(string(body)), nil
+}
+func decodePicture(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	name := params["name"]
+	if name == "" {
+		log.Print("Picture Suffix Missed")
+		return nil, NewSendError(http.StatusBadRequest, "Picture suffix missed")
+	}
+	if err := checkUpload(policy, senderId, name, body); err != nil {
+		return nil, err
+	}
+	return NewPictureMessage(body, name), nil
+}
+func decodeFile(policy *UploadPolicy, senderId string, body []byte, params map[string]string) (Message, error) {
+	name := params["name"]
+	if name == "" {
+		log.Print("Filename Missed")
+		return nil, NewSendError(http.StatusBadRequest, "Filename missed")
+	}
+	if err := checkUpload(policy, senderId, filepath.Ext(name), body); err != nil {
+		return nil, err
+	}
+	return NewFileMessage(body, name), nil
+}
+
 /*
 * Send Text Message With following request format:
 * Note: message with post method
@@ -16,23 +116,44 @@ import (
 * "Message-Type":"xxxx"
 * "File-Name" : "xxxxx"  			//if it's a file message
 * "Pic-Suffix" : "xxx"   			//if it's a picture message
+* "Client-Msg-Id" : "xxx"			//optional, a retried message with the same id is sent only once
+* "Parent-Id" : "xxx"				//optional, id of the message replied to
+* "Send-At" : "xxx"				//optional, send the message at a time in RFC3339, eg: "2017-06-01T09:00:00+08:00"
+* "Send-Delay" : "xxx"				//optional, send the message after seconds, 0 sends it at once
+* "Message-TTL" : "xxx"				//optional, seconds before the message expires
+* "Expire-After-Read" : "true"			//optional, TTL counts from when the message is read
+* "Voice-Format" : "xxx"			//if it's a voice message, eg: "ogg"
+* "Voice-Duration" : "xxx"			//if it's a voice message, in milliseconds
+* "Voice-Waveform" : "xxx"			//optional for a voice message, format:"p1,p2,..." each in 0-255
 * --------------body-------------------
 * ::the content you want to send
 *
 *
 *
 * MessageType can be the the following types:
-* TextMessage 、 PictureMessage 、 FileMessage
+* TextMessage 、 PictureMessage 、 FileMessage 、 VoiceMessage
+* LocationMessage 、 ContactCardMessage 、 StickerMessage		//content in json, see Location, ContactCard and Sticker
+* or a type registered by RegisterMessageType, whose params are read from headers it declares
+*
+* Body larger than the max size of the message type is rejected with 413,
+* file of type not allowed is rejected with 415, and upload exceeding the
+* storage quota of the sender is rejected with 413
+*
+* The id of the message is returned in response header "Message-Id",
+* it's the id of the schedule if the message is scheduled
 */
 
-func SendMessageHandleFunc(r *http.Request, validateFunc func(string) (*User, error)) Message {
+func SendMessageHandleFunc(r *http.Request, validateFunc func(string) (*User, error), policy *UploadPolicy, registry *MessageRegistry) (Message, error) {
 	defer r.Body.Close()
 
 	var senderId string
 	if checkCode, ok := r.Header["Check-Code"]; ok {
 		if u, err := validateFunc(checkCode[0]); err != nil {
 			log.Print(err)
-			return nil
+			if se, ok := err.(*SendError); ok {
+				return nil, se
+			}
+			return nil, NewSendError(http.StatusUnauthorized, "Invalid check code")
 		} else {
 			senderId = u.id
 		}
@@ -45,49 +166,41 @@ func SendMessageHandleFunc(r *http.Request, validateFunc func(string) (*User, er
 				group = make([]string, 0)
 			}
 
-			body, _ := ioutil.ReadAll(r.Body)
+			body, err := readLimitedBody(r, policy.MaxSize(messageType[0]))
+			if err != nil {
+				return nil, err
+			}
 
-			switch messageType[0] {
-			case TextMessageType:
-				m := NewTextMessage(string(body))
-				log.Print("content:",string(body))
-				m.SetTargetId(targetId[0])
-				m.SetSenderId(senderId)
-				if len(group) > 0 {
-					m.SetGroup(group[0])
-				}
-				return m
-			case PictureMessageType:
-				if suffix, ok := r.Header["Pic-Suffix"]; ok {
-					m := NewPictureMessage(body, suffix[0])
-					m.SetTargetId(targetId[0])
-					m.SetSenderId(senderId)
-					if len(group) > 0 {
-						m.SetGroup(group[0])
-					}
-					return m
-				}
-				log.Print("Picture Suffix Missed")
-				break
-			case FileMessageType:
-				if fileName, ok := r.Header["File-Name"]; ok {
-					m := NewFileMessage(body, fileName[0])
-					m.SetTargetId(targetId[0])
-					m.SetSenderId(senderId)
-					if len(group) > 0 {
-						m.SetGroup(group[0])
-					}
-					return m
+			params := registry.HeaderParams(messageType[0], r.Header)
+			m, err := registry.Decode(policy, senderId, messageType[0], body, params)
+			if err != nil {
+				return nil, err
+			}
+
+			m.SetTargetId(targetId[0])
+			m.SetSenderId(senderId)
+			if len(group) > 0 {
+				m.SetGroup(group[0])
+			}
+			if parent := r.Header.Get("Parent-Id"); parent != "" {
+				if pid, err := strconv.ParseUint(parent, 10, 64); err == nil {
+					m.SetParentId(pid)
+				} else {
+					return nil, NewSendError(http.StatusBadRequest, "Invalid parent id")
 				}
-				log.Print("Filename Missed")
-				break
 			}
+			if p, err := ParseExpiry(r.Header.Get("Message-TTL"), r.Header.Get("Expire-After-Read")); err != nil {
+				return nil, err
+			} else if p != nil {
+				m.SetExpiry(time.Duration(p.TTL) * time.Second, p.AfterRead)
+			}
+			return m, nil
 		} else {
 			log.Print("Message Type Missed")
+			return nil, NewSendError(http.StatusBadRequest, "Message type missed")
 		}
 	} else {
 		log.Print("TargetId Missed")
+		return nil, NewSendError(http.StatusBadRequest, "Target id missed")
 	}
-
-	return nil
 }
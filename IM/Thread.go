@@ -0,0 +1,93 @@
+package IM
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	DefaultQuoteLength = 64			//Max characters of a quoted snippet
+)
+
+/*
+* Check the message a reply refers to, it must exist in history, belong to the same
+* conversation as the reply, and the sender of the reply must take part in it
+*/
+func (im *IM) checkParent(m Message) error {
+	if m.ParentId() == 0 {
+		return nil
+	}
+	if im.history == nil {
+		return NewSendError(http.StatusBadRequest, "History is not enabled, can't reply to a message")
+	}
+
+	//a parent the sender doesn't take part in is not found, so messages of others are never quoted by guessing ids
+	p, ok := im.history.Get(m.ParentId())
+	if !ok || !p.IsParticipant(m.SenderId()) {
+		return NewSendError(http.StatusNotFound, "Parent message not found")
+	}
+	if p.ConversationKey() != ConversationKey(m) {
+		return NewSendError(http.StatusBadRequest, "Parent message is not in the same conversation")
+	}
+	if p.Recalled {
+		return NewSendError(http.StatusBadRequest, "Parent message is recalled")
+	}
+
+	return nil
+}
+
+/*
+* Remove the quote of the parent from a frame pushed to a receiver who doesn't take part in
+* the parent, eg: a member who joins a group after the parent is sent
+*/
+func (im *IM) hideQuote(f *Frame, m Message, receiver string) {
+	if _, ok := f.Meta[Quote]; !ok || im.history == nil {
+		return
+	}
+	if p, ok := im.history.Get(m.ParentId()); !ok || !p.IsParticipant(receiver) {
+		delete(f.Meta, Quote)
+	}
+}
+
+/*
+* Serve thread api
+* Get request should obey the following format:
+* --------------headers:---------------
+* "Check-Code":"xxxxx"
+* --------------query:-----------------
+* id=xxx			//id of the message which starts the thread
+*
+* Return {"parent":{...},"replies":[...]} in json, replies are in order of message id
+*/
+func (im *IM) ServeThread(w http.ResponseWriter, r *http.Request) {
+	u, err := im.Validate(r.Header.Get("Check-Code"))
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusUnauthorized, "Invalid check code"))
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, "", NewSendError(http.StatusBadRequest, "Invalid message id"))
+		return
+	}
+
+	p, ok := im.history.Get(id)
+	if !ok || !p.IsParticipant(u.id) {
+		writeAPIError(w, "", NewSendError(http.StatusNotFound, ErrRecordNotFound.Error()))
+		return
+	}
+
+	replies := im.history.Thread(id)
+	items := make([]*HistoryItem, 0, len(replies))
+	for _, rec := range replies {
+		if rec.IsParticipant(u.id) {
+			items = append(items, im.historyItem(rec))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"parent"	: im.historyItem(p),
+		"replies"	: items,
+	})
+}
@@ -0,0 +1,89 @@
+package IM
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newThreadTestIM() *IM {
+	im := NewIM("localhost")
+	im.history = NewMemoryHistory(10)
+	im.history.Add(&HistoryRecord{ Id : 1, Type : TextMessageType, Sender : "a", Target : "b", Content : []byte("direct") })
+	im.history.Add(&HistoryRecord{ Id : 2, Type : TextMessageType, Sender : "a", Target : "b;c", Group : "g", Content : []byte("group") })
+	im.history.Add(&HistoryRecord{ Id : 3, Type : TextMessageType, Sender : "a", Target : "b", Content : []byte("recalled"), Recalled : true })
+	return im
+}
+
+func newReply(sender string, target string, group string, parent uint64) Message {
+	m := NewTextMessage("reply")
+	m.SetSenderId(sender)
+	m.SetTargetId(target)
+	if group != "" {
+		m.SetGroup(group)
+	}
+	m.SetParentId(parent)
+	return m
+}
+
+func TestCheckParent(t *testing.T) {
+	im := newThreadTestIM()
+
+	cases := []struct {
+		name string
+		m Message
+		code int
+	}{
+		{ "not a reply", newReply("b", "a", "", 0), 0 },
+		{ "reply by receiver", newReply("b", "a", "", 1), 0 },
+		{ "reply by sender", newReply("a", "b", "", 1), 0 },
+		{ "unknown parent", newReply("b", "a", "", 100), http.StatusNotFound },
+		{ "other conversation", newReply("b", "c", "", 1), http.StatusBadRequest },
+		{ "group reply by member", newReply("c", "a;b", "g", 2), 0 },
+		{ "group reply by user not in parent", newReply("d", "a;b", "g", 2), http.StatusNotFound },
+		{ "direct parent in group", newReply("b", "a", "g", 1), http.StatusBadRequest },
+		{ "recalled parent", newReply("b", "a", "", 3), http.StatusBadRequest },
+	}
+
+	for _, c := range cases {
+		err := im.checkParent(c.m)
+		code := 0
+		if se, ok := err.(*SendError); ok {
+			code = se.Code
+		} else if err != nil {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, code, c.code)
+		}
+	}
+
+	im.history = nil
+	if err := im.checkParent(newReply("b", "a", "", 1)); err == nil {
+		t.Errorf("reply is accepted without history")
+	}
+}
+
+func TestHideQuote(t *testing.T) {
+	im := newThreadTestIM()
+	m := newReply("c", "a;b;d", "g", 2)
+
+	cases := []struct {
+		receiver string
+		quoted bool
+	}{
+		{ "a", true },
+		{ "b", true },
+		{ "c", true },
+		{ "d", false },
+	}
+
+	for _, c := range cases {
+		f := NewFrame(TextMessageType, "reply")
+		f.AddMeta(Quote, "group")
+		im.hideQuote(f, m, c.receiver)
+		if _, ok := f.Meta[Quote]; ok != c.quoted {
+			t.Errorf("%s: quoted %v, want %v", c.receiver, ok, c.quoted)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package IM
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTokenExpire = time.Hour * 24
+	DefaultRefreshExpire = time.Hour * 24 * 30
+	DefaultKeyGracePeriod = time.Hour			//Tokens signed by an old key are valid in this period after rotation
+
+	//Types of tokens, a check code is an access token
+	TokenAccess = "access"
+	TokenRefresh = "refresh"
+)
+
+var (
+	ErrInvalidToken = errors.New("Invalid token")
+	ErrTokenExpired = errors.New("Token expired")
+	ErrTokenRevoked = errors.New("Token revoked")
+	ErrUserBanned = errors.New("User banned")
+)
+
+/*
+* Claims carried by an access token, compatible with JWT
+*/
+type TokenClaims struct {
+	Id string			`json:"jti"`			//Token id used to revoke it
+	Type string			`json:"typ,omitempty"`		//TokenAccess or TokenRefresh
+	Subject string			`json:"sub"`			//User id
+	IssuedAt int64			`json:"iat"`			//Unix seconds
+	IssuedAtNano int64		`json:"iatn,omitempty"`		//Unix nanoseconds, tokens revoked before it are told from tokens issued in the same second
+	ExpiresAt int64			`json:"exp"`			//Unix seconds
+	ReceiveMode uint8		`json:"rm"`			//DefaultReceive or DefaultReject
+	FilterVersion uint64		`json:"fv"`			//Version of receive, black and mute lists when it's issued
+	Device string			`json:"did,omitempty"`		//Device the token is issued to
+	Platform string			`json:"plt,omitempty"`		//Platform of the device, eg: ios, android, web
+}
+
+type tokenHeader struct {
+	Alg string			`json:"alg"`
+	Typ string			`json:"typ"`
+	Kid string			`json:"kid"`
+}
+
+/*
+* A key used to sign tokens, a retired key still validates tokens until it's out of grace period
+*/
+type signingKey struct {
+	id string
+	key []byte
+	retired time.Time
+}
+
+func newSigningKey(secret string) *signingKey {
+	sum := sha256.Sum256([]byte(secret))
+	return &signingKey{
+		id		: hex.EncodeToString(sum[:4]),
+		key		: []byte(secret),
+	}
+}
+
+/*
+* TokenSigner issues and validates HMAC-SHA256 signed tokens in JWT format,
+* so that a token can be validated by any server sharing the key without any state
+*/
+type TokenSigner struct {
+	mutex sync.RWMutex
+
+	keys []*signingKey			//Current key is the first one
+	grace time.Duration
+}
+
+func NewTokenSigner(secret string) *TokenSigner {
+	return &TokenSigner{
+		keys		: []*signingKey{ newSigningKey(secret) },
+		grace		: DefaultKeyGracePeriod,
+	}
+}
+
+func (s *TokenSigner) SetGracePeriod(grace time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.grace = grace
+}
+
+/*
+* Sign tokens with a new key, the old key is honored in grace period
+*/
+func (s *TokenSigner) Rotate(secret string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.keys[0].retired = now
+
+	keys := []*signingKey{ newSigningKey(secret) }
+	for _, k := range s.keys {
+		if now.Sub(k.retired) < s.grace {
+			keys = append(keys, k)
+		}
+	}
+	s.keys = keys
+}
+
+/*
+* Get a key by its id, return false if it's unknown or out of grace period
+*/
+func (s *TokenSigner) key(id string) (*signingKey, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for i, k := range s.keys {
+		if k.id != id {
+			continue
+		}
+		if i > 0 && time.Now().Sub(k.retired) >= s.grace {
+			return nil, false
+		}
+		return k, true
+	}
+	return nil, false
+}
+
+/*
+* A random id of a token
+*/
+func newTokenId() string {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		sum := sha256.Sum256([]byte(time.Now().String()))
+		return hex.EncodeToString(sum[:16])
+	}
+	return hex.EncodeToString(bs)
+}
+
+func sign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+* Sign a token, a token id is generated if it's not set
+*/
+func (s *TokenSigner) Sign(claims *TokenClaims) (string, error) {
+	if claims.Id == "" {
+		claims.Id = newTokenId()
+	}
+
+	s.mutex.RLock()
+	k := s.keys[0]
+	s.mutex.RUnlock()
+
+	header, err := json.Marshal(&tokenHeader{ Alg : "HS256", Typ : "JWT", Kid : k.id })
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + sign(k.key, data), nil
+}
+
+/*
+* Validate a token and return its claims
+*/
+func (s *TokenSigner) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	header := &tokenHeader{}
+	if err := json.Unmarshal(bs, header); err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	k, ok := s.key(header.Kid)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(sign(k.key, parts[0] + "." + parts[1])), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+
+	bs, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &TokenClaims{}
+	if err := json.Unmarshal(bs, claims); err != nil || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return claims, nil
+}
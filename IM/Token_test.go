@@ -0,0 +1,102 @@
+package IM
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClaims(subject string, ttl time.Duration) *TokenClaims {
+	now := time.Now()
+	return &TokenClaims{
+		Type		: TokenAccess,
+		Subject		: subject,
+		IssuedAt	: now.Unix(),
+		ExpiresAt	: now.Add(ttl).Unix(),
+		Device		: "phone",
+	}
+}
+
+func TestTokenSignVerify(t *testing.T) {
+	s := NewTokenSigner("secret")
+	token, err := s.Sign(newTestClaims("u1", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	expired, err := s.Sign(newTestClaims("u1", -time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSubject, err := s.Sign(newTestClaims("", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := NewTokenSigner("other").Sign(newTestClaims("u1", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		token string
+		err error
+	}{
+		{ "valid", token, nil },
+		{ "expired", expired, ErrTokenExpired },
+		{ "no subject", noSubject, ErrInvalidToken },
+		{ "signed by another key", foreign, ErrInvalidToken },
+		{ "tampered payload", parts[0] + "." + parts[1] + "x." + parts[2], ErrInvalidToken },
+		{ "tampered signature", parts[0] + "." + parts[1] + "." + parts[2][1:], ErrInvalidToken },
+		{ "missing part", parts[0] + "." + parts[1], ErrInvalidToken },
+		{ "empty", "", ErrInvalidToken },
+	}
+
+	for _, c := range cases {
+		claims, err := s.Verify(c.token)
+		if err != c.err {
+			t.Errorf("%s: got error %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err == nil && (claims.Subject != "u1" || claims.Device != "phone" || claims.Id == "") {
+			t.Errorf("%s: got claims %+v", c.name, claims)
+		}
+	}
+}
+
+func TestTokenRotate(t *testing.T) {
+	cases := []struct {
+		name string
+		grace time.Duration
+		oldValid bool
+	}{
+		{ "in grace period", time.Hour, true },
+		{ "no grace period", 0, false },
+	}
+
+	for _, c := range cases {
+		s := NewTokenSigner("first")
+		s.SetGracePeriod(c.grace)
+
+		old, err := s.Sign(newTestClaims("u1", time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Rotate("second")
+		current, err := s.Sign(newTestClaims("u1", time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Verify(old); (err == nil) != c.oldValid {
+			t.Errorf("%s: token of the old key got error %v", c.name, err)
+		}
+		if _, err := s.Verify(current); err != nil {
+			t.Errorf("%s: token of the new key got error %v", c.name, err)
+		}
+		if _, err := NewTokenSigner("second").Verify(old); err != ErrInvalidToken {
+			t.Errorf("%s: token of the old key is valid for a signer without it", c.name)
+		}
+	}
+}
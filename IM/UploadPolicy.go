@@ -0,0 +1,258 @@
+package IM
+
+import (
+	"sync"
+	"strings"
+	"net/http"
+	"fmt"
+)
+
+const (
+	DefaultMaxMessageSize = 10 << 20		//10MB
+	DefaultUserStorageQuota = 0			//No quota
+)
+
+/*
+* Upload policy limits what a user can send through the sender path
+* ---max size of a message body, configured per message type
+* ---storage quota of a user, counted over the files kept by the file proxies
+* ---file types allowed or denied, matched against file extension and sniffed mime type
+*/
+type UploadPolicy struct {
+	mutex sync.RWMutex
+
+	defaultMaxSize int64
+	maxSizes map[string]int64
+
+	userQuota int64
+	usage func(string) int64			//Storage currently used by a user
+	reserved map[string]int64			//Storage reserved by contents not in file proxies yet
+
+	allowedTypes map[string]uint8
+	deniedTypes map[string]uint8
+}
+
+func NewUploadPolicy() *UploadPolicy {
+	return &UploadPolicy{
+		defaultMaxSize		: DefaultMaxMessageSize,
+		maxSizes		: make(map[string]int64),
+		userQuota		: DefaultUserStorageQuota,
+		usage			: func(string) int64 { return 0 },
+		reserved		: make(map[string]int64),
+		allowedTypes		: make(map[string]uint8),
+		deniedTypes		: make(map[string]uint8),
+	}
+}
+
+/*
+* Set max body size of a type of message, set message type to "" to change the default size
+*/
+func (p *UploadPolicy) SetMaxSize(messageType string, size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if messageType == "" {
+		p.defaultMaxSize = size
+	} else {
+		p.maxSizes[messageType] = size
+	}
+}
+func (p *UploadPolicy) MaxSize(messageType string) int64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if s, ok := p.maxSizes[messageType]; ok {
+		return s
+	}
+	return p.defaultMaxSize
+}
+
+/*
+* Max body size of a request of any message type
+*/
+func (p *UploadPolicy) MaxRequestSize() int64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	max := p.defaultMaxSize
+	for _, s := range p.maxSizes {
+		if s > max {
+			max = s
+		}
+	}
+	return max
+}
+
+/*
+* Set storage quota of every user, 0 means no quota
+*/
+func (p *UploadPolicy) SetUserQuota(quota int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.userQuota = quota
+}
+func (p *UploadPolicy) SetUsageFunc(f func(string) int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.usage = f
+}
+
+/*
+* Set allowed and denied file types. A type is either an extension like ".png"
+* or a mime type like "image/png", a mime type like "image/*" matches all sub types
+* When allow list is not empty, only types in it are accepted
+*/
+func (p *UploadPolicy) SetFileTypes(allowed []string, denied []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.allowedTypes = make(map[string]uint8)
+	p.deniedTypes = make(map[string]uint8)
+
+	for _, t := range allowed {
+		p.allowedTypes[normalizeFileType(t)] = 0
+	}
+	for _, t := range denied {
+		p.deniedTypes[normalizeFileType(t)] = 0
+	}
+}
+
+func normalizeFileType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if !strings.Contains(t, "/") && !strings.HasPrefix(t, ".") {
+		t = "." + t
+	}
+	return t
+}
+
+/*
+* Sniff mime type of content without parameters, eg: "text/plain; charset=utf-8" -> "text/plain"
+*/
+func SniffMimeType(content []byte) string {
+	mime := http.DetectContentType(content)
+	if i := strings.Index(mime, ";"); i != -1 {
+		mime = mime[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(mime))
+}
+
+func matchFileType(types map[string]uint8, ext string, mime string) bool {
+	if _, ok := types[ext]; ok && ext != "" {
+		return true
+	}
+	if _, ok := types[mime]; ok {
+		return true
+	}
+	if i := strings.Index(mime, "/"); i != -1 {
+		if _, ok := types[mime[:i] + "/*"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+* Check if a file with the extension and content is acceptable
+*/
+func (p *UploadPolicy) CheckFileType(ext string, content []byte) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	ext = normalizeFileType(ext)
+	if ext == "." {
+		ext = ""
+	}
+	mime := SniffMimeType(content)
+
+	if matchFileType(p.deniedTypes, ext, mime) {
+		return NewSendError(http.StatusUnsupportedMediaType, fmt.Sprintf("File type not allowed(%s %s)", ext, mime))
+	}
+	if len(p.allowedTypes) > 0 && !matchFileType(p.allowedTypes, ext, mime) {
+		return NewSendError(http.StatusUnsupportedMediaType, fmt.Sprintf("File type not allowed(%s %s)", ext, mime))
+	}
+
+	return nil
+}
+
+/*
+* Check if a user can store another size bytes
+* Anonymous senders have no quota of their own, so they can't upload when there's a quota
+*/
+func (p *UploadPolicy) CheckQuota(id string, size int64) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.checkQuota(id, size)
+}
+
+/*
+* Reserve size bytes of the storage quota of a user, the bytes are counted until
+* the returned function is called, so that contents queued or being scanned are counted
+* before they're kept by file proxies
+*/
+func (p *UploadPolicy) Reserve(id string, size int64) (func(), error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.userQuota <= 0 {
+		return func() {}, nil
+	}
+	if err := p.checkQuota(id, size); err != nil {
+		return nil, err
+	}
+
+	p.reserved[id] += size
+	var once sync.Once
+	return func() { once.Do(func() { p.release(id, size) }) }, nil
+}
+
+func (p *UploadPolicy) release(id string, size int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.reserved[id] -= size; p.reserved[id] <= 0 {
+		delete(p.reserved, id)
+	}
+}
+
+/*
+* Note: caller must hold the mutex
+*/
+func (p *UploadPolicy) checkQuota(id string, size int64) error {
+	if p.userQuota <= 0 {
+		return nil
+	}
+	if id == "" {
+		return NewSendError(http.StatusUnauthorized, "Check code required to upload")
+	}
+	if p.usage(id) + p.reserved[id] + size > p.userQuota {
+		return NewSendError(http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+	}
+
+	return nil
+}
+
+/*
+* Reserve storage quota of the sender for the content of a message, the reservation
+* is released when the message is finished, by then the content is either kept
+* by a file proxy or dropped
+*/
+func (im *IM) reserveQuota(m Message) error {
+	_, content, ok := scannedContent(m)
+	if !ok {
+		return nil
+	}
+
+	release, err := im.uploadPolicy.Reserve(m.SenderId(), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	if fm, ok := m.(interface{ OnFinish(func()) }); ok {
+		fm.OnFinish(release)
+	} else {
+		release()
+	}
+	return nil
+}
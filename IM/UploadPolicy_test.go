@@ -0,0 +1,127 @@
+package IM
+
+import (
+	"net/http"
+	"testing"
+)
+
+func sendErrorCode(err error) int {
+	if se, ok := err.(*SendError); ok {
+		return se.Code
+	}
+	return 0
+}
+
+func TestUploadPolicyMaxSize(t *testing.T) {
+	p := NewUploadPolicy()
+	p.SetMaxSize("", 100)
+	p.SetMaxSize(PictureMessageType, 1000)
+	p.SetMaxSize(TextMessageType, 10)
+
+	cases := []struct {
+		messageType string
+		size int64
+	}{
+		{ PictureMessageType, 1000 },
+		{ TextMessageType, 10 },
+		{ FileMessageType, 100 },
+	}
+
+	for _, c := range cases {
+		if size := p.MaxSize(c.messageType); size != c.size {
+			t.Errorf("%s: got max size %d, want %d", c.messageType, size, c.size)
+		}
+	}
+	if size := p.MaxRequestSize(); size != 1000 {
+		t.Errorf("got max request size %d, want 1000", size)
+	}
+}
+
+func TestUploadPolicyFileTypes(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	text := []byte("hello")
+
+	cases := []struct {
+		name string
+		allowed []string
+		denied []string
+		ext string
+		content []byte
+		ok bool
+	}{
+		{ "no policy", nil, nil, "exe", text, true },
+		{ "denied by extension", nil, []string{ "exe" }, "exe", text, false },
+		{ "denied by extension case", nil, []string{ ".EXE" }, "Exe", text, false },
+		{ "denied by mime", nil, []string{ "image/png" }, "", png, false },
+		{ "denied by wildcard", nil, []string{ "image/*" }, "dat", png, false },
+		{ "allowed by wildcard", []string{ "image/*" }, nil, "", png, true },
+		{ "not allowed", []string{ "image/*" }, nil, "txt", text, false },
+		{ "allowed by extension", []string{ "txt" }, nil, "txt", text, true },
+		{ "denied over allowed", []string{ "image/*" }, []string{ "png" }, "png", png, false },
+	}
+
+	for _, c := range cases {
+		p := NewUploadPolicy()
+		p.SetFileTypes(c.allowed, c.denied)
+		err := p.CheckFileType(c.ext, c.content)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got error %v", c.name, err)
+		} else if err != nil && sendErrorCode(err) != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: got code %d", c.name, sendErrorCode(err))
+		}
+	}
+}
+
+func TestUploadPolicyQuota(t *testing.T) {
+	p := NewUploadPolicy()
+	if err := p.CheckQuota("", 1 << 30); err != nil {
+		t.Errorf("got error %v without quota", err)
+	}
+
+	usage := map[string]int64{ "a" : 60 }
+	p.SetUserQuota(100)
+	p.SetUsageFunc(func(id string) int64 { return usage[id] })
+
+	cases := []struct {
+		name string
+		id string
+		size int64
+		code int
+	}{
+		{ "anonymous", "", 1, http.StatusUnauthorized },
+		{ "within quota", "a", 40, 0 },
+		{ "over quota", "a", 41, http.StatusRequestEntityTooLarge },
+		{ "another user", "b", 100, 0 },
+	}
+
+	for _, c := range cases {
+		if code := sendErrorCode(p.CheckQuota(c.id, c.size)); code != c.code {
+			t.Errorf("%s: got code %d, want %d", c.name, code, c.code)
+		}
+	}
+}
+
+func TestUploadPolicyReserve(t *testing.T) {
+	p := NewUploadPolicy()
+	p.SetUserQuota(100)
+
+	release, err := p.Reserve("a", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Reserve("a", 41); sendErrorCode(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("got error %v reserving over quota", err)
+	}
+	if err := p.CheckQuota("a", 41); err == nil {
+		t.Errorf("reserved storage isn't counted by quota check")
+	}
+
+	release()
+	release()
+	if p.reserved["a"] != 0 {
+		t.Errorf("got %d bytes reserved after release", p.reserved["a"])
+	}
+	if _, err := p.Reserve("a", 100); err != nil {
+		t.Errorf("got error %v after release", err)
+	}
+}
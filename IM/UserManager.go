@@ -2,9 +2,8 @@ package IM
 
 import (
 	"sync"
-	"crypto/md5"
+	"sync/atomic"
 	"time"
-	"encoding/hex"
 	"errors"
 	"net/http"
 	"strconv"
@@ -16,6 +15,7 @@ import (
 const (
 	DefaultReceive = iota
 	DefaultReject
+	ContactsOnly				//Only messages from contacts and users in receive list are received
 )
 
 /*
@@ -24,38 +24,269 @@ const (
 *
 * You can also update the secret key dynamically as long as the server
 * hold the origin key, and update through function UpdateSecretKey
+*
+* Check codes are tokens signed by the secret key, see TokenSigner, so that they
+* survive restart and can be validated by every server sharing the secret key
+*
+* Users and the secret key are kept in a UserStore, and hot users are cached
 */
 type UserManager struct {
 	mutex sync.RWMutex
 
 	secretKey string
-	users map[string]*User
+	signer *TokenSigner
+	revoked *RevocationList
+	store UserStore
+	byId map[string]*User			//Cached users, latest registered user of each id
+	onRevoke func(string, string)		//Called with user id and device id when tokens of the user are revoked, device is empty for all devices
+	onContact func(string, string, string, string)	//Called with kind, user changing the relation, the other user and message when contacts change
+	contactMutex sync.Mutex
+	revokeMutex sync.Mutex			//Serialize saves of the revocation list
 
 	ticker *time.Ticker
 }
 
 func NewUserManager(secretKey string) *UserManager {
+	store := NewMemoryUserStore()
+	store.SaveSecretKey(secretKey)
+
 	return &UserManager{
 		secretKey		: secretKey,
-		users			: make(map[string]*User),
+		signer			: NewTokenSigner(secretKey),
+		revoked			: NewRevocationList(),
+		store			: store,
+		byId			: make(map[string]*User),
+		onRevoke		: func(string, string) {},
+		onContact		: func(string, string, string, string) {},
+	}
+}
+
+/*
+* Keep users in a store, the secret key saved in the store takes the place of the
+* one passed to NewUserManager, since it's updated before restart
+* Note: call it before serving
+*/
+func (m *UserManager) SetStore(store UserStore) error {
+	key, err := store.SecretKey()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if key == "" {
+		if err := store.SaveSecretKey(m.secretKey); err != nil {
+			return err
+		}
+	} else if key != m.secretKey {
+		m.secretKey = key
+		m.signer = NewTokenSigner(key)
+	}
+
+	revocations, err := store.Revocations()
+	if err != nil {
+		return err
+	}
+	if revocations != nil {
+		m.revoked = NewRevocationListFromRecord(revocations)
+	}
+
+	m.store = store
+	m.byId = make(map[string]*User)
+	return nil
+}
+
+/*
+* Get a user from cache, or load it from the store and cache it
+*/
+func (m *UserManager) user(id string) (*User, bool) {
+	u, err := m.loadUser(id)
+	if err != nil && err != ErrUserNotFound {
+		log.Print(err)
+	}
+	return u, err == nil
+}
+
+/*
+* Get a user like user, return ErrUserNotFound if the user is unknown or expired, or the error
+* of the store, so that a user is created only if it's not found
+*/
+func (m *UserManager) loadUser(id string) (*User, error) {
+	m.mutex.RLock()
+	u, ok := m.byId[id]
+	m.mutex.RUnlock()
+
+	if !ok {
+		r, err := m.store.Load(id)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Sub(r.Created) > DefaultRefreshExpire && !r.Restricted() {
+			return nil, ErrUserNotFound
+		}
+
+		nu := NewUserFromRecord(r)
+		m.mutex.Lock()
+		if u, ok = m.byId[id]; !ok {
+			m.byId[id] = nu
+			u = nu
+		}
+		m.mutex.Unlock()
+	}
+
+	u.touch()
+	return u, nil
+}
+
+/*
+* Save a user to the store
+*/
+func (m *UserManager) save(u *User) {
+	if err := m.store.Save(u.Record()); err != nil {
+		log.Print("Fail to save user:", err)
+	}
+}
+
+/*
+* Save the revocation list to the store after it changes
+*/
+func (m *UserManager) saveRevocations() {
+	m.revokeMutex.Lock()
+	defer m.revokeMutex.Unlock()
+
+	if err := m.store.SaveRevocations(m.revoked.Record()); err != nil {
+		log.Print("Fail to save revocation list:", err)
 	}
 }
 
+func (m *UserManager) SetRevokeCallback(onRevoke func(string, string)) {
+	m.onRevoke = onRevoke
+}
+func (m *UserManager) SetContactCallback(onContact func(string, string, string, string)) {
+	m.onContact = onContact
+}
+
 
 /*
 * A user of IM
 */
 type User struct {
-	checkCode string
+	checkCode string			//Latest token issued to the user
 	id string
 	createTime time.Time
 	expireTime time.Duration
+	filterVersion uint64			//Increased when receive, black or mute list changes
 
 	mutex sync.Mutex
 	disabled bool
+	devices map[string]*Device
+	requests map[string]*FriendRequest	//Pending friend requests by the other user
+	mutedUntil time.Time			//The user can't send messages before it
+	bannedUntil time.Time			//The user can't sign in before it
+	restrictReason string
+	roomBans map[string]time.Time		//Groups the user can't send to or receive from before a time
+	accessed int64				//When the user is accessed last time(unix seconds), used to evict it from cache
 
 	userFilter UserFilter
 }
+func (u *User) touch() {
+	atomic.StoreInt64(&u.accessed, time.Now().Unix())
+}
+func (u *User) idle() time.Duration {
+	return time.Now().Sub(time.Unix(atomic.LoadInt64(&u.accessed), 0))
+}
+/*
+* Version of the receive, black and mute lists, it's changed under the mutex with the lists
+*/
+func (u *User) FilterVersion() uint64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.filterVersion
+}
+/*
+* Take the receive mode and filter version of a token issued by another server with newer
+* lists of the user, lists kept by this server are not changed
+* Return false if the version of the token is not newer
+*/
+func (u *User) adoptFilter(recMode uint8, version uint64) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if version <= u.filterVersion {
+		return false
+	}
+	u.filterVersion = version
+
+	u.userFilter.mutex.Lock()
+	u.userFilter.recMode = recMode
+	u.userFilter.mutex.Unlock()
+	return true
+}
+/*
+* If the user is muted or banned now
+*/
+func (u *User) Restriction() (muted bool, banned bool, reason string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+	return now.Before(u.mutedUntil), now.Before(u.bannedUntil), u.restrictReason
+}
+/*
+* If the user is muted, banned, or banned from any group now
+*/
+func (u *User) Restricted() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return restricted(time.Now(), u.mutedUntil, u.bannedUntil, u.roomBans)
+}
+func restricted(now time.Time, mutedUntil time.Time, bannedUntil time.Time, roomBans map[string]time.Time) bool {
+	if now.Before(mutedUntil) || now.Before(bannedUntil) {
+		return true
+	}
+	for _, until := range roomBans {
+		if now.Before(until) {
+			return true
+		}
+	}
+	return false
+}
+/*
+* If the user is banned from a group now
+*/
+func (u *User) BannedFrom(group string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	until, ok := u.roomBans[group]
+	return ok && time.Now().Before(until)
+}
+/*
+* Copy state of the user replaced by a new registration, the old user may still be used
+* by live streams, so its maps are copied under its lock instead of shared
+* Devices are shared since each device has its own lock
+*/
+func (u *User) inherit(old *User) {
+	old.mutex.Lock()
+	defer old.mutex.Unlock()
+
+	u.filterVersion = old.filterVersion + 1
+	for id, d := range old.devices {
+		u.devices[id] = d
+	}
+	for other, fr := range old.requests {
+		c := *fr
+		u.requests[other] = &c
+	}
+	for g, until := range old.roomBans {
+		u.roomBans[g] = until
+	}
+	u.mutedUntil, u.bannedUntil, u.restrictReason = old.mutedUntil, old.bannedUntil, old.restrictReason
+	u.userFilter.AddContacts(old.userFilter.sorted(old.userFilter.contacts))
+}
 func (u* User) Invalidate() {
 	u.mutex.Lock()
 	u.disabled = true
@@ -82,6 +313,10 @@ func (u *User) ParseParams(params string) {
 			us := strings.Split(content, ";")
 			u.userFilter.AddToBlackList(us)
 			break
+		case "ML":
+			gs := strings.Split(content, ";")
+			u.userFilter.AddToMuteList(gs)
+			break
 		default:
 		}
 	}
@@ -90,11 +325,17 @@ func NewUser(id string, checkCode string, expireTime time.Duration, recMode uint
 	u := &User{
 		id		: id,
 		checkCode	: checkCode,
+		createTime	: time.Now(),
 		expireTime	: expireTime,
+		devices		: make(map[string]*Device),
+		requests	: make(map[string]*FriendRequest),
+		roomBans	: make(map[string]time.Time),
 
 		userFilter	: UserFilter{
+			contacts	: make(map[string]uint8),
 			receiveList	: make(map[string]uint8),
 			blackList	: make(map[string]uint8),
+			muteList	: make(map[string]uint8),
 			recMode		: recMode,
 		},
 	}
@@ -106,42 +347,81 @@ func NewUser(id string, checkCode string, expireTime time.Duration, recMode uint
 	return u
 }
 
+/*
+* Lists of a user, the filter is read by brokers of live streams and by senders while
+* it's changed, so it has its own lock
+*/
 type UserFilter struct {
+	mutex sync.RWMutex
+
 	recMode uint8
 	blackList map[string]uint8
 	receiveList map[string]uint8
+	muteList map[string]uint8		//Muted groups, which don't trigger offline notifications
+	contacts map[string]uint8
 }
 
-func (f *UserFilter) AddToReceiveList(users []string) {
-	for _, u := range users {
-		f.receiveList[u] = 0
+func (f *UserFilter) add(list map[string]uint8, ids []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range ids {
+		list[id] = 0
 	}
 }
-func (f *UserFilter) RemoveFromReceiveList(users []string) {
-	for _, u := range users {
-		delete(f.receiveList, u)
+func (f *UserFilter) remove(list map[string]uint8, ids []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range ids {
+		delete(list, id)
 	}
 }
-func (f *UserFilter) AddToBlackList(users []string) {
-	for _, u := range users {
-		f.blackList[u] = 0
-	}
+func (f *UserFilter) has(list map[string]uint8, id string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	_, ok := list[id]
+	return ok
 }
-func (f *UserFilter) RemoveFromBlackList(users []string) {
-	for _, u := range users {
-		delete(f.blackList, u)
-	}
+func (f *UserFilter) sorted(list map[string]uint8) []string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return sortedKeys(list)
 }
+
+func (f *UserFilter) AddToReceiveList(users []string) { f.add(f.receiveList, users) }
+func (f *UserFilter) RemoveFromReceiveList(users []string) { f.remove(f.receiveList, users) }
+func (f *UserFilter) AddToBlackList(users []string) { f.add(f.blackList, users) }
+func (f *UserFilter) RemoveFromBlackList(users []string) { f.remove(f.blackList, users) }
+func (f *UserFilter) AddToMuteList(groups []string) { f.add(f.muteList, groups) }
+func (f *UserFilter) RemoveFromMuteList(groups []string) { f.remove(f.muteList, groups) }
+func (f *UserFilter) AddContacts(users []string) { f.add(f.contacts, users) }
+func (f *UserFilter) RemoveContacts(users []string) { f.remove(f.contacts, users) }
+func (f *UserFilter) IsMuted(group string) bool { return f.has(f.muteList, group) }
+func (f *UserFilter) IsBlocked(id string) bool { return f.has(f.blackList, id) }
+func (f *UserFilter) IsContact(id string) bool { return f.has(f.contacts, id) }
 func (f *UserFilter) IsReceived(id string) bool {
-	for s := range f.blackList {
-		if s == id {
-			return false
-		}
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	return f.isReceived(id)
+}
+/*
+* Note: caller must hold the mutex
+*/
+func (f *UserFilter) isReceived(id string) bool {
+	if _, ok := f.blackList[id]; ok {
+		return false
 	}
-	for s := range f.receiveList {
-		if s == id {
-			return true
-		}
+	if _, ok := f.receiveList[id]; ok {
+		return true
+	}
+
+	if f.recMode == ContactsOnly {
+		_, ok := f.contacts[id]
+		return ok
 	}
 
 	if f.recMode == DefaultReceive {
@@ -150,11 +430,22 @@ func (f *UserFilter) IsReceived(id string) bool {
 		return false
 	}
 }
+/*
+* Filter messages by senders, only the black list applies to notices,
+* eg: a friend request from a user not in contacts
+*/
 func (f *UserFilter) Filter(src_ms []Message) []Message {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
 	res_ms := make([]Message, 0, 5)
 	for _, m := range src_ms {
 		sid := m.SenderId()
-		if f.IsReceived(sid) {
+		if m.Type() == NoticeMessageType {
+			if _, blocked := f.blackList[sid]; !blocked {
+				res_ms = append(res_ms, m)
+			}
+		} else if f.isReceived(sid) {
 			res_ms = append(res_ms, m)
 		}
 	}
@@ -162,69 +453,361 @@ func (f *UserFilter) Filter(src_ms []Message) []Message {
 	return res_ms
 }
 
-func NewCheckCode(id string) (string, error) {
-	h := md5.New()
-	h.Write([]byte(id + time.Now().String()))
-	return hex.EncodeToString(h.Sum(nil)), nil
+/*
+* Issue a check code and a refresh token to a device of a user, device may be empty
+* Note: caller must hold the mutex
+*/
+func (m *UserManager) newTokens(u *User, device string, platform string) (string, string, error) {
+	now := time.Now()
+	claims := TokenClaims{
+		Type		: TokenAccess,
+		Subject		: u.id,
+		IssuedAt	: now.Unix(),
+		IssuedAtNano	: now.UnixNano(),
+		ExpiresAt	: now.Add(u.expireTime).Unix(),
+		ReceiveMode	: u.userFilter.recMode,
+		FilterVersion	: u.FilterVersion(),
+		Device		: device,
+		Platform	: platform,
+	}
+	checkCode, err := m.signer.Sign(&claims)
+	if err != nil {
+		return "", "", err
+	}
+
+	claims.Id = ""
+	claims.Type = TokenRefresh
+	claims.ExpiresAt = now.Add(DefaultRefreshExpire).Unix()
+	refreshToken, err := m.signer.Sign(&claims)
+	if err != nil {
+		return "", "", err
+	}
+
+	u.checkCode = checkCode
+	u.createTime = now
+	if device != "" {
+		u.Device(device, platform)
+	}
+	return checkCode, refreshToken, nil
 }
 
 /*
-* Register a user with user's id and the secret key
+* Register a user with user's id and the secret key, return a signed token as the check code
 */
 func (m *UserManager) RegisterUser(validation string, id string, expireTime time.Duration, recMode uint8, params... string) (string, error) {
-	m.mutex.RLock()
-	sk := m.secretKey
-	m.mutex.RUnlock()
+	checkCode, _, err := m.RegisterUserWithRefresh(validation, id, expireTime, recMode, params...)
+	return checkCode, err
+}
 
-	if validation == sk {
-		checkCode, err := NewCheckCode(id)
-		if err != nil {
-			log.Print(err)
-			return "", err
+/*
+* Register a user and return a check code and a refresh token, which is used to get
+* a new check code by Refresh without the secret key
+*/
+func (m *UserManager) RegisterUserWithRefresh(validation string, id string, expireTime time.Duration, recMode uint8, params... string) (string, string, error) {
+	return m.RegisterDevice(validation, id, "", "", expireTime, recMode, params...)
+}
+
+/*
+* Register a device of a user, each device has its own tokens and delivery cursor,
+* and can be signed out without affecting other devices
+*/
+func (m *UserManager) RegisterDevice(validation string, id string, device string, platform string, expireTime time.Duration, recMode uint8, params... string) (string, string, error) {
+	if !m.CheckSecretKey(validation) {
+		return "", "", errors.New("Error: sercret key not match")
+	}
+	if expireTime <= 0 {
+		expireTime = DefaultTokenExpire
+	}
+
+	u := NewUser(id, "", expireTime, recMode, params...)
+	u.touch()
+	old, err := m.loadUser(id)
+	if err != nil && err != ErrUserNotFound {
+		log.Print(err)
+		return "", "", err
+	}
+	ok := err == nil
+	if ok {
+		if _, banned, _ := old.Restriction(); banned {
+			return "", "", ErrUserBanned
 		}
+	}
 
-		m.mutex.Lock()
-		m.users[checkCode] = NewUser(id, checkCode, expireTime, recMode, params...)
+	m.mutex.Lock()
+	if ok {
+		u.inherit(old)
+	}
+
+	checkCode, refreshToken, err := m.newTokens(u, device, platform)
+	if err != nil {
 		m.mutex.Unlock()
+		log.Print(err)
+		return "", "", err
+	}
+	m.byId[id] = u
+	m.mutex.Unlock()
 
-		return checkCode, nil
-	} else {
-		return "", errors.New("Error: sercret key not match")
+	m.save(u)
+	return checkCode, refreshToken, nil
+}
+
+/*
+* Exchange a refresh token for a new check code and a new refresh token,
+* the old refresh token is revoked so that it can be used only once
+*/
+func (m *UserManager) Refresh(refreshToken string) (string, string, error) {
+	claims, err := m.signer.Verify(refreshToken)
+	if err != nil {
+		return "", "", err
+	}
+	if claims.Type != TokenRefresh {
+		return "", "", ErrInvalidToken
+	}
+
+	//the user is loaded before the token is used, so the token is kept if the store fails
+	u, err := m.loadUser(claims.Subject)
+	if err != nil && err != ErrUserNotFound {
+		log.Print(err)
+		return "", "", err
+	}
+	found := err == nil
+	if found {
+		if _, banned, _ := u.Restriction(); banned {
+			return "", "", ErrUserBanned
+		}
+	}
+
+	if !m.revoked.Use(claims) {
+		return "", "", ErrTokenRevoked
+	}
+	m.saveRevocations()
+
+	if found {
+		u.adoptFilter(claims.ReceiveMode, claims.FilterVersion)
+	}
+
+	m.mutex.Lock()
+	if !found {
+		if cu, ok := m.byId[claims.Subject]; ok {
+			u = cu
+		} else {
+			u = NewUser(claims.Subject, "", DefaultTokenExpire, claims.ReceiveMode)
+			u.filterVersion = claims.FilterVersion
+			u.touch()
+			m.byId[claims.Subject] = u
+		}
+	}
+
+	checkCode, newRefresh, err := m.newTokens(u, claims.Device, claims.Platform)
+	m.mutex.Unlock()
+	if err != nil {
+		return "", "", err
+	}
+
+	m.save(u)
+	return checkCode, newRefresh, nil
+}
+
+/*
+* Revoke a check code, and the refresh token of the same user if it's set,
+* or revoke all tokens of the user if all is true
+* Live streams of the user are closed
+*/
+func (m *UserManager) Revoke(checkCode string, refreshToken string, all bool) error {
+	claims, err := m.signer.Verify(checkCode)
+	if err != nil {
+		return err
+	}
+	if claims.Type == TokenRefresh || !m.revoked.Use(claims) {
+		return ErrInvalidToken
+	}
+
+	if refreshToken != "" {
+		if rc, err := m.signer.Verify(refreshToken); err == nil && rc.Subject == claims.Subject {
+			m.revoked.RevokeToken(rc)
+		}
+	}
+	if all {
+		m.revoked.RevokeUser(claims.Subject)
+		m.saveRevocations()
+		m.onRevoke(claims.Subject, "")
+		return nil
+	}
+	m.saveRevocations()
+
+	if u, ok := m.UserById(claims.Subject); ok && claims.Device != "" && u.RemoveDevice(claims.Device) {
+		m.save(u)
+	}
+	m.onRevoke(claims.Subject, claims.Device)
+	return nil
+}
+
+/*
+* Sign out a device of a user remotely, all tokens of the device are revoked
+* and live streams of the device are closed
+* Tokens are revoked even if the device is unknown, eg: it's not saved before restart
+*/
+func (m *UserManager) SignOut(id string, device string) error {
+	if device == "" {
+		return NewSendError(http.StatusBadRequest, "Device missed")
+	}
+	if u, ok := m.UserById(id); ok && u.RemoveDevice(device) {
+		m.save(u)
 	}
+
+	m.revoked.RevokeDevice(id, device)
+	m.saveRevocations()
+	m.onRevoke(id, device)
+	return nil
 }
 
+/*
+* Cached users by id
+*/
 func (m *UserManager) Users() map[string]*User {
-	return m.users
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := make(map[string]*User, len(m.byId))
+	for id, u := range m.byId {
+		users[id] = u
+	}
+	return users
+}
+
+/*
+* Get the latest registered user of an id, it's loaded from the store if it's not cached
+*/
+func (m *UserManager) UserById(id string) (*User, bool) {
+	return m.user(id)
+}
+
+/*
+* Get a user cached in memory, the store is not read
+*/
+func (m *UserManager) CachedUser(id string) (*User, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	u, ok := m.byId[id]
+	return u, ok
+}
+
+/*
+* If a user muted a group
+*/
+func (m *UserManager) IsMuted(id string, group string) bool {
+	if u, ok := m.UserById(id); ok {
+		return u.userFilter.IsMuted(group)
+	}
+	return false
+}
+
+/*
+* Check if the key matches the secret key
+*/
+func (m *UserManager) CheckSecretKey(key string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return key != "" && key == m.secretKey
 }
 
 /*
 * Update the secret key with validation
 */
 func (m *UserManager) UpdateSecretKey(validation string, newKey string) error {
-	if validation == m.secretKey {
+	if m.CheckSecretKey(validation) && newKey != "" {
 		m.mutex.Lock()
 		m.secretKey = newKey
 		m.mutex.Unlock()
 
+		//tokens signed by the old key are honored in grace period
+		m.signer.Rotate(newKey)
+		if err := m.store.SaveSecretKey(newKey); err != nil {
+			log.Print("Fail to save secret key:", err)
+		}
+
 		return nil
 	} else {
 		return errors.New("Error: sercret key not match")
 	}
 }
 
+/*
+* Set the period in which tokens signed by the old key are valid after UpdateSecretKey
+*/
+func (m *UserManager) SetKeyGracePeriod(grace time.Duration) {
+	m.signer.SetGracePeriod(grace)
+}
+
 /*
 * Get a registered user by passing the checkCode returned by RegisterUser
+* The check code is validated by its signature, a user unknown to this server, eg: registered
+* on another server or before restart, is created from the claims of the check code
 */
 func (m *UserManager) Validate(checkCode string) (*User, error) {
-	if u, ok := m.users[checkCode]; ok {
-		if !u.disabled {
-			return u, nil
-		} else {
-			return nil, errors.New("user expired")
+	u, _, err := m.ValidateClaims(checkCode)
+	return u, err
+}
+
+/*
+* Validate a check code and return the user and claims of it, last seen time of
+* the device of the check code is updated
+*/
+func (m *UserManager) ValidateClaims(checkCode string) (*User, *TokenClaims, error) {
+	claims, err := m.signer.Verify(checkCode)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.Type == TokenRefresh {
+		return nil, nil, ErrInvalidToken
+	}
+	if m.revoked.IsRevoked(claims) {
+		return nil, nil, ErrTokenRevoked
+	}
+
+	//a user is created from the claims only if it's not found, eg: the token is issued by
+	//another server, a user failed to load is never replaced, so its record is kept
+	u, err := m.loadUser(claims.Subject)
+	if err == ErrUserNotFound {
+		expireTime := time.Unix(claims.ExpiresAt, 0).Sub(time.Unix(claims.IssuedAt, 0))
+		nu := NewUser(claims.Subject, checkCode, expireTime, claims.ReceiveMode)
+		nu.createTime = time.Unix(claims.IssuedAt, 0)
+		nu.filterVersion = claims.FilterVersion
+
+		nu.touch()
+
+		cached := false
+		m.mutex.Lock()
+		if u, cached = m.byId[claims.Subject]; !cached {
+			m.byId[claims.Subject] = nu
+			u = nu
+		}
+		m.mutex.Unlock()
+
+		if !cached {
+			m.save(u)
+		}
+	} else if err != nil {
+		log.Print(err)
+		return nil, nil, err
+	} else if u.adoptFilter(claims.ReceiveMode, claims.FilterVersion) {
+		m.save(u)
+	}
+
+	if u.disabled {
+		return nil, nil, errors.New("user expired")
+	}
+	if _, banned, _ := u.Restriction(); banned {
+		return nil, nil, ErrUserBanned
+	}
+	if claims.Device != "" {
+		if _, created := u.Device(claims.Device, claims.Platform); created {
+			m.save(u)
 		}
-	} else {
-		return nil, errors.New("no user matched")
 	}
+	return u, claims, nil
 }
 func (m *UserManager) StartExpireCheck(d time.Duration) {
 	if m.ticker != nil {
@@ -252,20 +835,35 @@ func (m *UserManager) ExpireCheck() {
 			break
 		}
 
-		expired := make([]*User, 0, 100)
-
-		for _, u := range m.users {
-			if time.Now().Sub(u.createTime) > u.expireTime {
+		//a user is kept until its refresh token expires, and is evicted from cache when
+		//it's idle, cached users are saved so that cursors of devices are kept
+		hot := make([]*User, 0)
+		m.mutex.Lock()
+		for id, u := range m.byId {
+			//restrictions are kept until they end, even if the user never signs in again
+			if time.Now().Sub(u.createTime) > DefaultRefreshExpire && !u.Restricted() {
 				u.Invalidate()
-				expired = append(expired, u)
+				delete(m.byId, id)
+				m.store.Delete(id)
+				continue
 			}
-		}
 
-		m.mutex.Lock()
-		for _, u := range expired {
-			delete(m.users, u.checkCode)
+			hot = append(hot, u)
+			if u.idle() > DefaultUserCacheIdle {
+				delete(m.byId, id)
+			}
 		}
 		m.mutex.Unlock()
+
+		for _, u := range hot {
+			m.save(u)
+		}
+		if err := m.store.DeleteBefore(time.Now().Add(-DefaultRefreshExpire)); err != nil {
+			log.Print(err)
+		}
+
+		m.revoked.Sweep()
+		m.saveRevocations()
 	}
 }
 
@@ -276,14 +874,20 @@ func (m *UserManager) ExpireCheck() {
 * "User-Id":"xxxx"
 * "Secret-Key":"xxxxx"
 * "Expire-Time":"xxxxxx"    //minite
-* "Received-Mode":"xxxxx"   //choices : "DefaultReceive" 、 "DefaultReject"
+* "Received-Mode":"xxxxx"   //choices : "DefaultReceive" 、 "DefaultReject" 、 "ContactsOnly"
+* "Device-Id":"xxxxx"		//optional, id of the device, each device has its own tokens and delivery cursor
+* "Platform":"xxxxx"		//optional, platform of the device, eg: ios, android, web
 * "Content-Type":"text/plain"
 * -------------Content----------------
 * BL:user1;user2;...;		//black list
 * RL:user1;user2;...;		//receive list
+* ML:group1;group2;...;		//mute list, muted groups don't trigger offline notifications unless the user is mentioned
 *
 * Return data format is:
-* stateCode;checkCode
+* stateCode;checkCode;refreshToken
+*
+* The check code is a signed token in JWT format, which carries user id, expire time,
+* receive mode and version of the lists
 *
 * eg1:ok;xxxxxxxxx
 * eg2:error;xxxxxxxx
@@ -312,6 +916,9 @@ func (m *UserManager) ServeRegister(w http.ResponseWriter, r *http.Request) {
 					case "DefaultReject":
 						recMode = DefaultReject
 						break
+					case "ContactsOnly":
+						recMode = ContactsOnly
+						break
 					default:
 						recMode = DefaultReceive
 					}
@@ -321,8 +928,8 @@ func (m *UserManager) ServeRegister(w http.ResponseWriter, r *http.Request) {
 
 				body, _ := ioutil.ReadAll(r.Body)
 				log.Print(string(body))
-				if checkCode, err := m.RegisterUser(secretKey[0], userId[0], expireTime, recMode, string(body)); err == nil {
-					w.Write([]byte("ok;" + checkCode))
+				if checkCode, refreshToken, err := m.RegisterDevice(secretKey[0], userId[0], r.Header.Get("Device-Id"), r.Header.Get("Platform"), expireTime, recMode, string(body)); err == nil {
+					w.Write([]byte("ok;" + checkCode + ";" + refreshToken))
 				} else {
 					w.Write([]byte("error;"))
 				}
@@ -339,7 +946,7 @@ func (m *UserManager) ServeRegister(w http.ResponseWriter, r *http.Request) {
 * Put request should obey the following format:
 * ----------------Headers-----------------------
 * "User-CheckCode":"xxxxx"
-* "List":"xxxxx"			//list can be "RL" "BL"
+* "List":"xxxxx"			//list can be "RL" "BL" "ML"
 * ----------------Content-----------------------
 * Add u1;u2				//Add users to the list
 * Del u1;u2				//Del users from the list
@@ -348,9 +955,18 @@ func (m *UserManager) ServeUpdateReceiveList(w http.ResponseWriter, r * http.Req
 	defer r.Body.Close()
 
 	if check, ok := r.Header["User-CheckCode"]; ok {
-		if list, ok := r.Header["List"]; ok && (list[0] == "RL" || list[0] == "BL") {
+		u, err := m.Validate(check[0])
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		if list, ok := r.Header["List"]; ok && (list[0] == "RL" || list[0] == "BL" || list[0] == "ML") {
 			body, _ := ioutil.ReadAll(r.Body)
 
+			u.mutex.Lock()
+			u.filterVersion++
+
 			cmds := strings.Split(string(body), "\n")
 			for _, cmd := range cmds {
 				parts := strings.Split(cmd, " ")
@@ -362,22 +978,29 @@ func (m *UserManager) ServeUpdateReceiveList(w http.ResponseWriter, r * http.Req
 				case "Add":
 					us := strings.Split(parts[1], ";")
 					if list[0] == "RL" {
-						m.users[check[0]].userFilter.AddToReceiveList(us)
+						u.userFilter.AddToReceiveList(us)
+					} else if list[0] == "ML" {
+						u.userFilter.AddToMuteList(us)
 					} else {
-						m.users[check[0]].userFilter.AddToBlackList(us)
+						u.userFilter.AddToBlackList(us)
 					}
 					break
 				case "Del":
 					us := strings.Split(parts[1], ";")
 					if list[0] == "RL" {
-						m.users[check[0]].userFilter.RemoveFromReceiveList(us)
+						u.userFilter.RemoveFromReceiveList(us)
+					} else if list[0] == "ML" {
+						u.userFilter.RemoveFromMuteList(us)
 					} else {
-						m.users[check[0]].userFilter.RemoveFromBlackList(us)
+						u.userFilter.RemoveFromBlackList(us)
 					}
 					break
 				default:
 				}
 			}
+			u.mutex.Unlock()
+
+			m.save(u)
 		} else { log.Print("update list not set") }
 	} else { log.Print("user not set") }
 }
@@ -404,3 +1027,41 @@ func (m *UserManager) ServeUpdateKey(w http.ResponseWriter, r *http.Request) {
 	} else { w.Write([]byte("error;")) }
 }
 
+/*
+* Post request should obey the following format:
+* --------------Headers-------------------
+* "Refresh-Token":"xxxxx"
+*
+* Return format:
+* stateCode;checkCode;refreshToken
+*
+* The refresh token can be used only once, use the new one next time
+*/
+func (m *UserManager) ServeRefresh(w http.ResponseWriter, r *http.Request) {
+	if refreshToken, ok := r.Header["Refresh-Token"]; ok {
+		if checkCode, newRefresh, err := m.Refresh(refreshToken[0]); err == nil {
+			w.Write([]byte("ok;" + checkCode + ";" + newRefresh))
+		} else {
+			log.Print(err)
+			w.Write([]byte("error;"))
+		}
+	} else { w.Write([]byte("error;")) }
+}
+
+/*
+* Post request should obey the following format:
+* --------------Headers-------------------
+* "User-CheckCode":"xxxxx"
+* "Refresh-Token":"xxxxx"		//optional, revoked together with the check code
+* "All":"true"				//optional, revoke all tokens of the user
+*
+* Return format:
+* stateCode;
+*/
+func (m *UserManager) ServeRevoke(w http.ResponseWriter, r *http.Request) {
+	if check, ok := r.Header["User-CheckCode"]; ok {
+		if err := m.Revoke(check[0], r.Header.Get("Refresh-Token"), r.Header.Get("All") == "true"); err == nil {
+			w.Write([]byte("ok;"))
+		} else { w.Write([]byte("error;")) }
+	} else { w.Write([]byte("error;")) }
+}
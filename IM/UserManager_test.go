@@ -0,0 +1,126 @@
+package IM
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+* User store failing to load users, saves are counted
+*/
+type brokenUserStore struct {
+	*MemoryUserStore
+	err error
+	saves int
+}
+
+func (s *brokenUserStore) Load(id string) (*UserRecord, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.MemoryUserStore.Load(id)
+}
+func (s *brokenUserStore) Save(r *UserRecord) error {
+	s.saves++
+	return s.MemoryUserStore.Save(r)
+}
+
+func signTestToken(t *testing.T, m *UserManager, typ string, subject string, version uint64) string {
+	now := time.Now()
+	token, err := m.signer.Sign(&TokenClaims{
+		Id		: subject + typ,
+		Type		: typ,
+		Subject		: subject,
+		IssuedAt	: now.Unix(),
+		IssuedAtNano	: now.UnixNano(),
+		ExpiresAt	: now.Add(time.Hour).Unix(),
+		ReceiveMode	: ContactsOnly,
+		FilterVersion	: version,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateClaimsStoreErrors(t *testing.T) {
+	broken := errors.New("broken disk")
+	stored := &UserRecord{ Id : "u1", Contacts : []string{ "friend" }, FilterVersion : 1, Created : time.Now() }
+
+	cases := []struct {
+		name string
+		record *UserRecord
+		err error
+		version uint64
+		valid bool
+		contacts []string
+		recMode uint8
+	}{
+		{ "unknown user", nil, nil, 1, true, []string{}, ContactsOnly },
+		{ "stored user", stored, nil, 1, true, []string{ "friend" }, DefaultReceive },
+		{ "token with newer lists", stored, nil, 2, true, []string{ "friend" }, ContactsOnly },
+		{ "store fails", stored, broken, 2, false, nil, 0 },
+	}
+
+	for _, c := range cases {
+		m := NewUserManager("secret")
+		store := &brokenUserStore{ MemoryUserStore : NewMemoryUserStore() }
+		if err := m.SetStore(store); err != nil {
+			t.Fatal(err)
+		}
+		if c.record != nil {
+			store.MemoryUserStore.Save(c.record)
+		}
+		store.err = c.err
+
+		u, _, err := m.ValidateClaims(signTestToken(t, m, TokenAccess, "u1", c.version))
+		if (err == nil) != c.valid {
+			t.Errorf("%s: got error %v", c.name, err)
+			continue
+		}
+		if !c.valid {
+			if store.saves != 0 {
+				t.Errorf("%s: user is saved over the stored record", c.name)
+			}
+			continue
+		}
+
+		if got := u.userFilter.sorted(u.userFilter.contacts); !reflect.DeepEqual(got, c.contacts) {
+			t.Errorf("%s: got contacts %v, want %v", c.name, got, c.contacts)
+		}
+		if u.userFilter.recMode != c.recMode {
+			t.Errorf("%s: got receive mode %d, want %d", c.name, u.userFilter.recMode, c.recMode)
+		}
+		if r, err := store.MemoryUserStore.Load("u1"); err != nil || (c.record != nil && len(r.Contacts) != 1) {
+			t.Errorf("%s: got stored record %+v and error %v", c.name, r, err)
+		}
+	}
+}
+
+func TestRefreshStoreErrors(t *testing.T) {
+	m := NewUserManager("secret")
+	store := &brokenUserStore{ MemoryUserStore : NewMemoryUserStore(), err : errors.New("broken disk") }
+	if err := m.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+	store.MemoryUserStore.Save(&UserRecord{ Id : "u1", Contacts : []string{ "friend" }, Created : time.Now() })
+
+	refresh := signTestToken(t, m, TokenRefresh, "u1", 1)
+	if _, _, err := m.Refresh(refresh); err == nil {
+		t.Fatal("refresh succeeds while the store fails")
+	}
+	if store.saves != 0 {
+		t.Errorf("user is saved over the stored record")
+	}
+
+	//the refresh token is not used up by the failure
+	store.err = nil
+	if _, _, err := m.Refresh(refresh); err != nil {
+		t.Fatalf("got error %v after the store recovers", err)
+	}
+	if r, _ := store.MemoryUserStore.Load("u1"); len(r.Contacts) != 1 {
+		t.Errorf("contacts are lost after refresh: %+v", r)
+	}
+}
@@ -0,0 +1,414 @@
+package IM
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultUserRootPath = "IM_USER"
+	DefaultUserCacheIdle = time.Hour		//A cached user not accessed in this period is evicted from cache
+)
+
+var ErrUserNotFound = errors.New("No such user")
+
+/*
+* A user kept in user store, lists of the filter are sorted
+*/
+type UserRecord struct {
+	Id string			`json:"id"`
+	ReceiveMode uint8		`json:"receiveMode"`
+	ReceiveList []string		`json:"receiveList,omitempty"`
+	BlackList []string		`json:"blackList,omitempty"`
+	MuteList []string		`json:"muteList,omitempty"`
+	Contacts []string		`json:"contacts,omitempty"`
+	Requests []FriendRequest	`json:"requests,omitempty"`		//Pending friend requests sent by or sent to the user
+	FilterVersion uint64		`json:"filterVersion"`
+	ExpireTime time.Duration	`json:"expireTime"`			//Life time of check codes issued to the user
+	Created time.Time		`json:"created"`			//When tokens are issued to the user last time
+	Devices []DeviceInfo		`json:"devices,omitempty"`
+	MutedUntil time.Time		`json:"mutedUntil,omitempty"`
+	BannedUntil time.Time		`json:"bannedUntil,omitempty"`
+	RestrictReason string		`json:"restrictReason,omitempty"`
+	RoomBans map[string]time.Time	`json:"roomBans,omitempty"`		//Group -> when the ban of the user from it ends
+}
+
+/*
+* UserStore keeps users and the secret key, so that they survive restart
+* UserManager caches hot users and delegates to the store
+*/
+type UserStore interface {
+	Load(string) (*UserRecord, error)			//Load a user by id, return ErrUserNotFound if it's unknown
+	Ids() ([]string, error)					//Ids of all users
+	Save(*UserRecord) error					//Save a user
+	Delete(string) error					//Delete a user
+	DeleteBefore(time.Time) error				//Delete users whose tokens are issued before a time, except restricted users
+	SecretKey() (string, error)				//Get the secret key saved, empty if it's never saved
+	SaveSecretKey(string) error				//Save the secret key when it's updated
+	Revocations() (*RevocationRecord, error)		//Get the revocation list saved, nil if it's never saved
+	SaveRevocations(*RevocationRecord) error		//Save the revocation list when it changes
+}
+
+func sortedKeys(m map[string]uint8) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+/*
+* Record of the user to be saved in user store
+*/
+func (u *User) Record() *UserRecord {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	r := &UserRecord{
+		Id		: u.id,
+		ReceiveMode	: u.userFilter.recMode,
+		ReceiveList	: u.userFilter.sorted(u.userFilter.receiveList),
+		BlackList	: u.userFilter.sorted(u.userFilter.blackList),
+		MuteList	: u.userFilter.sorted(u.userFilter.muteList),
+		Contacts	: u.userFilter.sorted(u.userFilter.contacts),
+		Requests	: make([]FriendRequest, 0, len(u.requests)),
+		FilterVersion	: u.filterVersion,
+		ExpireTime	: u.expireTime,
+		Created		: u.createTime,
+		Devices		: make([]DeviceInfo, 0, len(u.devices)),
+		MutedUntil	: u.mutedUntil,
+		BannedUntil	: u.bannedUntil,
+		RestrictReason	: u.restrictReason,
+		RoomBans	: make(map[string]time.Time, len(u.roomBans)),
+	}
+	for g, until := range u.roomBans {
+		r.RoomBans[g] = until
+	}
+	for _, d := range u.devices {
+		r.Devices = append(r.Devices, d.Info())
+	}
+	for _, fr := range u.requests {
+		r.Requests = append(r.Requests, *fr)
+	}
+	sort.Slice(r.Requests, func(i, j int) bool { return r.Requests[i].Created.Before(r.Requests[j].Created) })
+	sort.Slice(r.Devices, func(i, j int) bool { return r.Devices[i].Created.Before(r.Devices[j].Created) })
+
+	return r
+}
+
+/*
+* If the user is muted, banned, or banned from any group now
+*/
+func (r *UserRecord) Restricted() bool {
+	return restricted(time.Now(), r.MutedUntil, r.BannedUntil, r.RoomBans)
+}
+
+/*
+* Create a user from a record loaded from user store
+*/
+func NewUserFromRecord(r *UserRecord) *User {
+	u := NewUser(r.Id, "", r.ExpireTime, r.ReceiveMode)
+	u.createTime = r.Created
+	u.filterVersion = r.FilterVersion
+	u.mutedUntil = r.MutedUntil
+	u.bannedUntil = r.BannedUntil
+	u.restrictReason = r.RestrictReason
+	for g, until := range r.RoomBans {
+		u.roomBans[g] = until
+	}
+	u.userFilter.AddToReceiveList(r.ReceiveList)
+	u.userFilter.AddToBlackList(r.BlackList)
+	u.userFilter.AddToMuteList(r.MuteList)
+	u.userFilter.AddContacts(r.Contacts)
+	for i := range r.Requests {
+		fr := r.Requests[i]
+		if fr.From == r.Id {
+			u.requests[fr.To] = &fr
+		} else {
+			u.requests[fr.From] = &fr
+		}
+	}
+
+	for _, info := range r.Devices {
+		u.devices[info.Id] = &Device{
+			id		: info.Id,
+			platform	: info.Platform,
+			created		: info.Created,
+			lastSeen	: info.LastSeen,
+			cursor		: info.Cursor,
+		}
+	}
+
+	return u
+}
+
+/*
+* User store kept in memory, which doesn't survive restart
+*/
+type MemoryUserStore struct {
+	mutex sync.RWMutex
+
+	users map[string]*UserRecord
+	secretKey string
+	revocations *RevocationRecord
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users		: make(map[string]*UserRecord),
+	}
+}
+
+func (s *MemoryUserStore) Load(id string) (*UserRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	r, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *MemoryUserStore) Ids() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ids := make([]string, 0, len(s.users))
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *MemoryUserStore) Save(r *UserRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := *r
+	s.users[r.Id] = &c
+	return nil
+}
+
+func (s *MemoryUserStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryUserStore) DeleteBefore(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, r := range s.users {
+		if r.Created.Before(t) && !r.Restricted() {
+			delete(s.users, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryUserStore) SecretKey() (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.secretKey, nil
+}
+
+func (s *MemoryUserStore) SaveSecretKey(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.secretKey = key
+	return nil
+}
+
+func (s *MemoryUserStore) Revocations() (*RevocationRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.revocations, nil
+}
+
+func (s *MemoryUserStore) SaveRevocations(r *RevocationRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.revocations = r
+	return nil
+}
+
+/*
+* User store which saves each user in a json file under the root, named by hex of the user id,
+* the secret key in file "secret.key" and the revocation list in file "revocations.list"
+*/
+type FileUserStore struct {
+	root string
+}
+
+func NewFileUserStore(root string) (*FileUserStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &FileUserStore{ root : root }, nil
+}
+
+func (s *FileUserStore) path(id string) string {
+	return filepath.Join(s.root, hex.EncodeToString([]byte(id)) + ".json")
+}
+
+/*
+* Write a file to a temp file in the same directory first and rename it, so a crash never
+* leaves a broken file, it's used by all file stores
+* Each write has its own temp file, so concurrent writes of a file never mix their bytes
+*/
+func writeFileAtomic(path string, bs []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path) + ".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) Load(id string) (*UserRecord, error) {
+	bs, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &UserRecord{}
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *FileUserStore) Ids() ([]string, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		id, err := hex.DecodeString(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, string(id))
+	}
+	return ids, nil
+}
+
+func (s *FileUserStore) Save(r *UserRecord) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(r.Id), bs)
+}
+
+func (s *FileUserStore) Delete(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileUserStore) DeleteBefore(t time.Time) error {
+	files, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(s.root, f.Name())
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		r := &UserRecord{}
+		if err := json.Unmarshal(bs, r); err != nil {
+			log.Printf("Broken user file: %s\n", f.Name())
+			continue
+		}
+		if r.Created.Before(t) && !r.Restricted() {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+func (s *FileUserStore) SecretKey() (string, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(s.root, "secret.key"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(bs), err
+}
+
+func (s *FileUserStore) SaveSecretKey(key string) error {
+	return writeFileAtomic(filepath.Join(s.root, "secret.key"), []byte(key))
+}
+
+func (s *FileUserStore) Revocations() (*RevocationRecord, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(s.root, "revocations.list"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RevocationRecord{}
+	if err := json.Unmarshal(bs, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (s *FileUserStore) SaveRevocations(r *RevocationRecord) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.root, "revocations.list"), bs)
+}
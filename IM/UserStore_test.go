@@ -0,0 +1,144 @@
+package IM
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestFileUserStoreRoundTrip(t *testing.T) {
+	s, err := NewFileUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []*UserRecord{
+		{ Id : "plain", Created : created, ExpireTime : DefaultTokenExpire },
+		{
+			Id		: "lists",
+			ReceiveMode	: ContactsOnly,
+			ReceiveList	: []string{ "a", "b" },
+			BlackList	: []string{ "c" },
+			MuteList	: []string{ "g" },
+			Contacts	: []string{ "d" },
+			FilterVersion	: 3,
+			Created		: created,
+		},
+		{
+			Id		: "restricted/..\\id",
+			MutedUntil	: created.Add(time.Hour),
+			RestrictReason	: "spam",
+			RoomBans	: map[string]time.Time{ "g" : created.Add(time.Hour) },
+			Created		: created,
+		},
+	}
+
+	for _, r := range cases {
+		if err := s.Save(r); err != nil {
+			t.Fatalf("%s: %v", r.Id, err)
+		}
+		got, err := s.Load(r.Id)
+		if err != nil {
+			t.Errorf("%s: %v", r.Id, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, r) {
+			t.Errorf("%s: got %+v, want %+v", r.Id, got, r)
+		}
+	}
+
+	ids, err := s.Ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if want := []string{ "lists", "plain", "restricted/..\\id" }; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %q, want %q", ids, want)
+	}
+
+	if err := s.Delete("plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("plain"); err != ErrUserNotFound {
+		t.Errorf("got error %v loading a deleted user", err)
+	}
+	if err := s.Delete("plain"); err != nil {
+		t.Errorf("got error %v deleting a deleted user", err)
+	}
+}
+
+func TestFileUserStoreDeleteBefore(t *testing.T) {
+	s, err := NewFileUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	cases := []struct {
+		record *UserRecord
+		kept bool
+	}{
+		{ &UserRecord{ Id : "old", Created : now.Add(-time.Hour) }, false },
+		{ &UserRecord{ Id : "new", Created : now.Add(time.Hour) }, true },
+		{ &UserRecord{ Id : "muted", Created : now.Add(-time.Hour), MutedUntil : now.Add(time.Hour) }, true },
+		{ &UserRecord{ Id : "unmuted", Created : now.Add(-time.Hour), MutedUntil : now.Add(-time.Minute) }, false },
+		{ &UserRecord{ Id : "room banned", Created : now.Add(-time.Hour), RoomBans : map[string]time.Time{ "g" : now.Add(time.Hour) } }, true },
+	}
+
+	for _, c := range cases {
+		if err := s.Save(c.record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.DeleteBefore(now); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		if _, err := s.Load(c.record.Id); (err == nil) != c.kept {
+			t.Errorf("%s: got error %v, kept should be %v", c.record.Id, err, c.kept)
+		}
+	}
+}
+
+func TestFileUserStoreSecrets(t *testing.T) {
+	s, err := NewFileUserStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := s.SecretKey(); key != "" || err != nil {
+		t.Errorf("got key %q and error %v before it's saved", key, err)
+	}
+	if r, err := s.Revocations(); r != nil || err != nil {
+		t.Errorf("got revocations %+v and error %v before they are saved", r, err)
+	}
+
+	for _, key := range []string{ "first", "second" } {
+		if err := s.SaveSecretKey(key); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.SecretKey(); got != key || err != nil {
+			t.Errorf("got key %q and error %v, want %q", got, err, key)
+		}
+	}
+
+	r := &RevocationRecord{
+		Tokens		: map[string]time.Time{ "t1" : time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) },
+		Users		: map[string]int64{ "u1" : 10 },
+		Devices		: map[string]int64{ "u1\nphone" : 20 },
+	}
+	if err := s.SaveRevocations(r); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Revocations(); err != nil || !reflect.DeepEqual(got, r) {
+		t.Errorf("got revocations %+v and error %v, want %+v", got, err, r)
+	}
+
+	//files of the key and revocations are not users
+	if ids, err := s.Ids(); err != nil || len(ids) != 0 {
+		t.Errorf("got ids %q and error %v", ids, err)
+	}
+}